@@ -0,0 +1,596 @@
+package main
+
+import (
+	"HyDFS/ring"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A copy of a file that missed an append keeps lagging behind the others, a copy that missed a file or a block lacks
+// it, and a block rotting on disk is only found when it is read, re-replication only pulling the files a server
+// doesn't hold when the ring changes. Every anti_entropy_period, each server runs a round of anti-entropy on its own
+// goroutine, so that a slow peer never holds up maintenance, and asks its peers with a short timeout. The content of the
+// stored files is checked by the Scrubber, slowly, apart from the rounds.
+//
+// A round compares the files a server shares with each of the other servers storing them through Merkle trees. The
+// leaves of the tree of a block map are the hashes of its lines, each naming a block with its size and checksum, the
+// root of a block is the checksum of its content, and the tree of the files shared with a server has a leaf per file or block, holding the name and root of
+// its tree, grouped in buckets by the ring position of the name. The roots are compared first, then the buckets that
+// differ, then the files. A file or block the peer stores and this server lacks is pulled from the peer, unless its
+// tombstone covers it. A block map that differs has the leaves of its tree compared, which give the first line where
+// the copies part. A server only repairs its own copy, pulling the lines past that point from the other server, the
+// other one doing the same on its side:
+//   - the copy with the most writes merged, then the longest block map, then the one on the lowest id, is repaired
+//     after neither, and takes the lines of the other copy it lacks at its end, as a new version
+//   - the other copy takes the lines of that one from the first difference on, then the lines only it had
+// so both end up alike. Blocks, written once, are only compared by their checksums, the scrub checking their content,
+// and a copy with appends ready to merge is left for the next round. Appends waiting for an earlier one of their client don't hold
+// the repair back, those the peer merged already are dropped by it.
+
+const (
+	MERKLE_BUCKETS       = 16
+	ANTI_ENTROPY_TIMEOUT = 5 * time.Second // Wait for a peer to answer a tree, a slow one is compared next round
+)
+
+// Root of the binary Merkle tree over the given hashes, in order
+func merkleRoot(hashes []string) string {
+	if len(hashes) == 0 {
+		return stringChecksum("")
+	}
+	level := hashes
+	for len(level) > 1 {
+		next := make([]string, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+			} else {
+				next = append(next, stringChecksum(level[i]+level[i+1]))
+			}
+		}
+		level = next
+	}
+	return level[0]
+}
+
+// Lines of a block map, each with its newline
+func blockMapLines(content string) []string {
+	lines := strings.SplitAfter(content, "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+func lineHashes(lines []string) []string {
+	hashes := make([]string, len(lines))
+	for i, line := range lines {
+		hashes[i] = stringChecksum(line)
+	}
+	return hashes
+}
+
+func merkleBucket(filename string) int {
+	return int(ring.Hash(filename) % MERKLE_BUCKETS)
+}
+
+// Tree of the files a server shares with another one, down to the buckets
+type merkleTree struct {
+	Root    string   `json:"root"`
+	Buckets []string `json:"buckets"`
+}
+
+// Tree of the files given with their roots
+func newMerkleTree(roots map[string]string) merkleTree {
+	names := make([][]string, MERKLE_BUCKETS)
+	for name := range roots {
+		names[merkleBucket(name)] = append(names[merkleBucket(name)], name)
+	}
+	tree := merkleTree{Buckets: make([]string, MERKLE_BUCKETS)}
+	for i, bucket := range names {
+		sort.Strings(bucket)
+		leaves := make([]string, len(bucket))
+		for j, name := range bucket {
+			leaves[j] = stringChecksum(name + "\n" + roots[name])
+		}
+		tree.Buckets[i] = merkleRoot(leaves)
+	}
+	tree.Root = merkleRoot(tree.Buckets)
+	return tree
+}
+
+// A copy of a file as compared by anti-entropy, with the leaves of its tree
+type fileLeaves struct {
+	FType   string   `json:"ftype"`
+	Version int      `json:"version"`
+	Meta    fileMeta `json:"meta"`
+	Leaves  []string `json:"leaves"`
+}
+
+// Lines of the block map of a stored file with its entry, read under the lock of the file
+func (fs *FileServer) readLines(filename string) ([]string, File, bool, error) {
+	f, exists, unlock := fs.lockFile(filename, "", false)
+	defer unlock()
+	if !exists {
+		return nil, f, false, nil
+	}
+	data, err := os.ReadFile(fs.file_dir + diskName(filename))
+	return blockMapLines(string(data)), f, true, err
+}
+
+// Roots of the trees of the files this server shares with a peer, given the ring
+func (fs *FileServer) sharedRoots(ring_now *ring.Ring, peer int) map[string]string {
+	var names []string
+	roots := make(map[string]string)
+	fs.Mutex.Lock()
+	for _, files := range []map[string]File{fs.p_files, fs.r_files} {
+		for name, f := range files {
+			if !containsId(fileReplicas(ring_now, name, f.rf), peer) {
+				continue
+			}
+			if isBlockName(name) {
+				// Blocks are written once, their content is checked against their checksum by the scrub
+				roots[name] = f.checksum
+			} else {
+				names = append(names, name)
+			}
+		}
+	}
+	fs.Mutex.Unlock()
+
+	for _, name := range names {
+		lines, _, exists, err := fs.readLines(name)
+		if exists && err == nil {
+			roots[name] = merkleRoot(lineHashes(lines))
+		}
+	}
+	return roots
+}
+
+// Servers that may store copies of the files of this server, which it compares its copies with: the copies of a file
+// are on consecutive servers of the ring, at most max_rf of them, so a server that lacks a file it should store finds
+// it on one of its neighbours
+func (fs *FileServer) syncPeers(ring_now *ring.Ring) []int {
+	var peers []int
+	for _, id := range append(ring_now.Predecessors(fs.id, fs.config.MaxRF-1), ring_now.Successors(fs.id, fs.config.MaxRF-1)...) {
+		if id != fs.id && !containsId(peers, id) {
+			peers = append(peers, id)
+		}
+	}
+	sort.Ints(peers)
+	return peers
+}
+
+// Anti-entropy daemon, running a round every anti_entropy_period once the server is online, until it stops
+func AntiEntropy(fs *FileServer) {
+	ticker := time.NewTicker(fs.config.AntiEntropy)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-fs.stop:
+			return
+		case <-ticker.C:
+		}
+		if fs.online.Load() {
+			antiEntropy(fs)
+		}
+	}
+}
+
+// Compare the stored files with their other copies
+func antiEntropy(fs *FileServer) {
+	ring_now := fs.currentRing()
+	for _, peer := range fs.syncPeers(ring_now) {
+		if fs.stopped() {
+			return
+		}
+		if err := fs.syncWith(ring_now, peer); err != nil {
+			log.Printf("Anti-entropy with server %d failed: %v", peer, err)
+		}
+	}
+}
+
+// Scrubber daemon, checking the content of the stored files against their entries until the server stops: a missing
+// or corrupt copy, of a block in particular, is fetched again from another server storing it. Reading every file is
+// far too slow for an anti-entropy round, so each pass reads the files one at a time, spread over scrub_period.
+func Scrubber(fs *FileServer) {
+	for {
+		names := fs.storedNames()
+		// A pass over no file still waits for the period
+		pause := fs.config.Scrub
+		if len(names) > 0 {
+			pause /= time.Duration(len(names))
+		}
+		for i := 0; i < max(len(names), 1); i++ {
+			select {
+			case <-fs.stop:
+				return
+			case <-time.After(pause):
+			}
+			if fs.online.Load() && i < len(names) {
+				fs.scrub(names[i])
+			}
+		}
+	}
+}
+
+// Names of the files stored by the server, primaries and replicas
+func (fs *FileServer) storedNames() []string {
+	var names []string
+	fs.Mutex.Lock()
+	defer fs.Mutex.Unlock()
+	for _, files := range []map[string]File{fs.p_files, fs.r_files} {
+		for name := range files {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Check the content of a stored file against its entry, fetching it again if it is missing or corrupt
+func (fs *FileServer) scrub(name string) {
+	// A corrupt file is fetched again by openChecked itself, a file deleted since the pass began is skipped
+	file, _, err := fs.openChecked(name, "", true)
+	if err == nil {
+		file.Close()
+	} else if _, stored := fs.storedFile(name, ""); stored && errors.Is(err, os.ErrNotExist) {
+		log.Println("Stored file " + name + " is missing")
+		go fs.repairFile(name)
+	}
+}
+
+// Send a GET request for anti-entropy to a peer, decoding its JSON answer into v
+func (fs *FileServer) askPeer(peer int, query string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s/antientropy?%s", fs.nodes.HTTPAddr(peer), query), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := fs.newClient(ANTI_ENTROPY_TIMEOUT).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusBadRequest {
+		return errNotStored
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server %d answered %s", peer, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Compare the files shared with a peer down the trees, and repair the copies of this server that differ
+func (fs *FileServer) syncWith(ring_now *ring.Ring, peer int) error {
+	roots := fs.sharedRoots(ring_now, peer)
+	tree := newMerkleTree(roots)
+	var remote merkleTree
+	if err := fs.askPeer(peer, "peer="+strconv.Itoa(fs.id), &remote); err != nil {
+		return err
+	}
+	if remote.Root == tree.Root || len(remote.Buckets) != len(tree.Buckets) {
+		return nil
+	}
+	for i := range tree.Buckets {
+		if remote.Buckets[i] == tree.Buckets[i] {
+			continue
+		}
+		var remote_roots map[string]string
+		if err := fs.askPeer(peer, fmt.Sprintf("peer=%d&bucket=%d", fs.id, i), &remote_roots); err != nil {
+			return err
+		}
+		// A file or block missing here is pulled, the peer pulls the ones it lacks on its side
+		for name, remote_root := range remote_roots {
+			root, exists := roots[name]
+			if merkleBucket(name) != i || root == remote_root {
+				continue
+			}
+			var err error
+			if !exists {
+				err = fs.pullCopy(ring_now, peer, name)
+			} else if !isBlockName(name) {
+				err = fs.repairCopy(peer, name)
+			}
+			if err != nil {
+				log.Println("Failed to repair file "+name+" from server "+strconv.Itoa(peer), err)
+			}
+		}
+	}
+	return nil
+}
+
+// Store the copy of a file or block a peer holds and this server lacks, as the primary if the ring makes it one
+func (fs *FileServer) pullCopy(ring_now *ring.Ring, peer int, filename string) error {
+	ftype := "r"
+	if ring_now.Owner(ring.Hash(filename)) == peer {
+		ftype = "p"
+	}
+	resp, err := fs.fetchStored(peer, filename, ftype)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	rf, err := fs.parseRF(resp.Header.Get("Replication-Factor"))
+	if err != nil {
+		return err
+	}
+	version := parseVersion(resp.Header.Get("Version"))
+	if fs.buried(filename, version) {
+		return nil
+	}
+
+	err = fs.storeFile(filename, resp.Body, func() string { return resp.Header.Get(CHECKSUM_HEADER) }, func(size int64, checksum string) error {
+		fs.Mutex.Lock()
+		defer fs.Mutex.Unlock()
+		// The file may have been written or deleted in the meantime, which leaves the copy of this server as it is
+		_, is_primary := fs.p_files[filename]
+		_, is_replica := fs.r_files[filename]
+		if t, buried := fs.tombstones[filename]; is_primary || is_replica || fs.creating[filename] || (buried && t.version >= version) {
+			return fmt.Errorf("file %s changed during its pull", filename)
+		}
+		f := NewFile(filename, rf)
+		f.version = version
+		f.size = size
+		f.checksum = checksum
+		f.meta = parseMeta(resp.Header.Get("Meta"))
+		if ring_now.Owner(ring.Hash(filename)) == fs.id {
+			fs.p_files[filename] = *f
+		} else {
+			fs.r_files[filename] = *f
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Pulled missing file %s from server %d", filename, peer)
+	fs.saveCatalog(filename)
+	return nil
+}
+
+// Whether a copy is the one another copy is repaired after
+func leadingCopy(version int, length int, id int, other_version int, other_length int, other_id int) bool {
+	if version != other_version {
+		return version > other_version
+	}
+	if length != other_length {
+		return length > other_length
+	}
+	return id < other_id
+}
+
+// Block map lines both copies end up with, given the lines of the leading copy and of the other one from their
+// first difference on, and how many lines only the other copy had
+func repairedLines(leading []string, other []string, from int) ([]string, int) {
+	known := make(map[string]bool)
+	for _, line := range leading[from:] {
+		known[line] = true
+	}
+	lines := append([]string{}, leading...)
+	extra := 0
+	for _, line := range other {
+		if !known[line] {
+			lines = append(lines, line)
+			extra++
+		}
+	}
+	return lines, extra
+}
+
+// Repair the copy of a file of this server against the one of a peer, pulling the lines past their first difference
+func (fs *FileServer) repairCopy(peer int, filename string) error {
+	var remote fileLeaves
+	if err := fs.askPeer(peer, "filename="+escapeName(filename), &remote); err != nil {
+		return err
+	}
+	lines, f, exists, err := fs.readLines(filename)
+	if !exists || err != nil || mergePending(f) {
+		return err
+	}
+	leaves := lineHashes(lines)
+	from := 0
+	for from < len(leaves) && from < len(remote.Leaves) && leaves[from] == remote.Leaves[from] {
+		from++
+	}
+	// The peer lacks lines this copy has and none the other way round, it pulls them on its side
+	if from == len(remote.Leaves) {
+		return nil
+	}
+
+	// The lines of the peer past the common part, checked against its leaves
+	var offset int
+	for _, line := range lines[:from] {
+		offset += len(line)
+	}
+	resp, err := fs.fetchStoredRange(peer, filename, remote.FType, fmt.Sprintf("bytes=%d-", offset))
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	pulled := blockMapLines(string(data))
+	if len(pulled) < len(remote.Leaves)-from {
+		return fmt.Errorf("server %d sent %d lines of %s past line %d, expected %d", peer, len(pulled), filename, from, len(remote.Leaves)-from)
+	}
+	pulled = pulled[:len(remote.Leaves)-from]
+	for i, line := range pulled {
+		if stringChecksum(line) != remote.Leaves[from+i] {
+			return fmt.Errorf("%w: line %d of %s from server %d", errChecksum, from+i, filename, peer)
+		}
+	}
+
+	leading := leadingCopy(f.version, len(lines), fs.id, remote.Version, len(remote.Leaves), peer)
+	version := remote.Version
+	var repaired []string
+	var extra int
+	if leading {
+		version = f.version
+		repaired, extra = repairedLines(lines, pulled, from)
+	} else {
+		repaired, extra = repairedLines(append(append([]string{}, lines[:from]...), pulled...), lines[from:], from)
+	}
+	if extra > 0 {
+		version++
+	}
+	if version == f.version && strings.Join(repaired, "") == strings.Join(lines, "") {
+		return nil
+	}
+	return fs.rewriteLines(f, offset, repaired[from:], version, remote.Meta, leading, extra > 0)
+}
+
+// Replace the block map of a copy past offset, if it didn't change since it was read, and record what it now holds
+func (fs *FileServer) rewriteLines(read File, offset int, lines []string, version int, remote fileMeta, leading bool, new_version bool) error {
+	f, exists, unlock := fs.lockFile(read.filename, "", true)
+	defer unlock()
+	if !exists || f.Mutex != read.Mutex || f.version != read.version || f.checksum != read.checksum || mergePending(f) {
+		return nil
+	}
+	if err := fs.replaceTail(f.filename, int64(offset), strings.Join(lines, "")); err != nil {
+		return err
+	}
+	log.Printf("Repaired file %s past byte %d, now at version %d", f.filename, offset, version)
+
+	// The copy holds the appends the peer merged, and the versions of the leading copy
+	content_size := fs.contentSize(f.filename)
+	dropped := false
+	fs.Mutex.Lock()
+	for _, files := range []map[string]File{fs.p_files, fs.r_files} {
+		if file, exist := files[f.filename]; exist && file.Mutex == f.Mutex {
+			file.version = version
+			fs.digest(&file)
+			if !leading {
+				file.meta.Versions = remote.Versions
+			}
+			for _, a := range remote.Appends {
+				file.meta = file.meta.withAppend(a)
+			}
+			applied := make(map[string]uint64)
+			for _, m := range []map[string]uint64{file.meta.Applied, remote.Applied} {
+				for client, seq := range m {
+					applied[client] = max(applied[client], seq)
+				}
+			}
+			file.meta.Applied = applied
+			if dropApplied(file.cache, applied) {
+				dropped = true
+			}
+			if new_version {
+				file.meta.Merged = time.Now()
+				file.meta = fs.withVersion(file.meta, fileVersion{Version: version, Time: file.meta.Merged, Size: content_size, MapSize: file.size})
+			}
+			files[f.filename] = file
+		}
+	}
+	fs.Mutex.Unlock()
+	if dropped {
+		if err := fs.rewriteAppendLog(f.filename, f.cache); err != nil {
+			log.Println("Failed to rewrite the append log of "+f.filename, err)
+		}
+	}
+	fs.saveCatalog(f.filename)
+	return nil
+}
+
+// Replace the content of a stored file past offset by tail, all at once: the new content is written to a temporary
+// file like an upload, which replaces the file once synced, so a crash leaves either block map whole
+func (fs *FileServer) replaceTail(filename string, offset int64, tail string) error {
+	file, err := os.Open(fs.file_dir + diskName(filename))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	tmp, err := os.CreateTemp(fs.config.FileDir, uploadPattern(fs.id))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if n, err := io.Copy(tmp, io.LimitReader(file, offset)); err != nil {
+		return err
+	} else if n != offset {
+		return fmt.Errorf("%s holds %d bytes, repaired past byte %d", filename, n, offset)
+	}
+	if _, err := io.WriteString(tmp, tail); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fs.file_dir+diskName(filename))
+}
+
+// Whether a copy, read under the lock of its file, has appends a merge would apply now
+func mergePending(f File) bool {
+	return len(readyAppends(f.cache, f.meta.Applied, time.Now())) > 0
+}
+
+// Remove from a cache the appends whose numbers were merged, the repaired block map holding them
+func dropApplied(cache map[appendKey]pendingAppend, applied map[string]uint64) bool {
+	dropped := false
+	for k := range cache {
+		if k.seq != 0 && k.seq <= applied[k.client] {
+			delete(cache, k)
+			dropped = true
+		}
+	}
+	return dropped
+}
+
+// Serve the trees of anti-entropy: of the files shared with a peer, of a bucket of them, or of a single file
+func (fs *FileServer) httpHandleAntiEntropy(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		if filename := r.URL.Query().Get("filename"); filename != "" {
+			lines, f, exists, err := fs.readLines(filename)
+			if !exists {
+				httpError(w, CODE_NOT_EXIST, "Rejected, file "+filename+" doesn't exist", http.StatusBadRequest)
+				return
+			}
+			if err != nil {
+				httpError(w, errorCode(err), "Could not read file: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			ftype := "r"
+			if fileExistsinPrimary(fs, filename) {
+				ftype = "p"
+			}
+			json.NewEncoder(w).Encode(fileLeaves{FType: ftype, Version: f.version, Meta: f.meta, Leaves: lineHashes(lines)})
+			return
+		}
+
+		peer, err := strconv.Atoi(r.URL.Query().Get("peer"))
+		if err != nil {
+			http.Error(w, "Invalid or missing peer", http.StatusBadRequest)
+			return
+		}
+		roots := fs.sharedRoots(fs.currentRing(), peer)
+		if s := r.URL.Query().Get("bucket"); s != "" {
+			bucket, err := strconv.Atoi(s)
+			if err != nil || bucket < 0 || bucket >= MERKLE_BUCKETS {
+				http.Error(w, "Invalid bucket "+s, http.StatusBadRequest)
+				return
+			}
+			for name := range roots {
+				if merkleBucket(name) != bucket {
+					delete(roots, name)
+				}
+			}
+			json.NewEncoder(w).Encode(roots)
+			return
+		}
+		json.NewEncoder(w).Encode(newMerkleTree(roots))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAntiEntropyRepairsMissedAppends(t *testing.T) {
+	c := newTestClusterWith(t, 3, map[string]interface{}{"anti_entropy_period": "500ms"})
+	cl := c.Client()
+	c.mustCreate(cl, "file.txt", "a", 3)
+	c.WaitReplicas(5 * time.Second)
+	holders := c.holders("file.txt")
+
+	// A replica misses the first append, the primary the second one
+	c.Drop(holders[2], "/appending")
+	if err := cl.Append("file.txt", strings.NewReader("b")); err != nil {
+		t.Fatal(err)
+	}
+	c.Drop(holders[2], "")
+	c.Drop(holders[0], "/appending")
+	if err := cl.AppendThrough("file.txt", strings.NewReader("c"), 1); err != nil {
+		t.Fatal(err)
+	}
+	c.Drop(holders[0], "")
+	if err := cl.Merge("file.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	c.waitFor("copies to converge", 10*time.Second, func() error {
+		for _, id := range holders[1:] {
+			if c.content(id, "file.txt") != c.content(holders[0], "file.txt") {
+				return fmt.Errorf("node %d stores another block map than the primary %d", id, holders[0])
+			}
+			f, _ := c.node(id).fs.storedFile("file.txt", "")
+			p, _ := c.node(holders[0]).fs.storedFile("file.txt", "")
+			if f.version != p.version || f.checksum != p.checksum {
+				return fmt.Errorf("node %d is at version %d, the primary at %d", id, f.version, p.version)
+			}
+		}
+		return nil
+	})
+	for _, id := range holders {
+		if got := c.content(id, "file.txt"); len(blockMapLines(got)) != 3 {
+			t.Errorf("node %d stores %d blocks, expected the create and both appends", id, len(blockMapLines(got)))
+		}
+	}
+	if got := c.mustGet(c.Client(), "file.txt"); got != "abc" {
+		t.Errorf("get = %q after the repair", got)
+	}
+}
+
+func TestAntiEntropyRepairsMissingAndCorruptBlocks(t *testing.T) {
+	c := newTestClusterWith(t, 4, map[string]interface{}{"anti_entropy_period": "500ms", "scrub_period": "500ms"})
+	cl := c.Client()
+	c.mustCreate(cl, "data.txt", "hello world", 3)
+	c.WaitReplicas(5 * time.Second)
+	blocks, err := parseBlockMap(strings.NewReader(c.content(c.holders("data.txt")[0], "data.txt")))
+	if err != nil || len(blocks) != 1 {
+		t.Fatalf("Block map of data.txt: %v %v", blocks, err)
+	}
+	block := blocks[0].name
+	holders := c.holders(block)
+
+	// One copy of the block never got it, another one rots on disk, and nothing reads them
+	missing := c.node(holders[1]).fs
+	missing.Mutex.Lock()
+	delete(missing.p_files, block)
+	delete(missing.r_files, block)
+	missing.Mutex.Unlock()
+	os.Remove(missing.file_dir + diskName(block))
+	if err := os.WriteFile(c.node(holders[2]).fs.file_dir+diskName(block), []byte("HELLO WORLD"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c.waitFor("the copies of the block to be repaired", 10*time.Second, func() error {
+		if got := c.holders(block); len(got) != len(holders) {
+			return fmt.Errorf("block stored on %v, expected %v", got, holders)
+		}
+		for _, id := range holders {
+			if got, _ := os.ReadFile(c.node(id).fs.file_dir + diskName(block)); string(got) != "hello world" {
+				return fmt.Errorf("node %d stores the block as %q", id, got)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Every append waiting in the cache of a file is stored in the append log of the file, synced to disk before the
+// append is acknowledged. The cache only holds where each append is in the log, so appends of any size take no memory.
+// A record is a "stamp client seq prev size" line followed by the appended bytes, the size being written once they
+// all are. The log is replayed into the cache on restart and emptied once its appends are merged.
+
+const LOG_SIZE_WIDTH = 20 // Digits of the size field, so that it can be rewritten in place
+
+// Key ordering an append among the pending appends of its file. Every client numbers its appends, and the coordinator
+// stamps each append with its hybrid logical clock, past everything the coordinator heard of, see hlc.go. Appends are
+// ordered by stamp, so that an append is never merged before one that was seen before it was made, except that the
+// appends of a client are merged in the order of their numbers, see sortedAppends. An append also names the previous
+// one of its client to the file, which it waits for, see readyAppends.
+type appendKey struct {
+	stamp  hlcTime
+	client string // Id of the client, or of the coordinator for a client that sent none
+	seq    uint64 // Number of the append among those of its client
+	prev   uint64 // Number of the previous append of the client to the file, 0 if none
+}
+
+// Wait for the previous append of a client, after which an append is merged without it. An append that failed
+// before any server logged it would hold the later ones of its client forever.
+const GAP_TIMEOUT = MERGE_TIMEOUT
+
+func (k appendKey) before(o appendKey) bool {
+	if k.stamp != o.stamp {
+		return k.stamp.before(o.stamp)
+	}
+	if k.client != o.client {
+		return k.client < o.client
+	}
+	return k.seq < o.seq
+}
+
+func (k appendKey) equal(o appendKey) bool {
+	return k.stamp == o.stamp && k.client == o.client && k.seq == o.seq
+}
+
+// Query giving the key of an append to the servers logging it
+func appendKeyQuery(k appendKey) string {
+	return url.Values{"timestamp": {k.stamp.String()}, "client": {k.client}, "seq": {strconv.FormatUint(k.seq, 10)}, "prev": {strconv.FormatUint(k.prev, 10)}}.Encode()
+}
+
+func parseAppendKey(query url.Values) appendKey {
+	stamp, _ := parseHLC(query.Get("timestamp"))
+	seq, _ := strconv.ParseUint(query.Get("seq"), 10, 64)
+	prev, _ := strconv.ParseUint(query.Get("prev"), 10, 64)
+	return appendKey{stamp: stamp, client: query.Get("client"), seq: seq, prev: prev}
+}
+
+// Header of the record of an append in the log, the client escaped into a single field
+func logHeader(k appendKey, size int64) string {
+	client := url.QueryEscape(k.client)
+	if client == "" {
+		client = "-"
+	}
+	return fmt.Sprintf("%s %s %d %d %0*d\n", k.stamp, client, k.seq, k.prev, LOG_SIZE_WIDTH, size)
+}
+
+// Location of an append in the append log of its file
+type pendingAppend struct {
+	offset int64
+	size   int64
+}
+
+func appendLogDir(config Config, id int) string {
+	return config.FileDir + strconv.Itoa(id) + ".appends/"
+}
+
+func (fs *FileServer) appendLogPath(filename string) string {
+	return fs.log_dir + diskName(filename) + ".log"
+}
+
+// Stream an append to the end of the log of its file, returning once it is on disk
+func (fs *FileServer) logAppend(filename string, k appendKey, content io.Reader) (pendingAppend, error) {
+	file, err := os.OpenFile(fs.appendLogPath(filename), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return pendingAppend{}, err
+	}
+	defer file.Close()
+
+	start, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return pendingAppend{}, err
+	}
+	// A size of -1 marks a record whose content isn't all written yet
+	header := logHeader(k, -1)
+	if _, err := io.WriteString(file, header); err != nil {
+		return pendingAppend{}, err
+	}
+	size, err := io.Copy(file, content)
+	if err != nil {
+		file.Truncate(start)
+		return pendingAppend{}, err
+	}
+	if _, err := file.WriteAt([]byte(fmt.Sprintf("%0*d", LOG_SIZE_WIDTH, size)), start+int64(len(header))-LOG_SIZE_WIDTH-1); err != nil {
+		file.Truncate(start)
+		return pendingAppend{}, err
+	}
+	if err := file.Sync(); err != nil {
+		return pendingAppend{}, err
+	}
+	return pendingAppend{offset: start + int64(len(header)), size: size}, nil
+}
+
+// Reader of an append stored in the log of a file, to be closed by the caller
+func (fs *FileServer) openAppend(filename string, a pendingAppend) (io.ReadCloser, error) {
+	file, err := os.Open(fs.appendLogPath(filename))
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(file, a.offset, a.size), file}, nil
+}
+
+// Keys of the appends in a cache, in the order they are merged: by stamp, the appends of each client taking the places
+// of its appends in the order of their numbers. Appends a client sent concurrently or retried may be stamped out of
+// order, their numbers never are.
+func sortedAppends(cache map[appendKey]pendingAppend) []appendKey {
+	keys := make([]appendKey, 0, len(cache))
+	clients := make(map[string][]appendKey)
+	for k := range cache {
+		keys = append(keys, k)
+		clients[k.client] = append(clients[k.client], k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].before(keys[j])
+	})
+	for _, numbered := range clients {
+		sort.Slice(numbered, func(i, j int) bool {
+			return numbered[i].seq < numbered[j].seq
+		})
+	}
+	next := make(map[string]int)
+	for i, k := range keys {
+		keys[i] = clients[k.client][next[k.client]]
+		next[k.client]++
+	}
+	return keys
+}
+
+// Keys of the appends in a cache that can be merged, in order, given the highest number of each client merged
+// already. An append waits until the previous one of its client to the file, prev, is merged before it, or for
+// GAP_TIMEOUT after its stamp. The appends of the client after it wait with it.
+func readyAppends(cache map[appendKey]pendingAppend, applied map[string]uint64, now time.Time) []appendKey {
+	merged := make(map[string]uint64, len(applied))
+	for client, seq := range applied {
+		merged[client] = seq
+	}
+	waiting := make(map[string]bool)
+	var ready []appendKey
+	for _, k := range sortedAppends(cache) {
+		if waiting[k.client] || (k.prev > merged[k.client] && now.Before(k.stamp.Time().Add(GAP_TIMEOUT))) {
+			waiting[k.client] = true
+			continue
+		}
+		ready = append(ready, k)
+		merged[k.client] = max(merged[k.client], k.seq)
+	}
+	return ready
+}
+
+// Whether a copy merged or logged an append already, which its client sent again
+func duplicateAppend(cache map[appendKey]pendingAppend, applied map[string]uint64, k appendKey) bool {
+	if k.seq == 0 {
+		return false
+	}
+	if applied[k.client] >= k.seq {
+		return true
+	}
+	for logged := range cache {
+		if logged.client == k.client && logged.seq == k.seq {
+			return true
+		}
+	}
+	return false
+}
+
+// Replace the log of a file with the appends still in its cache, removing it if there are none.
+// The appends in the cache are moved to their place in the new log.
+func (fs *FileServer) rewriteAppendLog(filename string, cache map[appendKey]pendingAppend) error {
+	path := fs.appendLogPath(filename)
+	if len(cache) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	old, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer old.Close()
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	moved := make(map[appendKey]pendingAppend)
+	var offset int64
+	for _, k := range sortedAppends(cache) {
+		a := cache[k]
+		header := logHeader(k, a.size)
+		if _, err := io.WriteString(file, header); err != nil {
+			return err
+		}
+		if _, err := io.Copy(file, io.NewSectionReader(old, a.offset, a.size)); err != nil {
+			return err
+		}
+		moved[k] = pendingAppend{offset: offset + int64(len(header)), size: a.size}
+		offset += int64(len(header)) + a.size
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	for k, a := range moved {
+		cache[k] = a
+	}
+	return nil
+}
+
+// Read the appends logged for a file. A record cut short by a crash was never acknowledged and is dropped.
+func (fs *FileServer) readAppendLog(filename string) (map[appendKey]pendingAppend, error) {
+	cache := make(map[appendKey]pendingAppend)
+	file, err := os.Open(fs.appendLogPath(filename))
+	if os.IsNotExist(err) {
+		return cache, nil
+	}
+	if err != nil {
+		return cache, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		header, err := reader.ReadString('\n')
+		if err != nil {
+			break
+		}
+		fields := strings.Fields(header)
+		if len(fields) != 5 {
+			log.Println("Ignoring the rest of the append log of " + filename + ", invalid record")
+			break
+		}
+		var k appendKey
+		var err1, err2, err3, err4 error
+		k.stamp, err1 = parseHLC(fields[0])
+		if fields[1] != "-" {
+			k.client, err2 = url.QueryUnescape(fields[1])
+		}
+		k.seq, err3 = strconv.ParseUint(fields[2], 10, 64)
+		k.prev, err4 = strconv.ParseUint(fields[3], 10, 64)
+		size, err5 := strconv.ParseInt(fields[4], 10, 64)
+		if errors.Join(err1, err2, err3, err4, err5) != nil || size < 0 {
+			log.Println("Ignoring the rest of the append log of " + filename + ", incomplete record")
+			break
+		}
+		if n, _ := reader.Discard(int(size)); int64(n) < size {
+			break
+		}
+		cache[k] = pendingAppend{offset: offset + int64(len(header)), size: size}
+		offset += int64(len(header)) + size
+	}
+	return cache, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAppendLogReplayAndMerge(t *testing.T) {
+	config := Config{VNodes: 16, DefaultRF: 3, MaxRF: 4, FileDir: t.TempDir() + "/"}
+	fs := FileServerInit(nil, nil, 1, config)
+
+	if err := os.WriteFile(fs.file_dir+"log.txt", []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f := NewFile("log.txt", 3)
+	fs.digest(f)
+	fs.r_files["log.txt"] = *f
+	fs.saveCatalog()
+
+	// Appends stamped alike by different coordinators are told apart by their clients
+	start := hlcTime{wall: time.Now().UnixNano()}
+	for i, k := range []appendKey{{start, "client 1", 1, 0}, {start, "client 2", 1, 0}} {
+		if _, err := fs.logAppend("log.txt", k, strings.NewReader(string(rune('b'+i)))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A crash in the middle of an append leaves a partial record behind
+	file, err := os.OpenFile(fs.appendLogPath("log.txt"), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(logHeader(appendKey{hlcTime{start.wall, 2}, "client 1", 2, 1}, -1) + "part")
+	file.Close()
+
+	fs = FileServerInit(nil, nil, 1, config)
+	f = &File{}
+	*f = fs.r_files["log.txt"]
+	if len(f.cache) != 2 {
+		t.Fatalf("Replayed %d appends, expected 2", len(f.cache))
+	}
+
+	// Appends logged after the restart aren't hidden behind the partial record
+	key := appendKey{hlcTime{start.wall, 3}, "client 1", 3, 1}
+	pending, err := fs.logAppend("log.txt", key, strings.NewReader("d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.cache[key] = pending
+
+	merged, err := fs.mergeCache(f)
+	if err != nil || merged != 3 {
+		t.Fatalf("mergeCache merged %d appends with error %v", merged, err)
+	}
+	data, _ := os.ReadFile(fs.file_dir + "log.txt")
+	if string(data) != "abcd" {
+		t.Errorf("Merged content is %q, expected \"abcd\"", data)
+	}
+	if _, err := os.Stat(fs.appendLogPath("log.txt")); !os.IsNotExist(err) {
+		t.Errorf("The append log is still there after the merge")
+	}
+}
+
+func TestAppendLogStopsAtAMalformedRecord(t *testing.T) {
+	config := Config{VNodes: 16, DefaultRF: 3, MaxRF: 4, FileDir: t.TempDir() + "/"}
+	fs := FileServerInit(nil, nil, 1, config)
+
+	start := hlcTime{wall: time.Now().UnixNano()}
+	if _, err := fs.logAppend("log.txt", appendKey{start, "client 1", 1, 0}, strings.NewReader("b")); err != nil {
+		t.Fatal(err)
+	}
+	// A record without the number of the previous append of its client, followed by a valid one
+	file, err := os.OpenFile(fs.appendLogPath("log.txt"), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(file, "%s client+1 2 %0*d\nc", hlcTime{start.wall, 1}, LOG_SIZE_WIDTH, 1)
+	file.WriteString(logHeader(appendKey{hlcTime{start.wall, 2}, "client 1", 3, 2}, 1) + "d")
+	file.Close()
+
+	cache, err := fs.readAppendLog("log.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cache) != 1 {
+		t.Errorf("Read %d appends, expected the one before the malformed record", len(cache))
+	}
+}
+
+func TestAppendsOfAClientStayInOrder(t *testing.T) {
+	// The coordinator of the second append is a second behind the first one
+	var ahead, behind hlc
+	behind.physical = func() int64 { return time.Now().Add(-time.Second).UnixNano() }
+	first := ahead.now()
+	second := behind.update(first)
+	if !first.before(second) {
+		t.Fatalf("second append stamped %v, before the first one at %v", second, first)
+	}
+	if got := behind.now(); !second.before(got) {
+		t.Errorf("clock went back to %v after %v", got, second)
+	}
+	if got, err := parseHLC(second.String()); err != nil || got != second {
+		t.Errorf("parseHLC(%q) = %v, %v", second, got, err)
+	}
+
+	cache := map[appendKey]pendingAppend{
+		{second, "b", 2, 1}: {},
+		{first, "b", 1, 0}:  {},
+		{first, "a", 7, 0}:  {},
+	}
+	keys := sortedAppends(cache)
+	if keys[0].client != "a" || keys[1].seq != 1 || keys[2].seq != 2 {
+		t.Errorf("appends sorted as %+v", keys)
+	}
+}
+
+func TestAppendsMergeInTheOrderOfTheirNumbers(t *testing.T) {
+	now := time.Now()
+	at := func(ago time.Duration) hlcTime { return hlcTime{wall: now.Add(-ago).UnixNano()} }
+
+	// Appends a client sent concurrently, the second one stamped first, the third one waiting for a lost append 4
+	cache := map[appendKey]pendingAppend{
+		{at(3 * time.Second), "c", 2, 1}: {},
+		{at(2 * time.Second), "c", 1, 0}: {},
+		{at(2 * time.Second), "d", 9, 0}: {},
+		{at(time.Second), "c", 5, 4}:     {},
+		{at(time.Second), "c", 3, 2}:     {},
+	}
+	var order []uint64
+	for _, k := range readyAppends(cache, nil, now) {
+		order = append(order, k.seq)
+	}
+	if fmt.Sprint(order) != "[1 2 9 3]" {
+		t.Errorf("merged %v, expected [1 2 9 3]", order)
+	}
+
+	// Merged appends don't hold the next ones, and an append stops waiting after GAP_TIMEOUT
+	order = nil
+	for _, k := range readyAppends(map[appendKey]pendingAppend{{at(time.Second), "c", 5, 4}: {}}, map[string]uint64{"c": 4}, now) {
+		order = append(order, k.seq)
+	}
+	if fmt.Sprint(order) != "[5]" {
+		t.Errorf("merged %v after append 4, expected [5]", order)
+	}
+	if ready := readyAppends(cache, nil, now.Add(GAP_TIMEOUT)); len(ready) != len(cache) {
+		t.Errorf("merged %d appends after GAP_TIMEOUT, expected %d", len(ready), len(cache))
+	}
+
+	// An append sent again is told apart from a new one by its number, whatever its stamp
+	if !duplicateAppend(cache, nil, appendKey{at(0), "c", 3, 2}) || !duplicateAppend(nil, map[string]uint64{"c": 3}, appendKey{at(0), "c", 2, 1}) {
+		t.Errorf("append sent again isn't a duplicate")
+	}
+	if duplicateAppend(cache, map[string]uint64{"c": 3}, appendKey{at(0), "c", 4, 3}) {
+		t.Errorf("new append is a duplicate")
+	}
+}
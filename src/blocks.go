@@ -0,0 +1,412 @@
+package main
+
+import (
+	"HyDFS/ring"
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A HyDFS file is split into blocks of at most block_size bytes. Each block is stored like a file of its own,
+// under a name of the form "filename~id", so it has its own place on the ring and is re-replicated by itself.
+// What is stored under the file name is its block map: a "blockname size checksum" line per block, in order.
+// The primary of the file holds the block map, and an append adds the lines of its new blocks to it like any append.
+
+const (
+	BLOCK_SEPARATOR    = "~" // Reserved in file names, and safe in the URLs of requests between servers
+	BLOCK_FETCH_WINDOW = 4   // Blocks fetched at the same time by a get
+)
+
+// A server answered that it doesn't store a file
+var errNotStored = errors.New("file not stored")
+
+type block struct {
+	name     string
+	size     int64
+	checksum string // SHA-256 of the content, hex encoded
+}
+
+func isBlockName(filename string) bool {
+	return strings.Contains(filename, BLOCK_SEPARATOR)
+}
+
+// Lines of a block map
+func formatBlockMap(blocks []block) string {
+	var b strings.Builder
+	for _, blk := range blocks {
+		fmt.Fprintf(&b, "%s %d %s\n", blk.name, blk.size, blk.checksum)
+	}
+	return b.String()
+}
+
+func parseBlockMap(r io.Reader) ([]block, error) {
+	var blocks []block
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		// Block names may contain spaces, the size and checksum are the last two fields
+		fields := strings.Split(scanner.Text(), " ")
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("invalid block map line %q", scanner.Text())
+		}
+		fields = []string{strings.Join(fields[:len(fields)-2], " "), fields[len(fields)-2], fields[len(fields)-1]}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid block map line %q", scanner.Text())
+		}
+		blocks = append(blocks, block{name: fields[0], size: size, checksum: fields[2]})
+	}
+	return blocks, scanner.Err()
+}
+
+// Split content into blocks stored with rf replicas each, returning them in order. Each block must be acknowledged by
+// quorum of its copies like the file itself, or the write fails with errQuorum.
+func (fs *FileServer) writeBlocks(filename string, rf int, quorum int, content io.Reader) ([]block, error) {
+	// Block names only have to be unique, a write starts a new series of them
+	prefix := fmt.Sprintf("%s%s%d.", filename, BLOCK_SEPARATOR, time.Now().UnixNano())
+	reader := bufio.NewReader(content)
+	var blocks []block
+	for i := 0; ; i++ {
+		if _, err := reader.Peek(1); err == io.EOF {
+			return blocks, nil
+		} else if err != nil {
+			return blocks, err
+		}
+
+		name := prefix + strconv.Itoa(i)
+		owner := fs.currentRing().Owner(ring.Hash(name))
+		if owner == -1 {
+			return blocks, fmt.Errorf("no server to store block %s", name)
+		}
+		counter := &countingReader{r: io.LimitReader(reader, fs.config.BlockSize)}
+		content := newHashingReader(counter)
+		url := fmt.Sprintf("http://%s/creating?filename=%s&ftype=p&rf=%d&%s", fs.nodes.HTTPAddr(owner), escapeName(name), rf, quorumQuery(quorum, 0))
+		if err := fs.putChecksum(url, content, content.Sum); err != nil {
+			return blocks, fmt.Errorf("failed to store block %s: %w", name, err)
+		}
+		blocks = append(blocks, block{name: name, size: counter.n, checksum: content.Sum()})
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.n += int64(n)
+	return n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// Fetch a stored file from the given server, ftype telling if it is a primary or a replica there. The response
+// carries the checksum of the file. The caller closes the body of the response.
+func (fs *FileServer) fetchStored(server int, filename string, ftype string) (*http.Response, error) {
+	return fs.fetchStoredRange(server, filename, ftype, "")
+}
+
+// Fetch part of a stored file, rng being the value of a Range header or "" for the whole file
+func (fs *FileServer) fetchStoredRange(server int, filename string, ftype string, rng string) (*http.Response, error) {
+	return fs.fetchStoredAt(server, filename, ftype, rng, "")
+}
+
+// Fetch a stored file as it was at the version a versionQuery selects, "" for the current content. A sessionQuery
+// instead asks for the current content once it has the appends of a client.
+func (fs *FileServer) fetchStoredAt(server int, filename string, ftype string, rng string, at string) (*http.Response, error) {
+	url := fmt.Sprintf("http://%s/getting?filename=%s&ftype=%s", fs.nodes.HTTPAddr(server), escapeName(filename), ftype)
+	if at != "" {
+		url += "&" + at
+	}
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if rng != "" {
+		req.Header.Set("Range", rng)
+	}
+	client := fs.newClient(time.Minute * 2)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusBadRequest {
+		resp.Body.Close()
+		return nil, fmt.Errorf("server %d, %s: %w", server, filename, errNotStored)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, fmt.Errorf("server %d, %s: %w", server, filename, errNoVersion)
+	}
+	if resp.StatusCode == http.StatusConflict {
+		resp.Body.Close()
+		return nil, fmt.Errorf("server %d, %s: %w", server, filename, errNotApplied)
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, fmt.Errorf("server %d can't send %s: %s", server, filename, resp.Status)
+	}
+	return resp, nil
+}
+
+// Fetch the block map of a file and its replication factor, at the version a versionQuery selects
+func (fs *FileServer) fetchBlockMap(server int, filename string, ftype string, at string) ([]block, int, error) {
+	c, err := fs.fetchCopy(server, filename, ftype, at)
+	return c.blocks, c.rf, err
+}
+
+// Block map of a copy of a file, with what its server knows of the file
+type storedCopy struct {
+	server  int
+	blocks  []block
+	rf      int
+	version int
+	meta    fileMeta // The zero record for an earlier version
+}
+
+// Fetch the block map of a copy of a file, at the version a versionQuery selects
+func (fs *FileServer) fetchCopy(server int, filename string, ftype string, at string) (storedCopy, error) {
+	resp, err := fs.fetchStoredAt(server, filename, ftype, "", at)
+	if err != nil {
+		return storedCopy{}, err
+	}
+	defer resp.Body.Close()
+
+	rf, err := fs.parseRF(resp.Header.Get("Replication-Factor"))
+	if err != nil {
+		return storedCopy{}, err
+	}
+	content := newHashingReader(resp.Body)
+	blocks, err := parseBlockMap(content)
+	if err == nil {
+		err = checkSum(resp.Header.Get(CHECKSUM_HEADER), content.Sum())
+	}
+	if err != nil {
+		return storedCopy{}, err
+	}
+	return storedCopy{server: server, blocks: blocks, rf: rf, version: parseVersion(resp.Header.Get("Version")), meta: parseMeta(resp.Header.Get("Meta"))}, nil
+}
+
+// Part of a block read by a get
+type blockRange struct {
+	block
+	offset int64
+	length int64
+}
+
+func (br blockRange) whole() bool {
+	return br.offset == 0 && br.length == br.size
+}
+
+// Parts of the blocks holding the bytes from start to end of a file, end excluded
+func selectBlocks(blocks []block, start int64, end int64) []blockRange {
+	var parts []blockRange
+	var offset int64
+	for _, blk := range blocks {
+		from, to := max(start, offset), min(end, offset+blk.size)
+		if from < to {
+			parts = append(parts, blockRange{block: blk, offset: from - offset, length: to - from})
+		}
+		offset += blk.size
+	}
+	return parts
+}
+
+// Fetch part of a block from its primary, or from one of its replicas while it is being repaired
+func (fs *FileServer) fetchBlock(ring_now *ring.Ring, part blockRange, rf int) (*http.Response, error) {
+	rng := ""
+	if !part.whole() {
+		rng = fmt.Sprintf("bytes=%d-%d", part.offset, part.offset+part.length-1)
+	}
+	var err error
+	for i, server := range fileReplicas(ring_now, part.name, rf) {
+		ftype := "r"
+		if i == 0 {
+			ftype = "p"
+		}
+		var resp *http.Response
+		if resp, err = fs.fetchStoredRange(server, part.name, ftype, rng); err == nil {
+			return resp, nil
+		}
+	}
+	return nil, fmt.Errorf("no server could send block %s: %v", part.name, err)
+}
+
+type blockResult struct {
+	resp *http.Response
+	err  error
+}
+
+// Write the parts of blocks to w in order, checking whole blocks against their checksum. Up to BLOCK_FETCH_WINDOW
+// blocks are requested at once, a block waiting for its turn is held back by the connection rather than read in memory.
+func (fs *FileServer) readBlocks(blocks []blockRange, rf int, w io.Writer) error {
+	ring_now := fs.currentRing()
+	// Every block gets exactly one result, an error for those not requested when the get gives up
+	results := make([]chan blockResult, len(blocks))
+	for i := range results {
+		results[i] = make(chan blockResult, 1)
+	}
+	window := make(chan struct{}, BLOCK_FETCH_WINDOW)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go func() {
+		for i, blk := range blocks {
+			select {
+			case window <- struct{}{}:
+			case <-stop:
+				for _, ch := range results[i:] {
+					ch <- blockResult{err: fmt.Errorf("get aborted")}
+				}
+				return
+			}
+			go func(i int, blk blockRange) {
+				resp, err := fs.fetchBlock(ring_now, blk, rf)
+				results[i] <- blockResult{resp, err}
+			}(i, blk)
+		}
+	}()
+
+	for i, blk := range blocks {
+		result := <-results[i]
+		err := result.err
+		if err == nil {
+			var n int64
+			content := newHashingReader(result.resp.Body)
+			n, err = io.Copy(w, content)
+			result.resp.Body.Close()
+			<-window
+			if err == nil && n != blk.length {
+				err = fmt.Errorf("block %s sent %d bytes instead of %d", blk.name, n, blk.length)
+			}
+			if err == nil && blk.whole() {
+				err = checkSum(blk.checksum, content.Sum())
+			}
+		}
+		if err != nil {
+			// Close the responses of the blocks already requested
+			go func(rest []chan blockResult) {
+				for _, ch := range rest {
+					if result := <-ch; result.resp != nil {
+						result.resp.Body.Close()
+					}
+				}
+			}(results[i+1:])
+			return err
+		}
+	}
+	return nil
+}
+
+// Answer a get with the content of the blocks. The size of the file is always in the File-Size header.
+// A get of the whole file ends with its checksum in a trailer, which rules out a Content-Length. A get with a Range
+// header is answered with the range alone, with its Content-Length and Content-Range. Past the headers, a failure can
+// only abort the response, which the client sees as an unexpected end of the content.
+func (fs *FileServer) sendBlocks(w http.ResponseWriter, r *http.Request, filename string, blocks []block, rf int) {
+	var size int64
+	for _, blk := range blocks {
+		size += blk.size
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("File-Size", strconv.FormatInt(size, 10))
+
+	start, end, ranged, err := parseRange(r.Header.Get("Range"), size)
+	if err != nil {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		httpError(w, CODE_RANGE, "Rejected, "+err.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	h := sha256.New()
+	sent := &countingWriter{w: w}
+	out := io.MultiWriter(sent, h)
+	if ranged {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, size))
+		w.Header().Set("Content-Length", strconv.FormatInt(end-start, 10))
+		w.WriteHeader(http.StatusPartialContent)
+		out = sent
+	} else {
+		w.Header().Set("Trailer", CHECKSUM_HEADER)
+	}
+	if err := fs.readBlocks(selectBlocks(blocks, start, end), rf, out); err != nil {
+		log.Println("Error while sending content of file "+filename+":", err)
+		if sent.n == 0 && !ranged {
+			w.Header().Del("Trailer")
+			http.Error(w, "Error fetching the file, internal error", http.StatusInternalServerError)
+			return
+		}
+		panic(http.ErrAbortHandler)
+	}
+	if !ranged {
+		w.Header().Set(CHECKSUM_HEADER, hex.EncodeToString(h.Sum(nil)))
+	}
+}
+
+// Bytes asked for by the Range header of a get, from start to end excluded. Only single ranges are served, the whole
+// file is sent for any other header. A range starting past the end of the file can't be served.
+func parseRange(header string, size int64) (start int64, end int64, ranged bool, err error) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	first, last, found2 := strings.Cut(spec, "-")
+	if !found || !found2 || strings.Contains(spec, ",") {
+		return 0, size, false, nil
+	}
+	if first == "" {
+		// The last bytes of the file
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, size, false, nil
+		}
+		if size == 0 {
+			return 0, 0, false, fmt.Errorf("range %s of an empty file", spec)
+		}
+		return max(size-n, 0), size, true, nil
+	}
+	start, err = strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, size, false, nil
+	}
+	end = size
+	if last != "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < start {
+			return 0, size, false, nil
+		}
+		end = min(n+1, size)
+	}
+	if start >= size {
+		return 0, 0, false, fmt.Errorf("range %s starts past the end of the file, %d bytes", spec, size)
+	}
+	return start, end, true, nil
+}
+
+// Servers storing each block of a file, for ls
+func (fs *FileServer) describeBlocks(ring_now *ring.Ring, blocks []block, rf int) string {
+	var b strings.Builder
+	for _, blk := range blocks {
+		ids := make([]string, 0, rf)
+		for _, i := range fileReplicas(ring_now, blk.name, rf) {
+			ids = append(ids, strconv.Itoa(i))
+		}
+		fmt.Fprintf(&b, "\n%s %d bytes on %s", blk.name, blk.size, strings.Join(ids, ", "))
+	}
+	return b.String()
+}
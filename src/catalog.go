@@ -0,0 +1,385 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The catalog lists the files a server stores, so that it remembers them when it restarts, and the tombstones of the
+// files it deleted, so that they don't come back. It is kept next to the directory of the server rather than inside,
+// where it could clash with a HyDFS file name. Changes go to a journal next to it, synced before the write they
+// record is acknowledged, and are folded into the catalog once the journal grows past it.
+
+type catalogEntry struct {
+	Filename string     `json:"filename"`
+	Role     string     `json:"role"` // "p" for a primary file, "r" for a replica, "t" for the tombstone of a deleted file
+	RF       int        `json:"rf"`
+	Size     int64      `json:"size"`
+	Checksum string     `json:"checksum"` // SHA-256 of the content, hex encoded
+	Version  int        `json:"version"`
+	Deleted  *time.Time `json:"deleted,omitempty"` // Time of the delete, for tombstones
+	fileMeta
+}
+
+func catalogPath(config Config, id int) string {
+	return config.FileDir + strconv.Itoa(id) + ".catalog.json"
+}
+
+// Size and SHA-256 of a stored file
+func fileDigest(path string) (int64, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, file)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Record the size and checksum of a file whose content was just written
+func (fs *FileServer) digest(f *File) {
+	size, checksum, err := fileDigest(fs.file_dir + diskName(f.filename))
+	if err != nil {
+		log.Println("Failed to read back file "+f.filename, err)
+		return
+	}
+	f.size = size
+	f.checksum = checksum
+}
+
+// Key of an entry of the catalog, a name having a stored file and a tombstone at once while it is recreated
+type catalogKey struct {
+	filename string
+	role     string
+}
+
+// Record of the journal of the catalog: an entry that changed, or one that was removed
+type journalRecord struct {
+	catalogEntry
+	Removed bool `json:"removed,omitempty"`
+}
+
+// Compact the journal into the catalog once it holds more records than this, or than twice the entries
+const JOURNAL_RECORDS = 1024
+
+func catalogJournalPath(config Config, id int) string {
+	return config.FileDir + strconv.Itoa(id) + ".catalog.journal"
+}
+
+// Entries of the catalog for the given names as they stand, of every stored file and tombstone if there are none
+func (fs *FileServer) catalogEntries(names []string) map[catalogKey]catalogEntry {
+	entries := make(map[catalogKey]catalogEntry)
+	add := func(role string, f File) {
+		entries[catalogKey{f.filename, role}] = catalogEntry{
+			Filename: f.filename,
+			Role:     role,
+			RF:       f.rf,
+			Size:     f.size,
+			Checksum: f.checksum,
+			Version:  f.version,
+			fileMeta: f.meta,
+		}
+	}
+	bury := func(filename string, t tombstone) {
+		deleted := t.deleted
+		entries[catalogKey{filename, "t"}] = catalogEntry{Filename: filename, Role: "t", RF: t.rf, Version: t.version, Deleted: &deleted}
+	}
+
+	fs.Mutex.RLock()
+	defer fs.Mutex.RUnlock()
+	if names == nil {
+		for role, files := range map[string]map[string]File{"p": fs.p_files, "r": fs.r_files} {
+			for _, f := range files {
+				add(role, f)
+			}
+		}
+		for filename, t := range fs.tombstones {
+			bury(filename, t)
+		}
+		return entries
+	}
+	for _, name := range names {
+		if f, exists := fs.p_files[name]; exists {
+			add("p", f)
+		}
+		if f, exists := fs.r_files[name]; exists {
+			add("r", f)
+		}
+		if t, exists := fs.tombstones[name]; exists {
+			bury(name, t)
+		}
+	}
+	return entries
+}
+
+// Record the entries of the given files and tombstones in the catalog, of all of them if no name is given. Only the
+// entries that changed since they were last saved are appended to the journal of the catalog, which is synced before
+// this returns: a write costs the files it touched, not the whole catalog. Once the journal grows past the catalog,
+// it is folded into a new catalog.
+func (fs *FileServer) saveCatalog(names ...string) {
+	fs.catalog_mutex.Lock()
+	defer fs.catalog_mutex.Unlock()
+
+	current := fs.catalogEntries(names)
+	var records []journalRecord
+	for key, e := range current {
+		data, err := json.Marshal(e)
+		if err != nil {
+			log.Println("Failed to encode the catalog entry of "+e.Filename, err)
+			continue
+		}
+		if fs.catalog_saved[key] != string(data) {
+			fs.catalog_saved[key] = string(data)
+			records = append(records, journalRecord{catalogEntry: e})
+		}
+	}
+	for key := range fs.catalog_saved {
+		if _, exists := current[key]; !exists && (names == nil || containsName(names, key.filename)) {
+			delete(fs.catalog_saved, key)
+			records = append(records, journalRecord{catalogEntry: catalogEntry{Filename: key.filename, Role: key.role}, Removed: true})
+		}
+	}
+	if len(records) == 0 {
+		return
+	}
+
+	fs.catalog_journal += len(records)
+	if fs.catalog_journal > max(JOURNAL_RECORDS, 2*len(fs.catalog_saved)) {
+		if err := fs.compactCatalog(); err != nil {
+			log.Println("Failed to compact the catalog", err)
+		}
+		return
+	}
+	if err := fs.appendJournal(records); err != nil {
+		log.Println("Failed to write the journal of the catalog", err)
+	}
+}
+
+func containsName(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Append records to the journal of the catalog, one JSON object per line, and sync it
+func (fs *FileServer) appendJournal(records []journalRecord) error {
+	var data []byte
+	for _, r := range records {
+		line, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		data = append(append(data, line...), '\n')
+	}
+	path := catalogJournalPath(fs.config, fs.id)
+	_, err := os.Stat(path)
+	created := os.IsNotExist(err)
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if created {
+		return syncDir(filepath.Dir(path))
+	}
+	return nil
+}
+
+// Write the saved entries as a new catalog, replacing the previous one at once, then empty the journal
+func (fs *FileServer) compactCatalog() error {
+	entries := make([]json.RawMessage, 0, len(fs.catalog_saved))
+	for _, data := range fs.catalog_saved {
+		entries = append(entries, json.RawMessage(data))
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	path := catalogPath(fs.config, fs.id)
+	if err := writeSynced(path, data); err != nil {
+		return err
+	}
+	// The records of the journal are all in the catalog now, replaying them again would change nothing
+	if err := os.Remove(catalogJournalPath(fs.config, fs.id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	fs.catalog_journal = 0
+	return syncDir(filepath.Dir(path))
+}
+
+// Replace a file with the given content at once, the content and the rename both reaching the disk
+func writeSynced(path string, data []byte) error {
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// Sync a directory, so that the files created, renamed or removed in it stay so after a crash
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// Entries of the catalog as saved: those of the catalog, then the records of the journal replayed over them.
+// A record cut short by a crash ends the journal.
+func (fs *FileServer) loadCatalog() []catalogEntry {
+	data, err := os.ReadFile(catalogPath(fs.config, fs.id))
+	if err != nil && !os.IsNotExist(err) {
+		log.Println("Failed to read the catalog", err)
+	}
+	var saved []catalogEntry
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &saved); err != nil {
+			log.Println("Ignoring corrupted catalog", err)
+			saved = nil
+		}
+	}
+	entries := make(map[catalogKey]catalogEntry)
+	var order []catalogKey
+	set := func(e catalogEntry) {
+		key := catalogKey{e.Filename, e.Role}
+		if _, exists := entries[key]; !exists {
+			order = append(order, key)
+		}
+		entries[key] = e
+	}
+	for _, e := range saved {
+		set(e)
+	}
+
+	journal, err := os.ReadFile(catalogJournalPath(fs.config, fs.id))
+	if err != nil && !os.IsNotExist(err) {
+		log.Println("Failed to read the journal of the catalog", err)
+	}
+	for _, line := range strings.SplitAfter(string(journal), "\n") {
+		var r journalRecord
+		if !strings.HasSuffix(line, "\n") || json.Unmarshal([]byte(line), &r) != nil {
+			break
+		}
+		if r.Removed {
+			delete(entries, catalogKey{r.Filename, r.Role})
+		} else {
+			set(r.catalogEntry)
+		}
+	}
+
+	var result []catalogEntry
+	for _, key := range order {
+		if e, exists := entries[key]; exists {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+// Reload the files listed in the catalog whose content is intact, and delete the rest of the directory.
+// Every file comes back as a replica: the primary restore of updatePredList promotes those this server still
+// owns, and updatePredList pulls again the replicas that fell behind while the server was down.
+func (fs *FileServer) recoverFiles() {
+	for _, e := range fs.loadCatalog() {
+		if e.Role == "t" && e.Deleted != nil {
+			fs.tombstones[e.Filename] = tombstone{version: e.Version, rf: e.RF, deleted: *e.Deleted}
+			continue
+		}
+		size, checksum, err := fileDigest(fs.file_dir + diskName(e.Filename))
+		if err != nil || size != e.Size || checksum != e.Checksum {
+			log.Println("Dropping file " + e.Filename + ", its content doesn't match the catalog")
+			continue
+		}
+		f := NewFile(e.Filename, e.RF)
+		f.version = e.Version
+		f.meta = e.fileMeta
+		f.size = size
+		f.checksum = checksum
+		// Acknowledged appends that weren't merged yet come back from the append log
+		if f.cache, err = fs.readAppendLog(e.Filename); err != nil {
+			log.Println("Failed to read the append log of "+e.Filename, err)
+		}
+		// New appends go after the last complete record
+		if err := fs.rewriteAppendLog(e.Filename, f.cache); err != nil {
+			log.Println("Failed to rewrite the append log of "+e.Filename, err)
+		}
+		fs.r_files[e.Filename] = *f
+	}
+
+	// Files missing from the catalog may be partly written, they are fetched again if needed
+	dir, err := os.ReadDir(fs.file_dir)
+	if err != nil {
+		log.Println("Failed to list the file directory", err)
+		return
+	}
+	for _, d := range dir {
+		if _, exists := fs.r_files[hydfsName(d.Name())]; !exists && !d.IsDir() {
+			os.Remove(fs.file_dir + d.Name())
+		}
+	}
+	logs, err := os.ReadDir(fs.log_dir)
+	if err != nil {
+		log.Println("Failed to list the append log directory", err)
+		return
+	}
+	for _, d := range logs {
+		if _, exists := fs.r_files[hydfsName(strings.TrimSuffix(d.Name(), ".log"))]; !exists || !strings.HasSuffix(d.Name(), ".log") {
+			os.Remove(fs.log_dir + d.Name())
+		}
+	}
+
+	fs.removeUploads()
+
+	if len(fs.r_files) > 0 {
+		log.Printf("Recovered %d files from the catalog\n", len(fs.r_files))
+	}
+	// The recovered files start a new catalog
+	fs.catalog_mutex.Lock()
+	for key, e := range fs.catalogEntries(nil) {
+		if data, err := json.Marshal(e); err == nil {
+			fs.catalog_saved[key] = string(data)
+		}
+	}
+	if err := fs.compactCatalog(); err != nil {
+		log.Println("Failed to write the catalog", err)
+	}
+	fs.catalog_mutex.Unlock()
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRecoverFilesFromCatalog(t *testing.T) {
+	config := Config{VNodes: 16, DefaultRF: 3, MaxRF: 4, FileDir: t.TempDir() + "/"}
+	fs := FileServerInit(nil, nil, 1, config)
+
+	for name, content := range map[string]string{"intact.txt": "intact", "corrupted.txt": "corrupted"} {
+		if err := os.WriteFile(fs.file_dir+name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		f := NewFile(name, 2)
+		f.version = 3
+		fs.digest(f)
+		fs.p_files[name] = *f
+	}
+	fs.saveCatalog()
+
+	// Damage one file and leave another one out of the catalog
+	if err := os.WriteFile(fs.file_dir+"corrupted.txt", []byte("damaged"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fs.file_dir+"unlisted.txt", []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fs = FileServerInit(nil, nil, 1, config)
+	if len(fs.p_files) != 0 || len(fs.r_files) != 1 {
+		t.Fatalf("Recovered primaries %v and replicas %v, expected the replica intact.txt only", fs.p_files, fs.r_files)
+	}
+	f := fs.r_files["intact.txt"]
+	if f.rf != 2 || f.version != 3 {
+		t.Errorf("Recovered intact.txt with rf %d and version %d, expected 2 and 3", f.rf, f.version)
+	}
+	for _, name := range []string{"corrupted.txt", "unlisted.txt"} {
+		if _, err := os.Stat(fs.file_dir + name); !os.IsNotExist(err) {
+			t.Errorf("%s is still in the file directory", name)
+		}
+	}
+}
+
+func TestCatalogJournalSurvivesRestart(t *testing.T) {
+	config := Config{VNodes: 16, DefaultRF: 3, MaxRF: 4, FileDir: t.TempDir() + "/", TombstoneTTL: time.Hour}
+	fs := FileServerInit(nil, nil, 1, config)
+	catalog, err := os.ReadFile(catalogPath(config, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A file is written, another one deleted, each change only journaled
+	for _, name := range []string{"kept.txt", "deleted.txt"} {
+		if err := os.WriteFile(fs.file_dir+name, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		f := NewFile(name, 2)
+		f.version = 1
+		fs.digest(f)
+		fs.Mutex.Lock()
+		fs.p_files[name] = *f
+		fs.Mutex.Unlock()
+		fs.saveCatalog(name)
+	}
+	fs.deleteFile("deleted.txt", 2, 0)
+	fs.saveCatalog("deleted.txt")
+	if data, _ := os.ReadFile(catalogPath(config, 1)); string(data) != string(catalog) {
+		t.Errorf("catalog rewritten to %s, expected the changes in the journal only", data)
+	}
+
+	// A record cut short by a crash is ignored
+	journal, err := os.OpenFile(catalogJournalPath(config, 1), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal.WriteString(`{"filename":"kept.txt","role":"t"`)
+	journal.Close()
+
+	fs = FileServerInit(nil, nil, 1, config)
+	if f, exists := fs.r_files["kept.txt"]; !exists || f.version != 1 {
+		t.Errorf("recovered kept.txt as %v, %v", f, exists)
+	}
+	if _, exists := fs.r_files["deleted.txt"]; exists {
+		t.Error("deleted.txt came back")
+	}
+	if tomb, exists := fs.tombstones["deleted.txt"]; !exists || tomb.version != 1 {
+		t.Errorf("tombstone of deleted.txt recovered as %v, %v", tomb, exists)
+	}
+	if _, err := os.Stat(catalogJournalPath(config, 1)); !os.IsNotExist(err) {
+		t.Errorf("journal kept after it was folded into the catalog: %v", err)
+	}
+}
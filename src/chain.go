@@ -0,0 +1,150 @@
+package main
+
+import (
+	"HyDFS/ring"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// With replication_mode set to chain, appends go through the copies of a file in the order of the ring. The
+// coordinator sends an append to the head of the chain, the primary, which logs it and forwards it to the next copy,
+// its first successor, and so on down to the tail, the last replica. Each copy writes the append into the file once
+// the rest of the chain has it, and acknowledges it to the copy before it, so an append is acknowledged once the tail
+// merged it. The head forwards the appends of a file one at a time, so that every copy merges them in the order the
+// head got them, and gets read the tail, which holds every acknowledged append and none that isn't. An append that a
+// copy can't log fails, and the copies before it drop it. Appends fail until the failure detector removes that copy
+// from the ring, and so from the chain.
+
+func (fs *FileServer) chained() bool {
+	return fs.config.Replication == CHAIN_MODE
+}
+
+// Lock serializing the appends to a file this server heads the chain of
+type chainHead struct {
+	sync.Mutex
+	users   int  // Appends holding or waiting for the lock
+	dropped bool // The server stopped heading the chain, the last user removes the lock
+}
+
+// Lock the appends to a file this server is the head of, the returned function unlocks them
+func (fs *FileServer) lockChain(filename string) func() {
+	fs.Mutex.Lock()
+	head, exist := fs.chain_heads[filename]
+	if !exist {
+		head = &chainHead{}
+		fs.chain_heads[filename] = head
+	}
+	head.users++
+	fs.Mutex.Unlock()
+	head.Lock()
+	return func() {
+		head.Unlock()
+		fs.Mutex.Lock()
+		defer fs.Mutex.Unlock()
+		head.users--
+		if head.dropped && head.users == 0 && fs.chain_heads[filename] == head {
+			delete(fs.chain_heads, filename)
+		}
+	}
+}
+
+// Forget the lock of the appends to a file that was deleted, renamed or moved to another primary, once no append uses
+// it. The caller holds fs.Mutex.
+func (fs *FileServer) dropChain(filename string) {
+	head, exist := fs.chain_heads[filename]
+	if !exist {
+		return
+	}
+	if head.users == 0 {
+		delete(fs.chain_heads, filename)
+	} else {
+		head.dropped = true
+	}
+}
+
+// Copies of a file following this server in its chain, given the alive servers
+func (fs *FileServer) chainAfter(alive_ids []int, filename string, rf int) []int {
+	chain := fileReplicas(ring.New(alive_ids, fs.config.VNodes), filename, rf)
+	for i, id := range chain {
+		if id == fs.id {
+			return chain[i+1:]
+		}
+	}
+	return chain
+}
+
+// Chain of a forwarded append, the copies left after the one receiving it
+func formatChain(chain []int) string {
+	ids := make([]string, len(chain))
+	for i, id := range chain {
+		ids[i] = strconv.Itoa(id)
+	}
+	return strings.Join(ids, ",")
+}
+
+func parseChain(s string) []int {
+	var chain []int
+	for _, field := range strings.Split(s, ",") {
+		if id, err := strconv.Atoi(field); err == nil {
+			chain = append(chain, id)
+		}
+	}
+	return chain
+}
+
+// Forward a logged append to the next copy of the chain, which forwards it down to the tail, and return how many
+// copies down the chain acknowledged it. An append the next copy didn't log fails, so that the tail, which gets read,
+// holds every acknowledged append.
+func (fs *FileServer) forwardChain(filename string, query string, pending pendingAppend, chain []int) (int, error) {
+	if len(chain) == 0 {
+		return 0, nil
+	}
+	url := fmt.Sprintf("http://%s/appending?filename=%s&init=false&%s&chain=%s", fs.nodes.HTTPAddr(chain[0]), escapeName(filename), query, formatChain(chain[1:]))
+	content, err := fs.openAppend(filename, pending)
+	if err != nil {
+		return 0, err
+	}
+	defer content.Close()
+	hashed := newHashingReader(content)
+	header, err := fs.putHeader(url, hashed, hashed.Sum)
+	if err != nil {
+		return 0, fmt.Errorf("server %d of the chain of %s: %w", chain[0], filename, err)
+	}
+	acks, _ := strconv.Atoi(header.Get(ACKS_HEADER))
+	return max(acks, 1), nil
+}
+
+// Fetch the block map of a file from the tail of its chain, where the acknowledged appends are merged, or from the
+// copy closest to the tail when it can't answer, which holds them too
+func (fs *FileServer) fetchTailBlockMap(p_server int, filename string, at string) (storedCopy, int, error) {
+	rf, err := fs.fetchRF(p_server, filename)
+	if err != nil {
+		return storedCopy{}, 0, err
+	}
+	if rf == -1 {
+		return storedCopy{}, 0, fmt.Errorf("server %d, %s: %w", p_server, filename, errNotStored)
+	}
+	chain := fileReplicas(fs.currentRing(), filename, rf)
+	err = fmt.Errorf("server %d, %s: %w", p_server, filename, errNotStored)
+	for i := len(chain) - 1; i >= 0; i-- {
+		ftype := "r"
+		if chain[i] == p_server {
+			ftype = "p"
+		}
+		c, fetchErr := fs.fetchCopy(chain[i], filename, ftype, at)
+		if fetchErr == nil {
+			return c, 1, nil
+		}
+		// A missing version is missing on every copy
+		if errors.Is(fetchErr, errNoVersion) {
+			return storedCopy{}, 0, fetchErr
+		}
+		if !errors.Is(fetchErr, errNotStored) {
+			err = fetchErr
+		}
+	}
+	return storedCopy{}, 0, err
+}
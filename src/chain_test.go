@@ -0,0 +1,120 @@
+package main
+
+import (
+	"HyDFS/client"
+	"HyDFS/ring"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChainAppendsAreReadFromTheTail(t *testing.T) {
+	c := newTestClusterWith(t, 4, map[string]interface{}{"replication_mode": "chain"})
+	c.mustCreate(c.Client(), "file.txt", "x", 3)
+	c.WaitReplicas(5 * time.Second)
+
+	// Appends come through every server, the chain starts at the primary whichever it is
+	ids := c.nodes.IDs()
+	for i, content := range []string{"a", "b", "c"} {
+		cl := client.New([]string{c.nodes.HTTPAddr(ids[i%len(ids)])})
+		if acks, err := cl.AppendQuorum("file.txt", strings.NewReader(content), 0); err != nil || acks != 3 {
+			t.Fatalf("append acknowledged by %d copies, %v", acks, err)
+		}
+	}
+
+	// Every copy merged the appends in the same order, a client that made none reads them without a merge
+	holders := c.holders("file.txt")
+	for _, id := range holders[1:] {
+		if c.content(id, "file.txt") != c.content(holders[0], "file.txt") {
+			t.Errorf("node %d stores another block map than the primary %d", id, holders[0])
+		}
+	}
+	if got := c.mustGet(c.Client(), "file.txt"); got != "xabc" {
+		t.Fatalf("get = %q, expected the acknowledged appends", got)
+	}
+
+	// The copy before the tail takes over from it
+	var live []int
+	for id := range c.live() {
+		live = append(live, id)
+	}
+	chain := fileReplicas(ring.New(live, c.config.VNodes), "file.txt", 3)
+	c.Kill(chain[len(chain)-1])
+	c.WaitMembership(10 * time.Second)
+	c.WaitReplicas(10 * time.Second)
+
+	cl := c.Client()
+	if acks, err := cl.AppendQuorum("file.txt", strings.NewReader("d"), 0); err != nil || acks != 3 {
+		t.Fatalf("append acknowledged by %d copies, %v", acks, err)
+	}
+	if got := c.mustGet(c.Client(), "file.txt"); got != "xabcd" {
+		t.Errorf("get = %q after the tail failed", got)
+	}
+}
+
+func TestChainAppendFailsWhenTheTailMissesIt(t *testing.T) {
+	c := newTestClusterWith(t, 4, map[string]interface{}{"replication_mode": "chain"})
+	cl := c.Client()
+	c.mustCreate(cl, "file.txt", "x", 3)
+	c.WaitReplicas(5 * time.Second)
+
+	// The tail is alive but doesn't log the append, which fails instead of being acknowledged without it
+	chain := fileReplicas(ring.New(c.nodes.IDs(), c.config.VNodes), "file.txt", 3)
+	tail := chain[len(chain)-1]
+	c.Drop(tail, "/appending")
+	if _, err := cl.AppendQuorum("file.txt", strings.NewReader("a"), 0); !errors.Is(err, client.ErrQuorum) {
+		t.Fatalf("append without the tail returned %v", err)
+	}
+	c.Drop(tail, "")
+	if got := c.mustGet(c.Client(), "file.txt"); got != "x" {
+		t.Fatalf("get = %q, the failed append was read", got)
+	}
+	for _, id := range chain[:len(chain)-1] {
+		if c.content(id, "file.txt") != c.content(tail, "file.txt") {
+			t.Errorf("node %d stores another block map than the tail %d", id, tail)
+		}
+	}
+
+	if acks, err := cl.AppendQuorum("file.txt", strings.NewReader("b"), 0); err != nil || acks != 3 {
+		t.Fatalf("append acknowledged by %d copies, %v", acks, err)
+	}
+	if got := c.mustGet(c.Client(), "file.txt"); got != "xb" {
+		t.Errorf("get = %q, expected the acknowledged append", got)
+	}
+}
+
+func TestChainHeadsAreForgottenWithTheirFiles(t *testing.T) {
+	c := newTestClusterWith(t, 4, map[string]interface{}{"replication_mode": "chain"})
+	cl := c.Client()
+	for _, name := range []string{"deleted.txt", "renamed.txt"} {
+		c.mustCreate(cl, name, "x", 3)
+		if _, err := cl.AppendQuorum(name, strings.NewReader("a"), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	heads := func() map[string]bool {
+		names := make(map[string]bool)
+		for _, node := range c.live() {
+			node.fs.Mutex.Lock()
+			for name := range node.fs.chain_heads {
+				names[name] = true
+			}
+			node.fs.Mutex.Unlock()
+		}
+		return names
+	}
+	if got := heads(); !got["deleted.txt"] || !got["renamed.txt"] {
+		t.Fatalf("chains headed %v, expected both files", got)
+	}
+
+	if err := cl.Delete("deleted.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Rename("renamed.txt", "new.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got := heads(); got["deleted.txt"] || got["renamed.txt"] {
+		t.Errorf("chains headed %v after the delete and the rename", got)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+)
+
+// Every transfer of file content carries the SHA-256 of the content, checked by the receiver before it stores or
+// acknowledges anything. Uploads end with it in a trailer, computed while the content is sent, and a stored file is
+// sent with the checksum of its entry once its content is checked against it. A server finding a stored file
+// corrupt refuses to send it and fetches it again from another server storing it.
+
+const CHECKSUM_HEADER = "Checksum" // SHA-256 of the content, hex encoded
+
+var errChecksum = errors.New("checksum mismatch")
+
+// Reader computing the SHA-256 of what is read through it
+type hashingReader struct {
+	r io.Reader
+	h hash.Hash
+}
+
+func newHashingReader(r io.Reader) *hashingReader {
+	return &hashingReader{r: r, h: sha256.New()}
+}
+
+func (hr *hashingReader) Read(b []byte) (int, error) {
+	n, err := hr.r.Read(b)
+	hr.h.Write(b[:n])
+	return n, err
+}
+
+// Checksum of the content read so far
+func (hr *hashingReader) Sum() string {
+	return hex.EncodeToString(hr.h.Sum(nil))
+}
+
+// Compare a checksum with the one the sender gave, content sent without one is rejected as unchecked
+func checkSum(expected string, actual string) error {
+	if expected == "" {
+		return fmt.Errorf("%w: received %s, sent none", errChecksum, actual)
+	}
+	if expected != actual {
+		return fmt.Errorf("%w: received %s, sent %s", errChecksum, actual, expected)
+	}
+	return nil
+}
+
+// Checksum a request gives for its body, in a header when it is known upfront or else in a trailer.
+// The trailer is only there once the body is read.
+func requestChecksum(r *http.Request) string {
+	if checksum := r.Header.Get(CHECKSUM_HEADER); checksum != "" {
+		return checksum
+	}
+	return r.Trailer.Get(CHECKSUM_HEADER)
+}
+
+func stringChecksum(s string) string {
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+// Request body that sets the checksum trailer of its request once the content is read
+type trailerReader struct {
+	r        io.Reader
+	trailer  http.Header
+	checksum func() string
+}
+
+func (tr *trailerReader) Read(b []byte) (int, error) {
+	n, err := tr.r.Read(b)
+	if err == io.EOF {
+		tr.trailer.Set(CHECKSUM_HEADER, tr.checksum())
+	}
+	return n, err
+}
+
+// Entry of a stored file, ftype being "p" for a primary, "r" for a replica or "" for either
+func (fs *FileServer) storedFile(filename string, ftype string) (File, bool) {
+	fs.Mutex.Lock()
+	defer fs.Mutex.Unlock()
+	f, exists := fs.p_files[filename]
+	if ftype == "r" || (ftype == "" && !exists) {
+		f, exists = fs.r_files[filename]
+	}
+	return f, exists
+}
+
+// Lock a stored file through its current entry, for writing or for reading. A writer replacing the content of a
+// file replaces its entry while it holds the lock, so a reader holding it finds content that matches the entry.
+func (fs *FileServer) lockFile(filename string, ftype string, write bool) (File, bool, func()) {
+	for {
+		f, exists := fs.storedFile(filename, ftype)
+		if !exists {
+			return f, false, func() {}
+		}
+		unlock := f.Mutex.RUnlock
+		if write {
+			f.Mutex.Lock()
+			unlock = f.Mutex.Unlock
+		} else {
+			f.Mutex.RLock()
+		}
+		// The entry may have been replaced while waiting for its lock
+		if current, exists := fs.storedFile(filename, ftype); exists && current.Mutex == f.Mutex {
+			return current, true, unlock
+		}
+		unlock()
+	}
+}
+
+// Content of a stored file found to match its entry, as it was on disk then
+type verification struct {
+	checksum string
+	info     os.FileInfo
+}
+
+// Whether the content of a file was checked since it last changed, through a write, a merge or a repair
+func (v verification) current(f File, info os.FileInfo) bool {
+	return v.info != nil && v.checksum == f.checksum && os.SameFile(v.info, info) && v.info.Size() == info.Size() && v.info.ModTime().Equal(info.ModTime())
+}
+
+// Open a stored file to send it, once its content is checked against its entry. A corrupt file is fetched again from
+// another server, and not sent in the meantime. The lock of the file is only held for the check: merges append to the
+// file and writes replace it with another, so the first f.size bytes of the opened file stay the content of the entry.
+// Content checked since it last changed isn't read again, the Scrubber finding the files rotting on disk.
+func (fs *FileServer) openVerified(filename string, ftype string) (*os.File, File, error) {
+	return fs.openChecked(filename, ftype, false)
+}
+
+// Like openVerified, always reading the content when scrub is set
+func (fs *FileServer) openChecked(filename string, ftype string, scrub bool) (*os.File, File, error) {
+	f, exists, unlock := fs.lockFile(filename, ftype, false)
+	defer unlock()
+	if !exists {
+		return nil, f, errNotStored
+	}
+	file, err := os.Open(fs.file_dir + diskName(filename))
+	if err != nil {
+		return nil, f, err
+	}
+	info, err := file.Stat()
+	if err == nil && (scrub || !f.verified.current(f, info)) {
+		h := sha256.New()
+		var size int64
+		size, err = io.Copy(h, file)
+		if err == nil && (size != f.size || hex.EncodeToString(h.Sum(nil)) != f.checksum) {
+			err = fmt.Errorf("%w: stored file %s", errChecksum, filename)
+			go fs.repairFile(filename)
+		}
+		if err == nil {
+			fs.setVerified(f, verification{checksum: f.checksum, info: info})
+			_, err = file.Seek(0, io.SeekStart)
+		}
+	}
+	if err != nil {
+		file.Close()
+		return nil, f, err
+	}
+	return file, f, nil
+}
+
+// Record the check of the content of an entry, unless the entry changed since
+func (fs *FileServer) setVerified(f File, v verification) {
+	fs.Mutex.Lock()
+	defer fs.Mutex.Unlock()
+	for _, files := range []map[string]File{fs.p_files, fs.r_files} {
+		if stored, exists := files[f.filename]; exists && stored.Mutex == f.Mutex && stored.checksum == f.checksum {
+			stored.verified = v
+			files[f.filename] = stored
+		}
+	}
+}
+
+// Replace a corrupt stored file with the copy of another server storing it, keeping its entry and pending appends
+func (fs *FileServer) repairFile(filename string) {
+	fs.Mutex.Lock()
+	if fs.repairing[filename] {
+		fs.Mutex.Unlock()
+		return
+	}
+	fs.repairing[filename] = true
+	fs.Mutex.Unlock()
+	defer func() {
+		fs.Mutex.Lock()
+		delete(fs.repairing, filename)
+		fs.Mutex.Unlock()
+	}()
+
+	f, exists := fs.storedFile(filename, "")
+	if !exists {
+		return
+	}
+	log.Println("Repairing corrupt file " + filename)
+	for i, server := range fileReplicas(fs.currentRing(), filename, f.rf) {
+		if server == fs.id {
+			continue
+		}
+		ftype := "r"
+		if i == 0 {
+			ftype = "p"
+		}
+		resp, err := fs.fetchStored(server, filename, ftype)
+		if err != nil {
+			continue
+		}
+		err = fs.storeFile(filename, resp.Body, func() string { return resp.Header.Get(CHECKSUM_HEADER) }, func(size int64, checksum string) error {
+			fs.Mutex.Lock()
+			defer fs.Mutex.Unlock()
+			for _, files := range []map[string]File{fs.p_files, fs.r_files} {
+				if stored, exists := files[filename]; exists && stored.Mutex == f.Mutex {
+					stored.version = parseVersion(resp.Header.Get("Version"))
+					stored.size = size
+					stored.checksum = checksum
+					files[filename] = stored
+					return nil
+				}
+			}
+			return fmt.Errorf("file %s was replaced during its repair", filename)
+		})
+		resp.Body.Close()
+		if err != nil {
+			log.Println("Failed to repair file "+filename+" from server", server, err)
+			continue
+		}
+		fs.saveCatalog(filename)
+		log.Println("Repaired file "+filename+" from server", server)
+		return
+	}
+	log.Println("No server could repair file " + filename)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCorruptBlockIsRepaired(t *testing.T) {
+	c := newTestCluster(t, 4)
+	cl := c.Client()
+
+	c.mustCreate(cl, "data.txt", "hello world", 3)
+	c.WaitReplicas(5 * time.Second)
+
+	// Damage the copy of the primary of the block, keeping its size
+	blocks, err := parseBlockMap(strings.NewReader(c.content(c.holders("data.txt")[0], "data.txt")))
+	if err != nil || len(blocks) != 1 {
+		t.Fatalf("Block map of data.txt: %v %v", blocks, err)
+	}
+	primary := c.holders(blocks[0].name)[0]
+	if err := os.WriteFile(c.node(primary).fs.file_dir+diskName(blocks[0].name), []byte("HELLO WORLD"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := c.mustGet(cl, "data.txt"); got != "hello world" {
+		t.Errorf("Get data.txt = %q with a corrupt block", got)
+	}
+	c.waitFor("the block to be repaired", 5*time.Second, func() error {
+		if got := c.content(primary, blocks[0].name); got != "hello world" {
+			return fmt.Errorf("node %d stores the block as %q", primary, got)
+		}
+		return nil
+	})
+}
+
+func TestUploadNotMatchingChecksumIsRejected(t *testing.T) {
+	c := newTestCluster(t, 2)
+
+	url := fmt.Sprintf("http://%s/creating?filename=file.txt&ftype=p&rf=2", c.node(1).fs.nodes.HTTPAddr(1))
+	req, err := http.NewRequest(http.MethodPut, url, strings.NewReader("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(CHECKSUM_HEADER, stringChecksum("other content"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Upload answered %s, expected 400 Bad Request", resp.Status)
+	}
+	if holders := c.holders("file.txt"); len(holders) != 0 {
+		t.Errorf("file.txt is stored on %v", holders)
+	}
+}
+
+func TestUploadWithoutChecksumIsRejected(t *testing.T) {
+	c := newTestCluster(t, 2)
+	cl := c.Client()
+	c.mustCreate(cl, "file.txt", "a", 2)
+	addr := c.node(1).fs.nodes.HTTPAddr(1)
+
+	for _, path := range []string{
+		"/append?filename=file.txt",
+		"/creating?filename=other.txt&ftype=p&rf=2",
+		"/appending?filename=file.txt&ftype=p&timestamp=1.0",
+	} {
+		req, err := http.NewRequest(http.MethodPut, "http://"+addr+path, strings.NewReader("content"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("PUT %s without a checksum answered %s, expected 400 Bad Request", path, resp.Status)
+		}
+	}
+	if holders := c.holders("other.txt"); len(holders) != 0 {
+		t.Errorf("other.txt is stored on %v", holders)
+	}
+	if got := c.mustGet(cl, "file.txt"); got != "a" {
+		t.Errorf("Get file.txt = %q after appends without a checksum", got)
+	}
+}
+
+func TestStoredContentIsInPlaceBeforeItsEntry(t *testing.T) {
+	c := newTestCluster(t, 1)
+	fs := c.node(1).fs
+	path := fs.file_dir + diskName("file.txt")
+	store := func(content string, commit func() error) error {
+		return fs.storeFile("file.txt", strings.NewReader(content), func() string { return stringChecksum(content) }, func(size int64, checksum string) error {
+			// A reader finding the new entry must find the new content
+			if got, _ := os.ReadFile(path); string(got) != content {
+				t.Errorf("file holds %q when its entry for %q is installed", got, content)
+			}
+			if err := commit(); err != nil {
+				return err
+			}
+			f := NewFile("file.txt", 1)
+			f.size, f.checksum = size, checksum
+			fs.Mutex.Lock()
+			fs.p_files["file.txt"] = *f
+			fs.Mutex.Unlock()
+			return nil
+		})
+	}
+
+	if err := store("hello", func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if err := store("world", func() error { return errQuorum }); err != errQuorum {
+		t.Fatalf("store with a failing commit returned %v", err)
+	}
+	if got, _ := os.ReadFile(path); string(got) != "hello" {
+		t.Errorf("file holds %q after a failed commit, expected the previous content", got)
+	}
+	file, _, err := fs.openVerified("file.txt", "")
+	if err != nil {
+		t.Fatalf("previous content doesn't match its entry: %v", err)
+	}
+	file.Close()
+}
+
+func TestCheckedContentIsOnlyReadAgainByTheScrub(t *testing.T) {
+	c := newTestCluster(t, 1)
+	fs := c.node(1).fs
+	c.mustCreate(c.Client(), "data.txt", "hello world", 1)
+	blocks, err := parseBlockMap(strings.NewReader(c.content(1, "data.txt")))
+	if err != nil || len(blocks) != 1 {
+		t.Fatalf("Block map of data.txt: %v %v", blocks, err)
+	}
+	name := blocks[0].name
+	file, _, err := fs.openVerified(name, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	// Rot leaves the size and modification time of the file as they were
+	path := fs.file_dir + diskName(name)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("HELLO WORLD"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if file, _, err := fs.openVerified(name, ""); err != nil {
+		t.Errorf("open of checked content read it again: %v", err)
+	} else {
+		file.Close()
+	}
+	if _, _, err := fs.openChecked(name, "", true); !errors.Is(err, errChecksum) {
+		t.Errorf("scrub of rotten content returned %v, expected errChecksum", err)
+	}
+}
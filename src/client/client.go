@@ -0,0 +1,682 @@
+package client
+
+import (
+	"HyDFS/registry"
+	"bytes"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	PROBE_TIMEOUT   = 2 * time.Second
+	CHECKSUM_HEADER = "Checksum"       // Trailer carrying the SHA-256 of the content of uploads and gets, hex encoded
+	ACKS_HEADER     = "Replica-Acks"   // Copies of the file that acknowledged a create or an append, or answered a get
+	HLC_HEADER      = "HLC"            // Clock of the server sending a response, "wall.logical"
+	ERROR_HEADER    = "Error-Code"     // Why the server rejected a request, see ServerError.Unwrap
+	FAILED_HEADER   = "Failed-Servers" // Ids of the servers a list couldn't ask, comma separated
+)
+
+// Client sends HyDFS requests to a coordinator, which can be any live server of the cluster
+type Client struct {
+	servers     []string // host:port of every file server
+	http        *http.Client
+	probe       *http.Client
+	mu          sync.Mutex
+	coordinator string // Last server known to be alive, "" if none yet
+
+	// Appends are numbered, and each one is sent with the number of the previous one to its file and the latest clock
+	// of the servers the client heard from, so that the servers apply them after the previous ones and after
+	// everything the client saw, whichever coordinators they go through
+	id    string
+	seq   uint64
+	after string            // Latest HLC timestamp of the responses, "" before the first one
+	last  map[string]uint64 // Number of the last append sent to each file
+	// A get of a file is sent with the number of the last append to it, so that it reads its own writes
+	written map[string]uint64
+}
+
+// State is what a client numbers its appends and reads its own writes with. Programs that run a client per command,
+// like the command line tool, keep it between commands so that they act as a single client.
+type State struct {
+	ID      string            `json:"id"`
+	Seq     uint64            `json:"seq"`
+	After   string            `json:"after,omitempty"`
+	Last    map[string]uint64 `json:"last,omitempty"`    // Number of the last append sent to each file
+	Written map[string]uint64 `json:"written,omitempty"` // Number of the last acknowledged append to each file
+}
+
+// New creates a client for the file servers at the given host:port addresses
+func New(servers []string) *Client {
+	id := make([]byte, 8)
+	crand.Read(id)
+	return &Client{
+		servers: servers,
+		http:    &http.Client{},
+		probe:   &http.Client{Timeout: PROBE_TIMEOUT},
+		id:      hex.EncodeToString(id),
+		last:    make(map[string]uint64),
+		written: make(map[string]uint64),
+	}
+}
+
+// State returns the id of the client and the numbers of its appends
+func (c *Client) State() State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return State{ID: c.id, Seq: c.seq, After: c.after, Last: copyNumbers(c.last), Written: copyNumbers(c.written)}
+}
+
+// Restore makes the client go on from a state returned by State
+func (c *Client) Restore(s State) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.id, c.seq, c.after = s.ID, s.Seq, s.After
+	c.last, c.written = copyNumbers(s.Last), copyNumbers(s.Written)
+}
+
+func copyNumbers(m map[string]uint64) map[string]uint64 {
+	copied := make(map[string]uint64, len(m))
+	for name, seq := range m {
+		copied[name] = seq
+	}
+	return copied
+}
+
+// ID returns the id the client numbers its appends under, random and different for every client unless restored
+func (c *Client) ID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.id
+}
+
+// NewFromRegistry creates a client for every node of the registry
+func NewFromRegistry(nodes *registry.Registry) *Client {
+	servers := make([]string, 0, nodes.Len())
+	for _, id := range nodes.IDs() {
+		servers = append(servers, nodes.HTTPAddr(id))
+	}
+	return New(servers)
+}
+
+// Load creates a client for the nodes listed in a config file
+func Load(configFile string) (*Client, error) {
+	nodes, err := registry.Load(configFile)
+	if err != nil {
+		return nil, err
+	}
+	return NewFromRegistry(nodes), nil
+}
+
+// Coordinator returns the address of a live server, searching from a random one if the last coordinator is gone
+func (c *Client) Coordinator() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.coordinator != "" {
+		return c.coordinator, nil
+	}
+
+	if len(c.servers) == 0 {
+		return "", ErrNoServer
+	}
+	start := rand.Intn(len(c.servers))
+	for i := range c.servers {
+		addr := c.servers[(start+i)%len(c.servers)]
+		resp, err := c.probe.Get("http://" + addr + "/")
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			c.coordinator = addr
+			return addr, nil
+		}
+	}
+	return "", ErrNoServer
+}
+
+// drop forgets a coordinator that couldn't be reached
+func (c *Client) drop(addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.coordinator == addr {
+		c.coordinator = ""
+	}
+}
+
+// send builds a request for a coordinator and sends it, failing over to another coordinator while
+// servers can't be reached. It returns the coordinator that answered along with its response.
+func (c *Client) send(build func(addr string) (*http.Request, error)) (string, *http.Response, error) {
+	for range c.servers {
+		addr, err := c.Coordinator()
+		if err != nil {
+			return "", nil, err
+		}
+
+		req, err := build(addr)
+		if err != nil {
+			return "", nil, err
+		}
+		resp, err := c.http.Do(req)
+		if err != nil {
+			c.drop(addr)
+			continue
+		}
+		c.observe(resp.Header)
+		return addr, resp, nil
+	}
+	return "", nil, ErrNoServer
+}
+
+// observe keeps the clock of the server sending a response if it is the latest one
+func (c *Client) observe(header http.Header) {
+	stamp := header.Get(HLC_HEADER)
+	c.mu.Lock()
+	if later(stamp, c.after) {
+		c.after = stamp
+	}
+	c.mu.Unlock()
+}
+
+// later tells if HLC timestamp a is past b, "" being before any other
+func later(a string, b string) bool {
+	aw, al, _ := strings.Cut(a, ".")
+	bw, bl, _ := strings.Cut(b, ".")
+	x, errX := strconv.ParseInt(aw, 10, 64)
+	y, _ := strconv.ParseInt(bw, 10, 64)
+	if errX != nil || x != y {
+		return errX == nil && x > y
+	}
+	xl, _ := strconv.ParseUint(al, 10, 32)
+	yl, _ := strconv.ParseUint(bl, 10, 32)
+	return xl > yl
+}
+
+// check turns a response that isn't 200 OK into a ServerError, closing its body
+func check(op string, resp *http.Response) error {
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return &ServerError{Op: op, Status: resp.StatusCode, Code: resp.Header.Get(ERROR_HEADER), Message: string(bytes.TrimSpace(body))}
+}
+
+// text reads the whole body of a successful response
+func text(op string, resp *http.Response) (string, error) {
+	if err := check(op, resp); err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func jsonRequest(method string, url string, body map[string]string) (*http.Request, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+// authorize runs the first phase of create and append, returning the coordinator that authorized the request
+func (c *Client) authorize(op string, body map[string]string) (string, error) {
+	addr, resp, err := c.send(func(addr string) (*http.Request, error) {
+		return jsonRequest(http.MethodPost, "http://"+addr+"/"+op, body)
+	})
+	if err != nil {
+		return "", err
+	}
+	if _, err := text(op, resp); err != nil {
+		return "", err
+	}
+	return addr, nil
+}
+
+// upload runs the second phase of create and append, streaming the content to the coordinator that authorized it.
+// The content ends with its checksum, the coordinator rejects content that doesn't match it.
+func (c *Client) upload(op string, addr string, query url.Values, content io.Reader) (http.Header, error) {
+	req, err := http.NewRequest(http.MethodPut, "http://"+addr+"/"+op+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Trailer = http.Header{CHECKSUM_HEADER: nil}
+	req.Body = io.NopCloser(&checksumBody{r: content, h: sha256.New(), trailer: req.Trailer})
+	req.ContentLength = -1
+	resp, err := c.http.Do(req)
+	if err != nil {
+		c.drop(addr)
+		return nil, fmt.Errorf("hydfs: %s upload to %s failed: %w", op, addr, err)
+	}
+	c.observe(resp.Header)
+	_, err = text(op, resp)
+	return resp.Header, err
+}
+
+// Create stores the content as a new HyDFS file. rf is the number of servers storing it, 0 for the cluster default.
+func (c *Client) Create(name string, content io.Reader, rf int) error {
+	_, err := c.CreateQuorum(name, content, rf, Quorum{})
+	return err
+}
+
+// Quorum gives the copies of a file a write waits for and a get reads, 0 leaving the ones of the file or the cluster
+type Quorum struct {
+	W int // Copies that must hold a create or an append before it succeeds
+	R int // Copies a get reads, the newest one being served
+}
+
+// CreateQuorum creates like Create, the file keeping q for the writes and gets that don't give their own. It returns
+// the number of copies that stored the file, ErrQuorum telling that fewer than W did.
+func (c *Client) CreateQuorum(name string, content io.Reader, rf int, q Quorum) (int, error) {
+	body := map[string]string{"local": name, "hydfs": name}
+	if rf != 0 {
+		body["rf"] = strconv.Itoa(rf)
+	}
+	if q.W != 0 {
+		body["w"] = strconv.Itoa(q.W)
+	}
+	if q.R != 0 {
+		body["r"] = strconv.Itoa(q.R)
+	}
+	addr, err := c.authorize("create", body)
+	if err != nil {
+		return 0, err
+	}
+	header, err := c.upload("create", addr, url.Values{"filename": {name}}, content)
+	if err == nil {
+		c.forget(name)
+	}
+	return acks(header), err
+}
+
+// acks is the number of copies that acknowledged a request
+func acks(header http.Header) int {
+	n, _ := strconv.Atoi(header.Get(ACKS_HEADER))
+	return n
+}
+
+// forget the appends the client made to a file that was replaced
+func (c *Client) forget(name string) {
+	c.mu.Lock()
+	delete(c.written, name)
+	delete(c.last, name)
+	c.mu.Unlock()
+}
+
+// Append adds the content to the end of an existing HyDFS file
+func (c *Client) Append(name string, content io.Reader) error {
+	return c.AppendThrough(name, content, 0)
+}
+
+// AppendThrough appends like Append, routing the content through the replica-th replica of the file (0 being its primary)
+func (c *Client) AppendThrough(name string, content io.Reader, replica int) error {
+	_, err := c.append(name, content, replica, 0)
+	return err
+}
+
+// AppendQuorum appends like Append, succeeding once w copies of the file logged the append, 0 for the quorum of the
+// file. It returns the number of copies that logged it, ErrQuorum telling that fewer than w did. Those copies keep
+// the append all the same.
+func (c *Client) AppendQuorum(name string, content io.Reader, w int) (int, error) {
+	return c.append(name, content, 0, w)
+}
+
+func (c *Client) append(name string, content io.Reader, replica int, w int) (int, error) {
+	addr, err := c.authorize("append", map[string]string{"local": name, "hydfs": name})
+	if err != nil {
+		return 0, err
+	}
+	// Appends sent concurrently are merged in the order of their numbers, each one waiting for the previous one
+	c.mu.Lock()
+	c.seq++
+	seq, prev := c.seq, c.last[name]
+	c.last[name] = seq
+	query := url.Values{"filename": {name}, "num": {strconv.Itoa(replica)}, "client": {c.id}, "seq": {strconv.FormatUint(seq, 10)}, "prev": {strconv.FormatUint(prev, 10)}}
+	if c.after != "" {
+		query.Set("after", c.after)
+	}
+	c.mu.Unlock()
+	if w != 0 {
+		query.Set("w", strconv.Itoa(w))
+	}
+	header, err := c.upload("append", addr, query, content)
+	if err != nil {
+		// The append may never be merged, the next one doesn't wait for it
+		c.mu.Lock()
+		if c.last[name] == seq {
+			c.last[name] = prev
+		}
+		c.mu.Unlock()
+		return acks(header), err
+	}
+	c.mu.Lock()
+	if stamp := header.Get("Append-Timestamp"); later(stamp, c.after) {
+		c.after = stamp
+	}
+	if seq > c.written[name] {
+		c.written[name] = seq
+	}
+	c.mu.Unlock()
+	return acks(header), nil
+}
+
+// Get writes the content of a HyDFS file to w, with the appends the client made to it
+func (c *Client) Get(name string, w io.Writer) error {
+	_, err := c.get("get", c.session(name), 0, 0, w)
+	return err
+}
+
+// GetQuorum gets like Get, reading r copies of the file and writing the newest one, 0 for the quorum of the file.
+// It returns the number of copies that answered, ErrQuorum telling that fewer than r did.
+func (c *Client) GetQuorum(name string, r int, w io.Writer) (int, error) {
+	body := c.session(name)
+	if r != 0 {
+		body["r"] = strconv.Itoa(r)
+	}
+	header, err := c.get("get", body, 0, 0, w)
+	return acks(header), err
+}
+
+// session is the body of a get of the current content of a file, with the number of the last append to it
+func (c *Client) session(name string) map[string]string {
+	body := map[string]string{"local": name, "hydfs": name}
+	c.mu.Lock()
+	if seq := c.written[name]; seq > 0 {
+		body["client"] = c.id
+		body["seq"] = strconv.FormatUint(seq, 10)
+	}
+	c.mu.Unlock()
+	return body
+}
+
+// GetRange writes length bytes of a HyDFS file from offset to w, length 0 reading to the end of the file. It returns
+// the current size of the file, so that callers can page through it. The range stops at the end of the file, and
+// ErrRange is returned for an offset past it.
+func (c *Client) GetRange(name string, offset int64, length int64, w io.Writer) (int64, error) {
+	header, err := c.get("get", c.session(name), offset, length, w)
+	size, _ := strconv.ParseInt(header.Get("File-Size"), 10, 64)
+	return size, err
+}
+
+// GetVersion writes a HyDFS file to w as it was at the given version, ErrVersion telling that the version isn't
+// retained. Versions are numbered like the writes of the file, the create being 1.
+func (c *Client) GetVersion(name string, version int, w io.Writer) error {
+	_, err := c.get("get", map[string]string{"local": name, "hydfs": name, "version": strconv.Itoa(version)}, 0, 0, w)
+	return err
+}
+
+// GetAsOf writes a HyDFS file to w as it was at the given time, ErrVersion telling that no version that old is retained
+func (c *Client) GetAsOf(name string, t time.Time, w io.Writer) error {
+	_, err := c.get("get", map[string]string{"local": name, "hydfs": name, "as_of": t.Format(time.RFC3339Nano)}, 0, 0, w)
+	return err
+}
+
+// GetFromReplica writes the content of a HyDFS file to w, reading it from the replica stored on server id
+func (c *Client) GetFromReplica(id int, name string, w io.Writer) error {
+	_, err := c.get("getfromreplica", map[string]string{"local": name, "hydfs": name, "vm_id": strconv.Itoa(id)}, 0, 0, w)
+	return err
+}
+
+func (c *Client) get(op string, body map[string]string, offset int64, length int64, w io.Writer) (http.Header, error) {
+	if offset < 0 || length < 0 {
+		return nil, fmt.Errorf("hydfs: invalid range of %d bytes at %d", length, offset)
+	}
+	_, resp, err := c.send(func(addr string) (*http.Request, error) {
+		req, err := jsonRequest(http.MethodGet, "http://"+addr+"/"+op, body)
+		if err == nil && (offset > 0 || length > 0) {
+			if length > 0 {
+				req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+			} else {
+				req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+			}
+		}
+		return req, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		if err := check(op, resp); err != nil {
+			return resp.Header, err
+		}
+	}
+	defer resp.Body.Close()
+
+	// Only the whole file ends with a checksum, a range is checked by the servers
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, h), resp.Body); err != nil {
+		return resp.Header, err
+	}
+	if checksum := resp.Trailer.Get(CHECKSUM_HEADER); checksum != "" && checksum != hex.EncodeToString(h.Sum(nil)) {
+		return resp.Header, fmt.Errorf("%w: %s of %s", ErrChecksum, op, body["hydfs"])
+	}
+	return resp.Header, nil
+}
+
+// checksumBody is a request body that sets the checksum trailer of its request once the content is read
+type checksumBody struct {
+	r       io.Reader
+	h       hash.Hash
+	trailer http.Header
+}
+
+func (b *checksumBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.h.Write(p[:n])
+	if err == io.EOF {
+		b.trailer.Set(CHECKSUM_HEADER, hex.EncodeToString(b.h.Sum(nil)))
+	}
+	return n, err
+}
+
+// getText sends a GET request to a coordinator and returns the body of its response
+func (c *Client) getText(op string, query url.Values) (string, error) {
+	_, resp, err := c.send(func(addr string) (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, "http://"+addr+"/"+op+"?"+query.Encode(), nil)
+	})
+	if err != nil {
+		return "", err
+	}
+	return text(op, resp)
+}
+
+// Merge makes all replicas of a HyDFS file identical by applying their pending appends
+func (c *Client) Merge(name string) error {
+	_, err := c.getText("merge", url.Values{"filename": {name}})
+	return err
+}
+
+// Delete removes a HyDFS file from every server storing it, its name can then be created again
+func (c *Client) Delete(name string) error {
+	_, resp, err := c.send(func(addr string) (*http.Request, error) {
+		return http.NewRequest(http.MethodDelete, "http://"+addr+"/delete?"+url.Values{"filename": {name}}.Encode(), nil)
+	})
+	if err != nil {
+		return err
+	}
+	if _, err = text("delete", resp); err == nil {
+		c.forget(name)
+	}
+	return err
+}
+
+// Rename moves a HyDFS file to a new name, its pending appends included. The new name must not exist yet.
+func (c *Client) Rename(name string, newname string) error {
+	_, resp, err := c.send(func(addr string) (*http.Request, error) {
+		return http.NewRequest(http.MethodPost, "http://"+addr+"/rename?"+url.Values{"filename": {name}, "newname": {newname}}.Encode(), nil)
+	})
+	if err != nil {
+		return err
+	}
+	if _, err = text("rename", resp); err == nil {
+		c.mu.Lock()
+		for _, numbers := range []map[string]uint64{c.written, c.last} {
+			if seq, exist := numbers[name]; exist {
+				numbers[newname] = seq
+				delete(numbers, name)
+			}
+		}
+		c.mu.Unlock()
+	}
+	return err
+}
+
+// Mkdir creates an empty directory. Directories are also implied by the names of the files in them.
+func (c *Client) Mkdir(dir string) error {
+	_, resp, err := c.send(func(addr string) (*http.Request, error) {
+		return http.NewRequest(http.MethodPost, "http://"+addr+"/mkdir?"+url.Values{"dirname": {dir}}.Encode(), nil)
+	})
+	if err != nil {
+		return err
+	}
+	_, err = text("mkdir", resp)
+	return err
+}
+
+// Find lists the names of the HyDFS files starting with a prefix, directories made by mkdir ending with "/"
+func (c *Client) Find(prefix string) ([]string, error) {
+	answer, err := c.getText("find", url.Values{"prefix": {prefix}})
+	if err != nil {
+		return nil, err
+	}
+	return strings.FieldsFunc(answer, func(r rune) bool { return r == '\n' }), nil
+}
+
+// FileInfo describes a HyDFS file in the answer of List
+type FileInfo struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`     // Bytes merged into the file, pending appends excluded
+	Created  time.Time `json:"created"`  // Time of the create
+	Merged   time.Time `json:"merged"`   // Time of the last merge applying appends, zero before the first one
+	Pending  int       `json:"pending"`  // Appends waiting for a merge
+	Replicas int       `json:"replicas"` // Servers storing the file, the primary included
+	Owners   []int     `json:"owners"`   // Ids of the servers storing the file, the primary first
+	RF       int       `json:"rf"`       // Replication factor of the file
+	Version  int       `json:"version"`  // Writes merged into the file, the create included
+}
+
+// List describes every HyDFS file whose name starts with prefix, once each. sortBy is one of name (the default),
+// size, created, merged, pending and replicas, a "-" before it reversing the order.
+func (c *Client) List(prefix string, sortBy string) ([]FileInfo, error) {
+	files, _, err := c.ListPartial(prefix, sortBy)
+	return files, err
+}
+
+// ListPartial lists like List, also returning the ids of the servers that failed to answer the coordinator. The
+// files and copies only they store are missing from the list, and the Replicas and Owners of the others may be short.
+func (c *Client) ListPartial(prefix string, sortBy string) ([]FileInfo, []int, error) {
+	_, resp, err := c.send(func(addr string) (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, "http://"+addr+"/list?"+url.Values{"prefix": {prefix}, "sort": {sortBy}}.Encode(), nil)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	answer, err := text("list", resp)
+	if err != nil {
+		return nil, nil, err
+	}
+	var files []FileInfo
+	if err := json.Unmarshal([]byte(answer), &files); err != nil {
+		return nil, nil, fmt.Errorf("hydfs: invalid list: %w", err)
+	}
+	var failed []int
+	for _, field := range strings.Split(resp.Header.Get(FAILED_HEADER), ",") {
+		if id, err := strconv.Atoi(field); err == nil {
+			failed = append(failed, id)
+		}
+	}
+	return files, failed, nil
+}
+
+// FileStat is the metadata record of a HyDFS file, as its primary keeps it
+type FileStat struct {
+	Name     string       `json:"name"`
+	Size     int64        `json:"size"`     // Bytes merged into the file, pending appends excluded
+	RF       int          `json:"rf"`       // Replication factor of the file
+	Version  int          `json:"version"`  // Writes merged into the file, the create included
+	Pending  int          `json:"pending"`  // Appends waiting for a merge
+	Replicas []int        `json:"replicas"` // Ids of the servers the file belongs to, the primary first
+	Creator  string       `json:"creator"`  // Host of the client that created the file
+	Created  time.Time    `json:"created"`
+	Modified time.Time    `json:"modified"` // Time of the last create or append
+	Merged   time.Time    `json:"merged"`   // Time of the last merge applying appends, zero before the first one
+	Appends  []AppendStat `json:"appends"`  // Last appends, oldest first
+	Versions []Version    `json:"versions"` // Versions that can be read, oldest first
+}
+
+// Version describes a version of a file that can be read
+type Version struct {
+	Version int       `json:"version"`
+	Time    time.Time `json:"time"` // Of the create or of the merge that made it
+	Size    int64     `json:"size"`
+}
+
+// AppendStat describes an append in the history of a file
+type AppendStat struct {
+	Time     time.Time `json:"time"`
+	Size     int64     `json:"size"`
+	Client   string    `json:"client"`    // Host of the client that appended
+	ClientID string    `json:"client_id"` // Id of the client, see Client.ID
+	Seq      uint64    `json:"seq"`       // Number of the append among those of its client
+}
+
+// Stat returns the metadata of a HyDFS file without fetching its content
+func (c *Client) Stat(name string) (*FileStat, error) {
+	answer, err := c.getText("stat", url.Values{"filename": {name}})
+	if err != nil {
+		return nil, err
+	}
+	var stat FileStat
+	if err := json.Unmarshal([]byte(answer), &stat); err != nil {
+		return nil, fmt.Errorf("hydfs: invalid stat: %w", err)
+	}
+	return &stat, nil
+}
+
+// Versions lists the versions of a HyDFS file that can be read, oldest first
+func (c *Client) Versions(name string) ([]Version, error) {
+	stat, err := c.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return stat.Versions, nil
+}
+
+// Ls lists the servers storing a HyDFS file, or the entries of a directory
+func (c *Client) Ls(name string) (string, error) {
+	return c.getText("ls", url.Values{"filename": {name}})
+}
+
+// Store lists the files stored on every live server
+func (c *Client) Store() (string, error) {
+	return c.getText("store", nil)
+}
+
+// Membership lists the ids of the servers the coordinator considers alive
+func (c *Client) Membership() (string, error) {
+	return c.getText("membership", nil)
+}
+
+// Online tells if the coordinator has joined the cluster and serves requests
+func (c *Client) Online() (bool, error) {
+	answer, err := c.getText("online", nil)
+	return answer == "Yes", err
+}
@@ -0,0 +1,50 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrExists   = errors.New("hydfs: file already exists")
+	ErrNotExist = errors.New("hydfs: file doesn't exist")
+	ErrNoServer = errors.New("hydfs: no live server available")
+	ErrChecksum = errors.New("hydfs: content doesn't match its checksum")
+	ErrRange    = errors.New("hydfs: range starts past the end of the file")
+	ErrVersion  = errors.New("hydfs: version isn't retained")
+	ErrStale    = errors.New("hydfs: no server merged the appends of the client yet")
+	ErrQuorum   = errors.New("hydfs: too few copies of the file acknowledged")
+)
+
+// ServerError is returned when a coordinator rejects a request
+type ServerError struct {
+	Op      string // Operation that failed, e.g. "create"
+	Status  int    // HTTP status code of the response
+	Code    string // Why the server rejected the request, from its Error-Code header, "" if it gave no reason
+	Message string // Response body sent by the server
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("hydfs: %s failed with status %d: %s", e.Op, e.Status, e.Message)
+}
+
+// Unwrap maps the error codes of the server to the sentinel errors, so callers can use errors.Is
+func (e *ServerError) Unwrap() error {
+	switch e.Code {
+	case "exists":
+		return ErrExists
+	case "not_exist":
+		return ErrNotExist
+	case "no_version":
+		return ErrVersion
+	case "stale":
+		return ErrStale
+	case "quorum":
+		return ErrQuorum
+	case "checksum":
+		return ErrChecksum
+	case "range":
+		return ErrRange
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"HyDFS/client"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientErrorsCarryTheCodeOfTheServer(t *testing.T) {
+	c := newTestCluster(t, 4)
+	cl := c.Client()
+	c.mustCreate(cl, "file.txt", "hello", 3)
+	c.mustCreate(cl, "other.txt", "other", 3)
+
+	for _, test := range []struct {
+		op       string
+		err      error
+		expected error
+	}{
+		{"create an existing file", cl.Create("file.txt", strings.NewReader("x"), 3), client.ErrExists},
+		{"rename onto an existing file", cl.Rename("file.txt", "other.txt"), client.ErrExists},
+		{"get a missing file", cl.Get("missing.txt", io.Discard), client.ErrNotExist},
+		{"append to a missing file", cl.Append("missing.txt", strings.NewReader("x")), client.ErrNotExist},
+		{"delete a missing file", cl.Delete("missing.txt"), client.ErrNotExist},
+		{"get a version never written", cl.GetVersion("file.txt", 99, io.Discard), client.ErrVersion},
+		{"get past the end", func() error { _, err := cl.GetRange("file.txt", 10, 1, io.Discard); return err }(), client.ErrRange},
+	} {
+		if !errors.Is(test.err, test.expected) {
+			t.Errorf("%s: %v, expected %v", test.op, test.err, test.expected)
+		}
+		var rejected *client.ServerError
+		if !errors.As(test.err, &rejected) || rejected.Code == "" {
+			t.Errorf("%s: %v carries no error code", test.op, test.err)
+		}
+	}
+}
+
+func TestClientFailsOverToALiveCoordinator(t *testing.T) {
+	c := newTestCluster(t, 4)
+	c.mustCreate(c.Client(), "file.txt", "hello", 4)
+	c.WaitReplicas(5 * time.Second)
+
+	// The client knows every server but the introducer, which the cluster can't lose
+	var servers []string
+	for id := 2; id <= 4; id++ {
+		servers = append(servers, c.nodes.HTTPAddr(id))
+	}
+	cl := client.New(servers)
+	coordinator, err := cl.Coordinator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id := 2; id <= 4; id++ {
+		if c.nodes.HTTPAddr(id) == coordinator {
+			c.Kill(id)
+		}
+	}
+	c.WaitMembership(10 * time.Second)
+	if got := c.mustGet(cl, "file.txt"); got != "hello" {
+		t.Errorf("get = %q through another coordinator", got)
+	}
+	if next, err := cl.Coordinator(); err != nil || next == coordinator {
+		t.Errorf("coordinator %s, %v after %s went down", next, err, coordinator)
+	}
+
+	// A client knowing no live server finds none
+	if err := client.New([]string{coordinator}).Get("file.txt", io.Discard); !errors.Is(err, client.ErrNoServer) {
+		t.Errorf("get without a live server: %v, expected ErrNoServer", err)
+	}
+}
+
+func TestClientStateKeepsTheSession(t *testing.T) {
+	c := newTestCluster(t, 4)
+	first := c.Client()
+	c.mustCreate(first, "file.txt", "a", 3)
+	for i := 0; i < 3; i++ {
+		if err := first.Append("file.txt", strings.NewReader(fmt.Sprint(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Another process going on from the state reads the appends before any merge, and numbers its own after them
+	second := c.Client()
+	second.Restore(first.State())
+	if second.ID() != first.ID() {
+		t.Errorf("client id %s after restoring the state of %s", second.ID(), first.ID())
+	}
+	if got := c.mustGet(second, "file.txt"); got != "a012" {
+		t.Errorf("get = %q through the restored client, expected its own appends", got)
+	}
+	if err := second.Append("file.txt", strings.NewReader("3")); err != nil {
+		t.Fatal(err)
+	}
+	if state := second.State(); state.Seq <= first.State().Seq {
+		t.Errorf("restored client numbered its append %d, not past %d", state.Seq, first.State().Seq)
+	}
+	if err := second.Merge("file.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.mustGet(c.Client(), "file.txt"); got != "a0123" {
+		t.Errorf("get = %q after the merge, expected the appends in order", got)
+	}
+}
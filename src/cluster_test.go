@@ -0,0 +1,515 @@
+package main
+
+import (
+	"HyDFS/client"
+	"HyDFS/failuredetector"
+	"HyDFS/registry"
+	"HyDFS/ring"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Test cluster: every node runs its failure detector, file server and HTTP server inside the
+// test process, on ephemeral localhost ports. Node 1 is the introducer of the failure detector.
+
+// Small blocks, so that files of a few MB span several of them
+const testBlockSize = 4 << 20
+
+func TestMain(m *testing.M) {
+	// The nodes log every ping and gossip, HYDFS_TEST_LOG names a file to keep them in
+	if path := os.Getenv("HYDFS_TEST_LOG"); path != "" {
+		f, err := os.Create(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.SetOutput(f)
+	} else {
+		log.SetOutput(io.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+type testNode struct {
+	ml       *failuredetector.MembershipList
+	detector *failuredetector.Detector
+	fs       *FileServer
+	server   *http.Server
+}
+
+type testCluster struct {
+	t           *testing.T
+	configFile  string
+	nodes       *registry.Registry
+	config      Config
+	mu          sync.Mutex
+	running     map[int]*testNode
+	partitioned map[int]bool
+	addrs       map[string]int                   // HTTP address to node id
+	pulls       map[int][]string                 // Files each node fetched from another one through /getting
+	drops       map[int]func(*http.Request) bool // Requests each node fails, see Drop
+	sockets     map[int]*sockets                 // Ports bound for the nodes that haven't started yet
+}
+
+// sockets holds the ports of a node, bound when the cluster is made so that nothing else can take them
+type sockets struct {
+	http net.Listener
+	udp  map[string]*net.UDPConn // By port
+}
+
+// newTestCluster starts n nodes with ids 1..n and waits until they all joined the file system
+func newTestCluster(t *testing.T, n int) *testCluster {
+	t.Helper()
+	return newTestClusterWith(t, n, nil)
+}
+
+// newTestClusterWith starts a cluster whose config file has the given settings on top of the test ones
+func newTestClusterWith(t *testing.T, n int, settings map[string]interface{}) *testCluster {
+	t.Helper()
+	dir := t.TempDir()
+
+	var nodes []registry.Node
+	bound := make(map[int]*sockets)
+	for id := 1; id <= n; id++ {
+		s := bindSockets(t)
+		bound[id] = s
+		node := registry.Node{ID: id, Host: "127.0.0.1", HTTPPort: port(s.http.Addr())}
+		for _, p := range []*string{&node.PingPort, &node.RepingPort, &node.GossipPort, &node.CmdPort} {
+			conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			*p = port(conn.LocalAddr())
+			s.udp[*p] = conn
+		}
+		nodes = append(nodes, node)
+	}
+	config := map[string]interface{}{
+		"N":                      n,
+		"FD_K":                   3,
+		"FD_G":                   4,
+		"FD_ping_timeout":        "500ms",
+		"FD_reping_timeout":      "1s",
+		"FD_gossip_duration":     "3s",
+		"FD_introducer_id":       1,
+		"FD_fd_period":           "100ms",
+		"vnodes":                 16,
+		"replication_factor":     3,
+		"max_replication_factor": 4,
+		"file_dir":               filepath.Join(dir, "files"),
+		"block_size":             testBlockSize,
+		"kept_versions":          3,
+		"nodes":                  nodes,
+	}
+	for key, value := range settings {
+		config[key] = value
+	}
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testCluster{
+		t:           t,
+		configFile:  filepath.Join(dir, "config.yaml"),
+		running:     make(map[int]*testNode),
+		partitioned: make(map[int]bool),
+		addrs:       make(map[string]int),
+		pulls:       make(map[int][]string),
+		drops:       make(map[int]func(*http.Request) bool),
+		sockets:     bound,
+	}
+	if err := os.WriteFile(c.configFile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if c.nodes, err = registry.Load(c.configFile); err != nil {
+		t.Fatal(err)
+	}
+	if c.config, err = LoadConfig(c.configFile); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range c.nodes.IDs() {
+		c.addrs[c.nodes.HTTPAddr(id)] = id
+	}
+	t.Cleanup(c.Close)
+
+	// Nodes join one at a time like the operators do: a node ignores the gossip about the others
+	// until it got the membership list from the introducer
+	for id := 1; id <= n; id++ {
+		c.Start(id)
+		c.WaitJoined(id, 5*time.Second)
+	}
+	c.WaitMembership(10 * time.Second)
+	c.waitFor("nodes to go online", 10*time.Second, func() error {
+		for id := range c.live() {
+			if online, _ := client.New([]string{c.nodes.HTTPAddr(id)}).Online(); !online {
+				return fmt.Errorf("node %d is offline", id)
+			}
+		}
+		return nil
+	})
+	return c
+}
+
+// bindSockets opens the HTTP port of a node on an ephemeral port, its UDP ports are added by the caller
+func bindSockets(t *testing.T) *sockets {
+	t.Helper()
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &sockets{http: l, udp: make(map[string]*net.UDPConn)}
+	t.Cleanup(func() {
+		s.http.Close()
+		for _, conn := range s.udp {
+			conn.Close()
+		}
+	})
+	return s
+}
+
+func port(addr net.Addr) string {
+	_, port, _ := net.SplitHostPort(addr.String())
+	return port
+}
+
+func (c *testCluster) node(id int) *testNode {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.running[id]
+}
+
+// live returns the running nodes that aren't partitioned
+func (c *testCluster) live() map[int]*testNode {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	live := make(map[int]*testNode)
+	for id, node := range c.running {
+		if !c.partitioned[id] {
+			live[id] = node
+		}
+	}
+	return live
+}
+
+// Start runs node id, which joins the cluster through the introducer
+func (c *testCluster) Start(id int) {
+	c.t.Helper()
+	// The first start uses the ports bound with the cluster, a restart binds them again
+	c.mu.Lock()
+	bound := c.sockets[id]
+	delete(c.sockets, id)
+	c.mu.Unlock()
+
+	node := &testNode{ml: failuredetector.NewMembershipList(c.nodes)}
+	node.detector = failuredetector.NewDetector(node.ml, id, c.configFile)
+	node.detector.Drop = func(message string) bool {
+		return c.dropped(id, message)
+	}
+	if bound != nil {
+		node.detector.Conns = bound.udp
+	}
+	if err := node.detector.Start(); err != nil {
+		c.t.Fatalf("Failed to start failure detector of node %d: %s", id, err)
+	}
+
+	node.fs = FileServerInit(node.ml, c.nodes, id, c.config)
+	node.fs.transport = &testTransport{c: c, from: id}
+	go Maintenance(node.fs)
+	go AntiEntropy(node.fs)
+	go Scrubber(node.fs)
+
+	// Like HTTPServer, the node only serves once it is online, requests fail until then
+	handler := node.fs.Handler()
+	node.server = &http.Server{Addr: c.nodes.HTTPAddr(id), Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !node.fs.online.Load() {
+			http.Error(w, "Offline", http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})}
+	go func() {
+		var err error
+		if bound != nil {
+			err = node.server.Serve(bound.http)
+		} else {
+			err = node.server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			c.t.Errorf("HTTP server of node %d: %s", id, err)
+		}
+	}()
+
+	c.mu.Lock()
+	c.running[id] = node
+	c.mu.Unlock()
+}
+
+// WaitJoined waits until node id got the membership list of the introducer
+func (c *testCluster) WaitJoined(id int, timeout time.Duration) {
+	c.t.Helper()
+	c.waitFor(fmt.Sprintf("node %d to join", id), timeout, func() error {
+		if len(c.node(id).ml.Alive_Ids()) == 0 {
+			return errors.New("no members yet")
+		}
+		return nil
+	})
+}
+
+// Kill stops node id as if it crashed, its files stay on disk
+func (c *testCluster) Kill(id int) {
+	c.mu.Lock()
+	node, exists := c.running[id]
+	delete(c.running, id)
+	delete(c.partitioned, id)
+	c.mu.Unlock()
+	if !exists {
+		return
+	}
+
+	node.detector.Stop()
+	node.fs.Stop()
+	node.server.Close()
+}
+
+// Restart kills node id and starts it again on the same ports and data directory.
+// The introducer (node 1) can't restart, the others wouldn't learn about its new membership list.
+func (c *testCluster) Restart(id int) {
+	c.t.Helper()
+	c.Kill(id)
+	c.Start(id)
+	c.WaitJoined(id, 5*time.Second)
+}
+
+// Partition cuts node id off the other nodes, both for the failure detector and for the file servers.
+// The nodes keep running, and those marked failed during the partition stay so until they restart.
+func (c *testCluster) Partition(id int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.partitioned[id] = true
+}
+
+// Heal ends the partition of node id
+func (c *testCluster) Heal(id int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.partitioned, id)
+}
+
+// Drop makes the requests of the file servers to path on node id fail, like a lost message, "" ending it
+func (c *testCluster) Drop(id int, path string) {
+	if path == "" {
+		c.DropWhere(id, nil)
+		return
+	}
+	c.DropWhere(id, func(req *http.Request) bool { return req.URL.Path == path })
+}
+
+// DropWhere makes the requests of the file servers to node id that match fail, nil ending it
+func (c *testCluster) DropWhere(id int, match func(*http.Request) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if match == nil {
+		delete(c.drops, id)
+		return
+	}
+	c.drops[id] = match
+}
+
+// Close kills every node
+func (c *testCluster) Close() {
+	for _, id := range c.nodes.IDs() {
+		c.Kill(id)
+	}
+}
+
+// dropped tells if a failure detector message received by node to crosses a partition
+func (c *testCluster) dropped(to int, message string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.partitioned[to] {
+		return true
+	}
+
+	// "PING from X", "REPING from X to Y" and "GOSSIP from X passed by Y ..." where Y sent the gossip
+	fields := strings.Fields(message)
+	sender := ""
+	if len(fields) >= 3 {
+		sender = fields[2]
+	}
+	if len(fields) >= 6 && fields[0] == "GOSSIP" {
+		sender = fields[5]
+	}
+	from, exists := c.nodes.IDOf(sender)
+	return exists && c.partitioned[from]
+}
+
+// testTransport fails the requests of a file server that cross a partition, or that Drop drops
+type testTransport struct {
+	c    *testCluster
+	from int
+}
+
+func (tt *testTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	tt.c.mu.Lock()
+	to, exists := tt.c.addrs[req.URL.Host]
+	cut := tt.c.partitioned[tt.from] || (exists && tt.c.partitioned[to])
+	lost := exists && tt.c.drops[to] != nil && tt.c.drops[to](req)
+	if !cut && req.URL.Path == "/getting" {
+		tt.c.pulls[tt.from] = append(tt.c.pulls[tt.from], req.URL.Query().Get("filename"))
+	}
+	tt.c.mu.Unlock()
+	if cut {
+		return nil, fmt.Errorf("node %d can't reach %s, partitioned", tt.from, req.URL.Host)
+	}
+	if lost {
+		return nil, fmt.Errorf("request of node %d to %s%s dropped", tt.from, req.URL.Host, req.URL.Path)
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// Client returns a HyDFS client for the live nodes, a client on the majority side of partitions
+func (c *testCluster) Client() *client.Client {
+	var servers []string
+	for id := range c.live() {
+		servers = append(servers, c.nodes.HTTPAddr(id))
+	}
+	return client.New(servers)
+}
+
+func (c *testCluster) waitFor(what string, timeout time.Duration, check func() error) {
+	c.t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		err := check()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			c.t.Fatalf("Timed out waiting for %s: %s", what, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// WaitMembership waits until every live node sees exactly the live nodes as alive
+func (c *testCluster) WaitMembership(timeout time.Duration) {
+	c.t.Helper()
+	c.waitFor("membership convergence", timeout, func() error {
+		live := c.live()
+		expected := make([]int, 0, len(live))
+		for id := range live {
+			expected = append(expected, id)
+		}
+		sort.Ints(expected)
+
+		for id, node := range live {
+			if alive := node.ml.Alive_Ids(); !equalSlices(alive, expected) {
+				return fmt.Errorf("node %d sees %v alive, expected %v", id, alive, expected)
+			}
+		}
+		return nil
+	})
+}
+
+// WaitReplicas waits until maintenance settled: every file is a primary on its owner, a replica on the
+// rest of its replica set, and stored nowhere else among the live nodes
+func (c *testCluster) WaitReplicas(timeout time.Duration) {
+	c.t.Helper()
+	c.waitFor("replicas to settle", timeout, func() error {
+		live := c.live()
+		ids := make([]int, 0, len(live))
+		for id := range live {
+			ids = append(ids, id)
+		}
+		r := ring.New(ids, c.config.VNodes)
+
+		primaries := make(map[string][]int)
+		replicas := make(map[string][]int)
+		rfs := make(map[string]int)
+		for id, node := range live {
+			node.fs.Mutex.Lock()
+			for name, f := range node.fs.p_files {
+				primaries[name] = append(primaries[name], id)
+				rfs[name] = f.rf
+			}
+			for name, f := range node.fs.r_files {
+				replicas[name] = append(replicas[name], id)
+				rfs[name] = f.rf
+			}
+			pending := len(node.fs.mv_p_to_r)
+			node.fs.Mutex.Unlock()
+			if pending > 0 {
+				return fmt.Errorf("node %d still has %d primaries to move", id, pending)
+			}
+		}
+
+		for name, rf := range rfs {
+			expected := fileReplicas(r, name, rf)
+			sort.Ints(replicas[name])
+			expectedReplicas := append([]int{}, expected[1:]...)
+			sort.Ints(expectedReplicas)
+			if !equalSlices(primaries[name], expected[:1]) || !equalSlices(replicas[name], expectedReplicas) {
+				return fmt.Errorf("file %s has primaries %v and replicas %v, expected %v", name, primaries[name], replicas[name], expected)
+			}
+		}
+		return nil
+	})
+}
+
+// holders returns the ids of the live nodes storing a file, the primary first
+func (c *testCluster) holders(name string) []int {
+	var holders []int
+	for id, node := range c.live() {
+		if fileExistsinPrimary(node.fs, name) {
+			holders = append([]int{id}, holders...)
+		} else if fileExistsinReplica(node.fs, name) {
+			holders = append(holders, id)
+		}
+	}
+	return holders
+}
+
+// Pulled returns the files node id fetched from other nodes so far
+func (c *testCluster) Pulled(id int) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string{}, c.pulls[id]...)
+}
+
+// content returns what node id stores for a file, its cached appends excluded
+func (c *testCluster) content(id int, name string) string {
+	c.t.Helper()
+	data, err := os.ReadFile(c.node(id).fs.file_dir + diskName(name))
+	if err != nil {
+		c.t.Fatalf("Node %d: %s", id, err)
+	}
+	return string(data)
+}
+
+func (c *testCluster) mustCreate(cl *client.Client, name string, content string, rf int) {
+	c.t.Helper()
+	if err := cl.Create(name, strings.NewReader(content), rf); err != nil {
+		c.t.Fatalf("Create %s: %s", name, err)
+	}
+}
+
+func (c *testCluster) mustGet(cl *client.Client, name string) string {
+	c.t.Helper()
+	var b strings.Builder
+	if err := cl.Get(name, &b); err != nil {
+		c.t.Fatalf("Get %s: %s", name, err)
+	}
+	return b.String()
+}
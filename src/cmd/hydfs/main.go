@@ -0,0 +1,512 @@
+package main
+
+import (
+	"HyDFS/client"
+	"HyDFS/registry"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Exit codes, so that shell scripts can tell failures apart
+const (
+	EXIT_OK        = 0
+	EXIT_FAILURE   = 1
+	EXIT_USAGE     = 2
+	EXIT_NOT_EXIST = 3
+	EXIT_EXISTS    = 4
+	EXIT_NO_SERVER = 5
+)
+
+const usage = `Usage: hydfs [--config file] [--server host:port] [--state file] [--quiet] [command [args...]]
+
+Without a command, commands are read one per line from the standard input.
+
+Commands:
+  create [--w W] [--r R] localfilename HyDFSfilename [rf]
+                                              "-" as localfilename reads standard input, W and R are the
+                                              quorums the file keeps for its writes and gets
+  get [--r R] HyDFSfilename localfilename [offset [length]]
+                                              "-" as localfilename writes standard output, offset and
+                                              length read a range of bytes, to the end by default
+  get --version N HyDFSfilename localfilename  fetches the file as it was at version N
+  get --as-of time HyDFSfilename localfilename
+                                              fetches the file as it was at an RFC 3339 time
+  append [--w W] localfilename HyDFSfilename  waits for W copies to log the append
+  multiappend localfilename... HyDFSfilename  appends every local file concurrently
+  merge HyDFSfilename
+  delete HyDFSfilename
+  rename HyDFSfilename newHyDFSfilename
+  ls HyDFSfilename                            a name ending with "/" lists a directory, "/" the root
+  mkdir HyDFSdirectory
+  find [prefix]                               lists the files whose names start with prefix
+  list [--json] [--sort key] [prefix]         describes every file once, sorted by name, size, created,
+                                              merged, pending or replicas, "-key" reversing the order
+  stat HyDFSfilename                          prints the metadata of a file and its last appends
+  versions HyDFSfilename                      lists the versions of a file that can be read
+  store
+  getfromreplica id HyDFSfilename localfilename
+  list_mem_ids id
+  online id
+`
+
+// errUsage marks a command called with the wrong arguments
+var errUsage = errors.New("invalid arguments")
+
+type cli struct {
+	nodes  *registry.Registry
+	client *client.Client
+	quiet  bool
+	state  string // File keeping the state of the client between runs, "" for none, see state.go
+}
+
+func main() {
+	configFile := flag.String("config", "../config.yaml", "config file listing the nodes of the cluster")
+	server := flag.String("server", "", "host:port of the coordinator to use, instead of any live node of the config")
+	quiet := flag.Bool("quiet", false, "don't print progress of transfers")
+	state := flag.String("state", defaultStateFile(), "file keeping the client id and the numbers of its appends between runs, \"\" for none")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	nodes, err := registry.Load(*configFile)
+	if err != nil && *server == "" {
+		fmt.Fprintln(os.Stderr, "Failed to load node registry:", err)
+		os.Exit(EXIT_USAGE)
+	}
+
+	c := &cli{nodes: nodes, quiet: *quiet, state: *state}
+	if *server != "" {
+		c.client = client.New([]string{*server})
+	} else {
+		c.client = client.NewFromRegistry(nodes)
+	}
+
+	if flag.NArg() > 0 {
+		os.Exit(c.exitCode(c.runSaved(flag.Args())))
+	}
+	os.Exit(c.repl(os.Stdin))
+}
+
+// repl runs the commands read from in, returning the exit code of the last one
+func (c *cli) repl(in io.Reader) int {
+	code := EXIT_OK
+	scanner := bufio.NewScanner(in)
+	fmt.Fprintln(os.Stderr, "Enter 'exit' to quit.")
+	for scanner.Scan() {
+		args := strings.Fields(scanner.Text())
+		if len(args) == 0 {
+			continue
+		}
+		if args[0] == "exit" {
+			break
+		}
+		code = c.exitCode(c.runSaved(args))
+	}
+	return code
+}
+
+// exitCode reports an error and maps it to the exit code of the process
+func (c *cli) exitCode(err error) int {
+	if err == nil {
+		return EXIT_OK
+	}
+	fmt.Fprintln(os.Stderr, err)
+	switch {
+	case errors.Is(err, errUsage):
+		fmt.Fprint(os.Stderr, usage)
+		return EXIT_USAGE
+	case errors.Is(err, client.ErrNotExist):
+		return EXIT_NOT_EXIST
+	case errors.Is(err, client.ErrExists):
+		return EXIT_EXISTS
+	case errors.Is(err, client.ErrNoServer):
+		return EXIT_NO_SERVER
+	}
+	return EXIT_FAILURE
+}
+
+func (c *cli) run(args []string) error {
+	cmd, args := args[0], args[1:]
+	q, args, err := quorumFlags(cmd, args)
+	if err != nil {
+		return err
+	}
+	switch {
+	case cmd == "create" && (len(args) == 2 || len(args) == 3):
+		rf := 0
+		if len(args) == 3 {
+			n, err := strconv.Atoi(args[2])
+			if err != nil {
+				return fmt.Errorf("replication factor %q: %w", args[2], errUsage)
+			}
+			rf = n
+		}
+		in, err := c.open(args[0])
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		acks, err := c.client.CreateQuorum(args[1], in, rf, q)
+		if err != nil {
+			return err
+		}
+		c.done(fmt.Sprintf("File %s created, %d copies acknowledged", args[1], acks))
+		return nil
+
+	case cmd == "get" && len(args) == 4 && strings.HasPrefix(args[0], "--") && q.R == 0:
+		return c.getVersion(args[0], args[1], args[2], args[3])
+
+	case cmd == "get" && len(args) == 2:
+		return c.get(args[1], func(w io.Writer) error {
+			_, err := c.client.GetQuorum(args[0], q.R, w)
+			return err
+		})
+
+	case cmd == "get" && (len(args) == 3 || len(args) == 4) && q.R == 0:
+		var bounds [2]int64
+		for i, arg := range args[2:] {
+			n, err := strconv.ParseInt(arg, 10, 64)
+			if err != nil || n < 0 {
+				return fmt.Errorf("byte range %q: %w", arg, errUsage)
+			}
+			bounds[i] = n
+		}
+		var size int64
+		err := c.get(args[1], func(w io.Writer) error {
+			var err error
+			size, err = c.client.GetRange(args[0], bounds[0], bounds[1], w)
+			return err
+		})
+		if err == nil {
+			c.done(fmt.Sprintf("File %s is %d bytes", args[0], size))
+		}
+		return err
+
+	case cmd == "getfromreplica" && len(args) == 3:
+		id, err := strconv.Atoi(args[0])
+		if err != nil {
+			return fmt.Errorf("server id %q: %w", args[0], errUsage)
+		}
+		return c.get(args[2], func(w io.Writer) error {
+			return c.client.GetFromReplica(id, args[1], w)
+		})
+
+	case cmd == "append" && len(args) == 2:
+		in, err := c.open(args[0])
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		acks, err := c.client.AppendQuorum(args[1], in, q.W)
+		if err != nil {
+			return err
+		}
+		c.done(fmt.Sprintf("Appended %s to %s, %d copies acknowledged", args[0], args[1], acks))
+		return nil
+
+	case cmd == "multiappend" && len(args) >= 2:
+		return c.multiappend(args[:len(args)-1], args[len(args)-1])
+
+	case cmd == "merge" && len(args) == 1:
+		if err := c.client.Merge(args[0]); err != nil {
+			return err
+		}
+		c.done("File " + args[0] + " merged")
+		return nil
+
+	case cmd == "delete" && len(args) == 1:
+		if err := c.client.Delete(args[0]); err != nil {
+			return err
+		}
+		c.done("File " + args[0] + " deleted")
+		return nil
+
+	case cmd == "rename" && len(args) == 2:
+		if err := c.client.Rename(args[0], args[1]); err != nil {
+			return err
+		}
+		c.done("File " + args[0] + " renamed to " + args[1])
+		return nil
+
+	case cmd == "ls" && len(args) == 1:
+		return c.print(c.client.Ls(args[0]))
+
+	case cmd == "list":
+		return c.list(args)
+
+	case cmd == "stat" && len(args) == 1:
+		return c.stat(args[0])
+
+	case cmd == "versions" && len(args) == 1:
+		return c.versions(args[0])
+
+	case cmd == "mkdir" && len(args) == 1:
+		if err := c.client.Mkdir(args[0]); err != nil {
+			return err
+		}
+		c.done("Directory " + args[0] + " created")
+		return nil
+
+	case cmd == "find" && len(args) <= 1:
+		names, err := c.client.Find(strings.Join(args, ""))
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			fmt.Println(name)
+		}
+		return nil
+
+	case cmd == "store" && len(args) == 0:
+		return c.print(c.client.Store())
+
+	case cmd == "list_mem_ids" && len(args) == 1:
+		node, err := c.node(args[0])
+		if err != nil {
+			return err
+		}
+		return c.print(node.Membership())
+
+	case cmd == "online" && len(args) == 1:
+		node, err := c.node(args[0])
+		if err != nil {
+			return err
+		}
+		online, err := node.Online()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Is server %s online? %t\n", args[0], online)
+		return nil
+	}
+	return fmt.Errorf("%s: %w", cmd, errUsage)
+}
+
+// quorumFlags takes the leading --w and --r options of create, append and get off their arguments
+func quorumFlags(cmd string, args []string) (client.Quorum, []string, error) {
+	var q client.Quorum
+	for len(args) >= 2 && ((args[0] == "--w" && (cmd == "create" || cmd == "append")) || (args[0] == "--r" && (cmd == "create" || cmd == "get"))) {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 1 {
+			return q, nil, fmt.Errorf("quorum %q: %w", args[1], errUsage)
+		}
+		if args[0] == "--w" {
+			q.W = n
+		} else {
+			q.R = n
+		}
+		args = args[2:]
+	}
+	return q, args, nil
+}
+
+// node returns a client talking to a single server of the registry
+func (c *cli) node(arg string) (*client.Client, error) {
+	id, err := strconv.Atoi(arg)
+	if err != nil {
+		return nil, fmt.Errorf("server id %q: %w", arg, errUsage)
+	}
+	if c.nodes == nil {
+		return nil, fmt.Errorf("server ids need the node registry of a config file")
+	}
+	if _, exists := c.nodes.Node(id); !exists {
+		return nil, fmt.Errorf("server %d is not in the node registry", id)
+	}
+	return client.New([]string{c.nodes.HTTPAddr(id)}), nil
+}
+
+// open opens a local file for upload, "-" being the standard input
+func (c *cli) open(name string) (io.ReadCloser, error) {
+	if name == "-" {
+		return io.NopCloser(c.progress(os.Stdin, "-", -1)), nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	size := int64(-1)
+	if info, err := f.Stat(); err == nil {
+		size = info.Size()
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{c.progress(f, name, size), f}, nil
+}
+
+// get downloads into a local file, "-" being the standard output. A failed download leaves no local file behind.
+func (c *cli) get(name string, download func(w io.Writer) error) error {
+	if name == "-" {
+		w := c.progressWriter(os.Stdout, "-")
+		defer finish(w)
+		return download(w)
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	w := c.progressWriter(f, name)
+	defer finish(w)
+	if err := download(w); err != nil {
+		f.Close()
+		os.Remove(name)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	c.done("File saved to " + name)
+	return nil
+}
+
+func (c *cli) multiappend(locals []string, hydfs string) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(locals))
+	for i, local := range locals {
+		wg.Add(1)
+		go func(i int, local string) {
+			defer wg.Done()
+			in, err := c.open(local)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer in.Close()
+			// Spread the appends over the replicas of the file, like concurrent clients would
+			errs[i] = c.client.AppendThrough(hydfs, in, i)
+		}(i, local)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("append of %s: %w", locals[i], err)
+		}
+	}
+	c.done(fmt.Sprintf("Appended %d files to %s", len(locals), hydfs))
+	return nil
+}
+
+func (c *cli) print(answer string, err error) error {
+	if err != nil {
+		return err
+	}
+	fmt.Println(answer)
+	return nil
+}
+
+// done reports a successful command on the standard error, leaving the standard output to file content
+func (c *cli) done(message string) {
+	if !c.quiet {
+		fmt.Fprintln(os.Stderr, message)
+	}
+}
+
+// list prints the files of the cluster as a table, or in JSON
+func (c *cli) list(args []string) error {
+	flags := flag.NewFlagSet("list", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	asJSON := flags.Bool("json", false, "")
+	sortBy := flags.String("sort", "name", "")
+	if err := flags.Parse(args); err != nil || flags.NArg() > 1 {
+		return fmt.Errorf("list: %w", errUsage)
+	}
+	files, failed, err := c.client.ListPartial(flags.Arg(0), *sortBy)
+	if err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		fmt.Fprintf(os.Stderr, "Servers %v didn't answer, their files may be missing\n", failed)
+	}
+	if *asJSON {
+		out := json.NewEncoder(os.Stdout)
+		out.SetIndent("", "  ")
+		return out.Encode(files)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSIZE\tCREATED\tMERGED\tPENDING\tREPLICAS\tOWNERS")
+	for _, f := range files {
+		merged := "-"
+		if !f.Merged.IsZero() {
+			merged = f.Merged.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%d\t%d\t%v\n", f.Name, f.Size, f.Created.Format(time.RFC3339), merged, f.Pending, f.Replicas, f.Owners)
+	}
+	return w.Flush()
+}
+
+// stat prints the metadata record of a file, then its last appends
+func (c *cli) stat(name string) error {
+	stat, err := c.client.Stat(name)
+	if err != nil {
+		return err
+	}
+	merged := "-"
+	if !stat.Merged.IsZero() {
+		merged = stat.Merged.Format(time.RFC3339Nano)
+	}
+	fmt.Printf("name:     %s\n", stat.Name)
+	fmt.Printf("size:     %d\n", stat.Size)
+	fmt.Printf("rf:       %d\n", stat.RF)
+	fmt.Printf("version:  %d\n", stat.Version)
+	fmt.Printf("pending:  %d\n", stat.Pending)
+	fmt.Printf("replicas: %v\n", stat.Replicas)
+	fmt.Printf("creator:  %s\n", stat.Creator)
+	fmt.Printf("created:  %s\n", stat.Created.Format(time.RFC3339Nano))
+	fmt.Printf("modified: %s\n", stat.Modified.Format(time.RFC3339Nano))
+	fmt.Printf("merged:   %s\n", merged)
+	for _, a := range stat.Appends {
+		fmt.Printf("append:   %s %d bytes from %s\n", a.Time.Format(time.RFC3339Nano), a.Size, a.Client)
+	}
+	return nil
+}
+
+// getVersion fetches a file as it was at a version, given by number or as of a time
+func (c *cli) getVersion(flag string, value string, name string, local string) error {
+	switch flag {
+	case "--version":
+		version, err := strconv.Atoi(value)
+		if err != nil || version < 1 {
+			return fmt.Errorf("version %q: %w", value, errUsage)
+		}
+		return c.get(local, func(w io.Writer) error {
+			return c.client.GetVersion(name, version, w)
+		})
+	case "--as-of":
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return fmt.Errorf("time %q: %w", value, errUsage)
+		}
+		return c.get(local, func(w io.Writer) error {
+			return c.client.GetAsOf(name, t, w)
+		})
+	}
+	return fmt.Errorf("get %s: %w", flag, errUsage)
+}
+
+// versions prints the versions of a file that can be read
+func (c *cli) versions(name string) error {
+	versions, err := c.client.Versions(name)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tTIME\tSIZE")
+	for _, v := range versions {
+		fmt.Fprintf(w, "%d\t%s\t%d\n", v.Version, v.Time.Format(time.RFC3339Nano), v.Size)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"HyDFS/client"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCoordinator answers gets and stats of the file "file.txt", recording the requests it gets
+type fakeCoordinator struct {
+	mu       sync.Mutex
+	requests []map[string]string
+}
+
+func (f *fakeCoordinator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	request := map[string]string{"op": strings.TrimPrefix(r.URL.Path, "/")}
+	json.NewDecoder(r.Body).Decode(&request)
+	for key, values := range r.URL.Query() {
+		request[key] = values[0]
+	}
+	f.mu.Lock()
+	f.requests = append(f.requests, request)
+	f.mu.Unlock()
+
+	switch r.URL.Path {
+	case "/":
+		fmt.Fprint(w, "HyDFS")
+	case "/get":
+		fmt.Fprint(w, "content")
+	case "/stat":
+		if r.URL.Query().Get("filename") != "file.txt" {
+			w.Header().Set(client.ERROR_HEADER, "not_exist")
+			http.Error(w, "Rejected, file doesn't exist", http.StatusBadRequest)
+			return
+		}
+		created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+		json.NewEncoder(w).Encode(client.FileStat{Name: "file.txt", Size: 7, RF: 3, Version: 2, Created: created,
+			Versions: []client.Version{{Version: 1, Time: created, Size: 3}, {Version: 2, Time: created.Add(time.Hour), Size: 7}}})
+	default:
+		w.Header().Set(client.ERROR_HEADER, "not_exist")
+		http.Error(w, "Rejected, file doesn't exist", http.StatusBadRequest)
+	}
+}
+
+// last returns the last request other than the probes for a coordinator
+func (f *fakeCoordinator) last() map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := len(f.requests) - 1; i >= 0; i-- {
+		if f.requests[i]["op"] != "" {
+			return f.requests[i]
+		}
+	}
+	return nil
+}
+
+// captureStdout runs f and returns what it wrote to the standard output
+func captureStdout(t *testing.T, f func() error) (string, error) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	out := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		out <- string(data)
+	}()
+	err = f()
+	w.Close()
+	return <-out, err
+}
+
+func TestCommandArguments(t *testing.T) {
+	fake := &fakeCoordinator{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	c := &cli{client: client.New([]string{strings.TrimPrefix(server.URL, "http://")}), quiet: true}
+
+	for _, test := range []struct {
+		args     string
+		usage    bool              // The arguments are rejected before any request
+		request  map[string]string // Fields of the request sent, when it is accepted
+		stdout   []string          // Lines expected in the output
+		exitCode int
+	}{
+		{args: "create onlyone", usage: true},
+		{args: "create a b three", usage: true},
+		{args: "create --w 0 a b", usage: true},
+		{args: "get --version abc file.txt -", usage: true},
+		{args: "get --version 0 file.txt -", usage: true},
+		{args: "get --as-of yesterday file.txt -", usage: true},
+		{args: "get --as-of 2024-01-02 file.txt -", usage: true},
+		{args: "get --since 3 file.txt -", usage: true},
+		{args: "get --w 2 file.txt -", usage: true},
+		{args: "get --r x file.txt -", usage: true},
+		{args: "get file.txt - -1", usage: true},
+		{args: "append --r 2 a file.txt", usage: true},
+		{args: "stat", usage: true},
+		{args: "stat a b", usage: true},
+		{args: "versions", usage: true},
+		{args: "list --bogus", usage: true},
+		{args: "online x", usage: true},
+		{args: "unknown", usage: true},
+		{args: "get --version 3 file.txt -", request: map[string]string{"op": "get", "hydfs": "file.txt", "version": "3"}, stdout: []string{"content"}},
+		{args: "get --as-of 2024-01-02T03:04:05Z file.txt -", request: map[string]string{"op": "get", "hydfs": "file.txt", "as_of": "2024-01-02T03:04:05Z"}},
+		{args: "get --r 2 file.txt -", request: map[string]string{"op": "get", "hydfs": "file.txt", "r": "2"}},
+		{args: "stat file.txt", request: map[string]string{"op": "stat", "filename": "file.txt"}, stdout: []string{"name:     file.txt", "version:  2", "rf:       3"}},
+		{args: "versions file.txt", request: map[string]string{"op": "stat", "filename": "file.txt"}, stdout: []string{"VERSION  TIME", "1        2024-01-02T03:04:05Z  3", "2        2024-01-02T04:04:05Z  7"}},
+		{args: "stat other.txt", request: map[string]string{"op": "stat", "filename": "other.txt"}, exitCode: EXIT_NOT_EXIST},
+	} {
+		before := fake.last()
+		out, err := captureStdout(t, func() error { return c.run(strings.Fields(test.args)) })
+		if test.usage {
+			if !errors.Is(err, errUsage) || fmt.Sprint(fake.last()) != fmt.Sprint(before) {
+				t.Errorf("%s returned %v, expected a usage error before any request", test.args, err)
+			}
+			continue
+		}
+		if code := exitCodeOf(err); code != test.exitCode {
+			t.Errorf("%s returned %v, exit code %d instead of %d", test.args, err, code, test.exitCode)
+		}
+		sent := fake.last()
+		for key, value := range test.request {
+			if sent[key] != value {
+				t.Errorf("%s sent %s = %q, expected %q", test.args, key, sent[key], value)
+			}
+		}
+		for _, line := range test.stdout {
+			if !strings.Contains(out, line) {
+				t.Errorf("%s printed %q, expected %q in it", test.args, out, line)
+			}
+		}
+	}
+}
+
+// exitCodeOf maps an error like exitCode, without printing it
+func exitCodeOf(err error) int {
+	stderr := os.Stderr
+	os.Stderr, _ = os.Open(os.DevNull)
+	defer func() { os.Stderr = stderr }()
+	return (&cli{}).exitCode(err)
+}
+
+func TestQuorumFlags(t *testing.T) {
+	for _, test := range []struct {
+		cmd  string
+		args string
+		q    client.Quorum
+		rest string
+		err  bool
+	}{
+		{cmd: "create", args: "--w 2 --r 3 a b", q: client.Quorum{W: 2, R: 3}, rest: "a b"},
+		{cmd: "create", args: "a b 3", rest: "a b 3"},
+		{cmd: "append", args: "--w 1 a b", q: client.Quorum{W: 1}, rest: "a b"},
+		{cmd: "append", args: "--r 1 a b", rest: "--r 1 a b"},
+		{cmd: "get", args: "--r 2 f l", q: client.Quorum{R: 2}, rest: "f l"},
+		{cmd: "get", args: "--w 2 f l", rest: "--w 2 f l"},
+		{cmd: "get", args: "--r -1 f l", err: true},
+		{cmd: "create", args: "--w two a b", err: true},
+	} {
+		q, rest, err := quorumFlags(test.cmd, strings.Fields(test.args))
+		if test.err {
+			if !errors.Is(err, errUsage) {
+				t.Errorf("%s %s returned %v, expected a usage error", test.cmd, test.args, err)
+			}
+			continue
+		}
+		if err != nil || q != test.q || strings.Join(rest, " ") != test.rest {
+			t.Errorf("%s %s = %+v, %q, %v, expected %+v, %q", test.cmd, test.args, q, rest, err, test.q, test.rest)
+		}
+	}
+}
+
+func TestStateKeepsTheClientBetweenRuns(t *testing.T) {
+	fake := &fakeCoordinator{}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	state := filepath.Join(t.TempDir(), "hydfs", "client.json")
+	newCli := func() *cli {
+		return &cli{client: client.New([]string{strings.TrimPrefix(server.URL, "http://")}), quiet: true, state: state}
+	}
+
+	first := newCli()
+	if _, err := captureStdout(t, func() error { return first.runSaved([]string{"delete", "file.txt"}) }); err == nil {
+		t.Fatal("delete of a file the coordinator doesn't have succeeded")
+	}
+	if _, err := os.Stat(state); err != nil {
+		t.Fatalf("state not saved: %v", err)
+	}
+
+	second := newCli()
+	if second.client.ID() == first.client.ID() {
+		t.Fatal("two clients drew the same id")
+	}
+	if _, err := captureStdout(t, func() error { return second.runSaved([]string{"get", "file.txt", "-"}) }); err != nil {
+		t.Fatal(err)
+	}
+	if second.client.ID() != first.client.ID() {
+		t.Errorf("client id = %s after restoring the state, expected %s", second.client.ID(), first.client.ID())
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	PROGRESS_MIN_SIZE = 1 << 20 // Transfers smaller than this are not reported
+	PROGRESS_PERIOD   = 500 * time.Millisecond
+)
+
+// meter counts the bytes of a transfer and prints its progress on the standard error
+type meter struct {
+	name    string
+	total   int64 // -1 if unknown
+	done    int64
+	last    time.Time
+	printed bool
+}
+
+func (m *meter) add(n int) {
+	m.done += int64(n)
+	if m.done < PROGRESS_MIN_SIZE || time.Since(m.last) < PROGRESS_PERIOD {
+		return
+	}
+	m.last = time.Now()
+	m.printed = true
+	if m.total > 0 {
+		fmt.Fprintf(os.Stderr, "\r%s: %d/%d MB (%d%%)", m.name, m.done>>20, m.total>>20, m.done*100/m.total)
+	} else {
+		fmt.Fprintf(os.Stderr, "\r%s: %d MB", m.name, m.done>>20)
+	}
+}
+
+// finish ends the progress line once the transfer is over
+func (m *meter) finish() {
+	if m.printed {
+		fmt.Fprintf(os.Stderr, "\r%s: %d MB\n", m.name, m.done>>20)
+		m.printed = false
+	}
+}
+
+type progressReader struct {
+	r io.Reader
+	m *meter
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.m.add(n)
+	if err == io.EOF {
+		p.m.finish()
+	}
+	return n, err
+}
+
+type progressWriter struct {
+	w io.Writer
+	m *meter
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.m.add(n)
+	return n, err
+}
+
+// progress reports how much of r has been read, size being -1 if unknown
+func (c *cli) progress(r io.Reader, name string, size int64) io.Reader {
+	if c.quiet {
+		return r
+	}
+	return &progressReader{r: r, m: &meter{name: name, total: size, last: time.Now()}}
+}
+
+// progressWriter reports how much has been written to w
+func (c *cli) progressWriter(w io.Writer, name string) io.Writer {
+	if c.quiet {
+		return w
+	}
+	return &progressWriter{w: w, m: &meter{name: name, total: -1, last: time.Now()}}
+}
+
+// finish ends the progress line of a writer returned by progressWriter
+func finish(w io.Writer) {
+	if p, ok := w.(*progressWriter); ok {
+		p.m.finish()
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"HyDFS/client"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// The tool keeps the id of its client and the numbers of its appends in a state file, so that every run is the same
+// client: the appends of successive runs are merged in order, and gets read the appends of earlier runs. Commands
+// that change the state keep the file locked while they run, so that runs appending at the same time never number
+// two appends alike.
+
+// Commands that number appends or forget them
+var stateful = map[string]bool{"create": true, "append": true, "multiappend": true, "delete": true, "rename": true}
+
+// defaultStateFile is the state file in the user config directory, "" if there is none
+func defaultStateFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "hydfs", "client.json")
+}
+
+// runSaved runs a command with the client restored from the state file, saving it afterwards if the command changed it
+func (c *cli) runSaved(args []string) error {
+	if c.state == "" {
+		return c.run(args)
+	}
+	unlock, err := c.lockState()
+	if err != nil {
+		return err
+	}
+	if !stateful[args[0]] {
+		unlock()
+		return c.run(args)
+	}
+	defer unlock()
+	err = c.run(args)
+	if saveErr := c.saveState(); err == nil {
+		err = saveErr
+	}
+	return err
+}
+
+// lockState locks the state file and restores the client from it, the returned function unlocks it
+func (c *cli) lockState() (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(c.state), 0755); err != nil {
+		return nil, err
+	}
+	lock, err := os.OpenFile(c.state+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	unlock := func() {
+		syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+		lock.Close()
+	}
+
+	data, err := os.ReadFile(c.state)
+	if os.IsNotExist(err) {
+		// The first run keeps the random id of its client
+		return unlock, nil
+	}
+	var state client.State
+	if err == nil {
+		err = json.Unmarshal(data, &state)
+	}
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	c.client.Restore(state)
+	return unlock, nil
+}
+
+// saveState writes the state of the client, replacing the state file at once
+func (c *cli) saveState() error {
+	data, err := json.Marshal(c.client.State())
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(c.state+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(c.state+".tmp", c.state)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	DEFAULT_VNODES        = 16
+	DEFAULT_RF            = 4 // A primary and three replicas
+	DEFAULT_MAX_RF        = 5
+	DEFAULT_BLOCK         = 64 << 20 // 64 MB
+	DEFAULT_TOMBSTONE_TTL = 24 * time.Hour
+	DEFAULT_KEPT_VERSIONS = 10
+	DEFAULT_QUORUM        = 1 // The copy the write goes to, the primary for a read
+	DEFAULT_ANTI_ENTROPY  = 30 * time.Second
+	DEFAULT_SCRUB         = 24 * time.Hour
+
+	BROADCAST_MODE = "broadcast" // The server logging an append forwards it to every other copy
+	CHAIN_MODE     = "chain"     // Appends go down the replicas from the primary, see chain.go
+)
+
+// Config holds the file server settings of the config file
+type Config struct {
+	VNodes       int           `yaml:"vnodes"`                 // Virtual nodes each server places on the ring
+	DefaultRF    int           `yaml:"replication_factor"`     // Copies of a file kept when create doesn't ask for a number
+	MaxRF        int           `yaml:"max_replication_factor"` // Largest replication factor a create may ask for
+	FileDir      string        `yaml:"file_dir"`               // Directory holding the files of every node, in a subdirectory per id
+	BlockSize    int64         `yaml:"block_size"`             // Bytes in each block of a file, the last one excepted
+	TombstoneTTL time.Duration `yaml:"tombstone_ttl"`          // How long servers remember a deleted file
+	KeptVersions int           `yaml:"kept_versions"`          // Versions of a file that can be read, the current one included
+	VersionTTL   time.Duration `yaml:"version_ttl"`            // Age past which earlier versions can't be read, 0 for none
+	WriteQuorum  int           `yaml:"write_quorum"`           // Copies acknowledging a create or an append, by default
+	ReadQuorum   int           `yaml:"read_quorum"`            // Copies a get reads, by default
+	Replication  string        `yaml:"replication_mode"`       // How appends reach the copies of a file, broadcast or chain
+	AntiEntropy  time.Duration `yaml:"anti_entropy_period"`    // How often servers compare their copies of files, see antientropy.go
+	Scrub        time.Duration `yaml:"scrub_period"`           // How long servers take to read every stored file once, see Scrubber
+}
+
+// LoadConfig reads the file server settings, filling in defaults for the missing ones
+func LoadConfig(filename string) (Config, error) {
+	var config Config
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return config, err
+	}
+	defer file.Close()
+
+	if err := yaml.NewDecoder(file).Decode(&config); err != nil {
+		return config, fmt.Errorf("failed to parse %s: %v", filename, err)
+	}
+
+	if config.FileDir == "" {
+		config.FileDir = FILE_PATH_PREFIX
+	}
+	if !strings.HasSuffix(config.FileDir, "/") {
+		config.FileDir += "/"
+	}
+	if config.VNodes == 0 {
+		config.VNodes = DEFAULT_VNODES
+	}
+	if config.DefaultRF == 0 {
+		config.DefaultRF = DEFAULT_RF
+	}
+	if config.MaxRF == 0 {
+		config.MaxRF = DEFAULT_MAX_RF
+	}
+	if config.BlockSize == 0 {
+		config.BlockSize = DEFAULT_BLOCK
+	}
+	if config.TombstoneTTL == 0 {
+		config.TombstoneTTL = DEFAULT_TOMBSTONE_TTL
+	}
+	if config.KeptVersions == 0 {
+		config.KeptVersions = DEFAULT_KEPT_VERSIONS
+	}
+	if config.WriteQuorum == 0 {
+		config.WriteQuorum = DEFAULT_QUORUM
+	}
+	if config.ReadQuorum == 0 {
+		config.ReadQuorum = DEFAULT_QUORUM
+	}
+	if config.AntiEntropy == 0 {
+		config.AntiEntropy = DEFAULT_ANTI_ENTROPY
+	}
+	if config.Scrub == 0 {
+		config.Scrub = DEFAULT_SCRUB
+	}
+	if config.Replication == "" {
+		config.Replication = BROADCAST_MODE
+	}
+	if config.BlockSize < 0 {
+		return config, fmt.Errorf("block_size must be positive in %s", filename)
+	}
+	if config.AntiEntropy < 0 || config.Scrub < 0 {
+		return config, fmt.Errorf("anti_entropy_period and scrub_period must be positive in %s", filename)
+	}
+	if config.KeptVersions < 0 || config.VersionTTL < 0 {
+		return config, fmt.Errorf("kept_versions and version_ttl must be positive in %s", filename)
+	}
+	if config.WriteQuorum < 0 || config.ReadQuorum < 0 {
+		return config, fmt.Errorf("write_quorum and read_quorum must be positive in %s", filename)
+	}
+	if config.Replication != BROADCAST_MODE && config.Replication != CHAIN_MODE {
+		return config, fmt.Errorf("replication_mode must be %s or %s in %s", BROADCAST_MODE, CHAIN_MODE, filename)
+	}
+	if config.VNodes < 0 {
+		return config, fmt.Errorf("vnodes must be positive in %s", filename)
+	}
+	if config.DefaultRF < 1 || config.DefaultRF > config.MaxRF {
+		return config, fmt.Errorf("replication_factor must be between 1 and max_replication_factor in %s", filename)
+	}
+	return config, nil
+}
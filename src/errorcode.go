@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// A rejected request tells why in the Error-Code header, one of the codes below, so that clients don't have to parse
+// the message of the response, which is meant for people. Responses of other failures carry no code.
+
+const ERROR_HEADER = "Error-Code"
+
+const (
+	CODE_EXISTS     = "exists"     // The file already exists
+	CODE_NOT_EXIST  = "not_exist"  // The file doesn't exist, or was deleted
+	CODE_NO_VERSION = "no_version" // The version asked for isn't retained
+	CODE_STALE      = "stale"      // No copy merged the appends of the client yet
+	CODE_QUORUM     = "quorum"     // Too few copies acknowledged the write or answered the get
+	CODE_CHECKSUM   = "checksum"   // The content doesn't match its checksum
+	CODE_RANGE      = "range"      // The range starts past the end of the file
+)
+
+// Code of the reason an error gives for rejecting a request, "" if it has none
+func errorCode(err error) string {
+	switch {
+	case errors.Is(err, errExists):
+		return CODE_EXISTS
+	case errors.Is(err, errNotStored), errors.Is(err, errDeleted):
+		return CODE_NOT_EXIST
+	case errors.Is(err, errNoVersion):
+		return CODE_NO_VERSION
+	case errors.Is(err, errNotApplied):
+		return CODE_STALE
+	case errors.Is(err, errQuorum):
+		return CODE_QUORUM
+	case errors.Is(err, errChecksum):
+		return CODE_CHECKSUM
+	}
+	return ""
+}
+
+// Like http.Error, with the code of the reason in the Error-Code header
+func httpError(w http.ResponseWriter, code string, message string, status int) {
+	if code != "" {
+		w.Header().Set(ERROR_HEADER, code)
+	}
+	http.Error(w, message, status)
+}
@@ -3,6 +3,7 @@ package failuredetector
 import (
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"strings"
 	"time"
@@ -10,22 +11,21 @@ import (
 	"gopkg.in/yaml.v2"
 )
 
-var (
+// Config holds the failure detection settings of a node. Every detector keeps its own, so that several nodes can run in
+// one process.
+type Config struct {
 	N              int
-	K              int
+	K              int // Members asked to ping a member that doesn't answer
 	Timeout        time.Duration
 	RepingTimeout  time.Duration
-	PingPort       string
-	RepingPort     string
-	GossipPort     string
-	CmdPort        string
-	G              int
+	G              int // Members a gossip is passed on to
 	GossipDuration time.Duration
+	IntroducerID   int
 	IntroducerAddr string
 	FD_period      time.Duration
-)
+}
 
-func loadConfig(filename string) {
+func loadConfig(filename string) Config {
 	file, err := os.Open(filename)
 	if err != nil {
 		log.Fatalf("Failed to open config file: %s", err)
@@ -38,67 +38,121 @@ func loadConfig(filename string) {
 		log.Fatalf("Failed to parse config file: %s", err)
 	}
 
-	N = config["N"].(int)
-	K = config["FD_K"].(int)
-	Timeout, _ = time.ParseDuration(config["FD_ping_timeout"].(string))
-	RepingTimeout, _ = time.ParseDuration(config["FD_reping_timeout"].(string))
-	PingPort = config["FD_ping_port"].(string)
-	RepingPort = config["FD_reping_port"].(string)
-	GossipPort = config["FD_gossip_port"].(string)
-	CmdPort = config["FD_cmd_port"].(string)
-	G = config["FD_G"].(int)
-	GossipDuration, _ = time.ParseDuration(config["FD_gossip_duration"].(string))
-	IntroducerAddr = config["FD_introducer_addr"].(string)
-	FD_period, _ = time.ParseDuration(config["FD_fd_period"].(string))
+	var c Config
+	c.N = config["N"].(int)
+	c.K = config["FD_K"].(int)
+	c.Timeout, _ = time.ParseDuration(config["FD_ping_timeout"].(string))
+	c.RepingTimeout, _ = time.ParseDuration(config["FD_reping_timeout"].(string))
+	c.G = config["FD_G"].(int)
+	c.GossipDuration, _ = time.ParseDuration(config["FD_gossip_duration"].(string))
+	c.IntroducerID = config["FD_introducer_id"].(int)
+	c.FD_period, _ = time.ParseDuration(config["FD_fd_period"].(string))
+	return c
 }
 
-func Failuredetect(ml *MembershipList, vmNumber int) {
-	loadConfig("../config.yaml")
-	// Construct the domain name based on the VM number
-	domain := "fa24-cs425-68" + fmt.Sprintf("%02d", vmNumber) + ".cs.illinois.edu"
-
-	// Failure detection go routains
-	go startListenPing(domain, ml)
-	go startListenPingRequest(domain, ml)
-	go startListenGossiping(domain, ml)
-	go startListenCmd(domain, ml)
-	go startFailureDetect(ml, domain)
+// Detector is the failure detector of a single node
+type Detector struct {
+	ml         *MembershipList
+	vmNumber   int
+	configFile string
+	config     Config
+	receivers  []*Receiver
+	stop       chan struct{}
+	Drop       func(message string) bool // Incoming messages it returns true for are ignored, nil keeps them all
+	Conns      map[string]*net.UDPConn   // Sockets already bound to some ports of the node, Start binds the others
+}
 
-	// Wait 0.5s before introducer requests to join itself
-	time.Sleep(500 * time.Millisecond)
+func NewDetector(ml *MembershipList, vmNumber int, configFile string) *Detector {
+	return &Detector{
+		ml:         ml,
+		vmNumber:   vmNumber,
+		configFile: configFile,
+		stop:       make(chan struct{}),
+	}
+}
 
-	// Sent join request automatically
-	joinFD(ml, domain)
+func Failuredetect(ml *MembershipList, vmNumber int, configFile string) {
+	d := NewDetector(ml, vmNumber, configFile)
+	if err := d.Start(); err != nil {
+		log.Fatal(err)
+	}
 
 	for {
 		time.Sleep(1 * time.Second)
 	}
 }
 
-func startListenPing(myDomain string, ml *MembershipList) {
-	r := NewReceiver(myDomain, PingPort)
-	go r.Listen(ml)
-}
+// Start binds the ports of the node, starts failure detection and joins the network
+func (d *Detector) Start() error {
+	d.config = loadConfig(d.configFile)
+	ml := d.ml
+	// Look up this node's address and ports in the registry
+	me, exists := ml.nodes.Node(d.vmNumber)
+	if !exists {
+		return fmt.Errorf("Node %d is not listed in %s", d.vmNumber, d.configFile)
+	}
+	introducer, exists := ml.nodes.Node(d.config.IntroducerID)
+	if !exists {
+		return fmt.Errorf("Introducer %d is not listed in %s", d.config.IntroducerID, d.configFile)
+	}
+	d.config.IntroducerAddr = introducer.Domain()
+	domain := me.Domain()
+
+	// Failure detection go routains: ping, reping, gossip and cmd receivers
+	for _, port := range []string{me.PingPort, me.RepingPort, me.GossipPort, me.CmdPort} {
+		r := NewReceiver(domain, port, d.config)
+		r.Drop = d.Drop
+		r.conn = d.Conns[port]
+		if r.conn == nil {
+			if err := r.Bind(); err != nil {
+				d.Stop()
+				return err
+			}
+		}
+		d.receivers = append(d.receivers, r)
+		go r.Listen(ml)
+	}
+	go d.startFailureDetect(domain)
+
+	go func() {
+		// Wait 0.5s before introducer requests to join itself
+		time.Sleep(500 * time.Millisecond)
+		if d.stopped() {
+			return
+		}
 
-func startListenPingRequest(myDomain string, ml *MembershipList) {
-	r := NewReceiver(myDomain, RepingPort)
-	go r.Listen(ml)
+		// Sent join request automatically
+		d.join(domain)
+	}()
+	return nil
 }
 
-func startListenGossiping(myDomain string, ml *MembershipList) {
-	r := NewReceiver(myDomain, GossipPort)
-	go r.Listen(ml)
+// Stop closes the ports of the node and ends failure detection, the node then looks failed to the others
+func (d *Detector) Stop() {
+	if d.stopped() {
+		return
+	}
+	close(d.stop)
+	for _, r := range d.receivers {
+		r.Close()
+	}
 }
 
-func startListenCmd(myDomain string, ml *MembershipList) {
-	r := NewReceiver(myDomain, CmdPort)
-	go r.Listen(ml)
+func (d *Detector) stopped() bool {
+	select {
+	case <-d.stop:
+		return true
+	default:
+		return false
+	}
 }
 
-func startFailureDetect(ml *MembershipList, myDomain string) {
-	for {
-		if len(ml.Members) == 0 { // Haven't join the network yet
-			time.Sleep(FD_period)
+func (d *Detector) startFailureDetect(myDomain string) {
+	ml := d.ml
+	config := d.config
+	for !d.stopped() {
+		if ml.Len() == 0 { // Haven't join the network yet
+			time.Sleep(config.FD_period)
 			continue
 		}
 
@@ -106,26 +160,28 @@ func startFailureDetect(ml *MembershipList, myDomain string) {
 		member := ml.RandomMember(myDomain)
 		if member == nil {
 			log.Println("No members available to ping.")
-			time.Sleep(FD_period)
+			time.Sleep(config.FD_period)
 			continue
 		}
 
 		log.Printf("Pinging %s...\n", member.IP)
 
 		// Create a sender for the selected member
-		s := NewSender(member.IP, PingPort, myDomain)
-		err := s.Ping(Timeout)
+		target := ml.Lookup(member.IP)
+		s := NewSender(target.Host, target.PingPort, myDomain)
+		err := s.Ping(config.Timeout)
 		if err != nil {
 			log.Printf("Ping to %s failed: %s\n", member.IP, err)
-			kMembers := ml.GetRandomMembers(K, []string{myDomain, member.IP})
+			kMembers := ml.GetRandomMembers(config.K, []string{myDomain, member.IP})
 			ackReceived := false
 
 			log.Println("Checking live status of " + member.IP + " with")
 
 			for i, kMember := range kMembers {
 				log.Println(i, kMember.IP)
-				kSender := NewSender(kMember.IP, RepingPort, myDomain)
-				if err := kSender.Reping(RepingTimeout, member.IP); err == nil {
+				kNode := ml.Lookup(kMember.IP)
+				kSender := NewSender(kNode.Host, kNode.RepingPort, myDomain)
+				if err := kSender.Reping(config.RepingTimeout, member.IP); err == nil {
 					ackReceived = true
 					break
 				}
@@ -138,12 +194,13 @@ func startFailureDetect(ml *MembershipList, myDomain string) {
 
 				ml.UpdateMember(member.IP, updatedState, time.Now(), ml.GetIncNumber(member.IP))
 
-				gMembers := ml.GetRandomMembers(G, []string{myDomain, member.IP})
+				gMembers := ml.GetRandomMembers(config.G, []string{myDomain, member.IP})
 				log.Printf("Gossiping failure/suspect of %s with: \n", member.IP)
 				log.Printf("Failure detection/suspicion of %s at %s\n", member.IP, time.Now())
 				for i, gMember := range gMembers {
 					log.Println(i, gMember.IP)
-					gSender := NewSender(gMember.IP, GossipPort, myDomain)
+					gNode := ml.Lookup(gMember.IP)
+					gSender := NewSender(gNode.Host, gNode.GossipPort, myDomain)
 					if err := gSender.Gossip(time.Now(), member.IP, gossipCmd, myDomain, ml.GetIncNumber(member.IP)); err != nil {
 						log.Printf("Failed to send gossip to %s.\n", gMember.IP)
 					}
@@ -151,12 +208,14 @@ func startFailureDetect(ml *MembershipList, myDomain string) {
 			}
 		}
 
-		time.Sleep(FD_period) // Wait before the next ping
+		time.Sleep(config.FD_period) // Wait before the next ping
 	}
 }
 
-func joinFD(ml *MembershipList, domain string) {
-	s := NewSender(IntroducerAddr, GossipPort, domain)
+func (d *Detector) join(domain string) {
+	ml := d.ml
+	introducer := ml.Lookup(d.config.IntroducerAddr)
+	s := NewSender(introducer.Host, introducer.GossipPort, domain)
 	err := s.Ping(10 * time.Second)
 	if err != nil {
 		fmt.Println("Failed to join, introducer offline")
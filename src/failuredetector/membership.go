@@ -1,6 +1,7 @@
 package failuredetector
 
 import (
+	"HyDFS/registry"
 	"fmt"
 	"log"
 	"math/rand"
@@ -28,17 +29,30 @@ type Member struct {
 
 // MembershipList stores the status of all members and a mutex for synchronization
 type MembershipList struct {
-	Members map[string]Member // map[domain]Member
-	mu      sync.Mutex        // mutex to protect Members map
+	Members map[string]Member  // map[domain]Member
+	mu      sync.Mutex         // mutex to protect Members map
+	nodes   *registry.Registry // addresses of every node that may join, never modified
 }
 
 // NewMembershipList creates a new membership list
-func NewMembershipList() *MembershipList {
+func NewMembershipList(nodes *registry.Registry) *MembershipList {
 	return &MembershipList{
 		Members: make(map[string]Member),
+		nodes:   nodes,
 	}
 }
 
+// Lookup returns the registry entry of a member, or the zero Node if the domain isn't registered
+func (ml *MembershipList) Lookup(domain string) registry.Node {
+	id, exists := ml.nodes.IDOf(domain)
+	if !exists {
+		log.Printf("Domain %s is not in the node registry\n", domain)
+		return registry.Node{}
+	}
+	n, _ := ml.nodes.Node(id)
+	return n
+}
+
 // UpdateMember updates the state of an existing member or replaces it if the IP is already in use
 func (ml *MembershipList) UpdateMember(domain string, state string, timeStamp time.Time, inc int) {
 	ml.mu.Lock()         // Acquire the lock before modifying the map
@@ -88,6 +102,13 @@ func (ml *MembershipList) AddMember(domain string, state string, inc int) {
 	ml.Members[domain] = member
 }
 
+// Len returns the number of members, failed ones included, 0 until the node joined the network
+func (ml *MembershipList) Len() int {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+	return len(ml.Members)
+}
+
 // GetMember returns the details of a member by domain name
 func (ml *MembershipList) GetMember(domain string) (Member, bool) {
 	ml.mu.Lock()         // Acquire the lock before reading the map
@@ -282,21 +303,11 @@ func (ml *MembershipList) Alive_Ids() []int {
 			continue
 		}
 
-		// Extract IP and split the string
-		s := member.IP
-		parts := strings.Split(s, "-")
-
-		// Ensure the IP has enough parts and the expected format
-		if len(parts) >= 3 && len(parts[2]) >= 4 {
-			twoDigitStr := parts[2][2:4] // Extract the "68" part as a string
-
-			// Attempt to convert the extracted string into an integer
-			if id, err := strconv.Atoi(twoDigitStr); err == nil {
-				ids = append(ids, id) // Collect the integer
-			} else {
-				// Log error if conversion fails, but continue processing
-				log.Printf("Error parsing IP part: %s, error: %v", twoDigitStr, err)
-			}
+		// Resolve the member's domain to its id through the registry
+		if id, exists := ml.nodes.IDOf(member.IP); exists {
+			ids = append(ids, id)
+		} else {
+			log.Printf("Member %s is not in the node registry", member.IP)
 		}
 	}
 
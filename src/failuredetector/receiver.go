@@ -1,6 +1,7 @@
 package failuredetector
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
@@ -35,44 +36,72 @@ type Receiver struct {
 	myaddress    string // The address of the sender
 	port         string
 	gossipBuffer *GossipBuffer // Buffer for tracking gossip messages
+	conn         *net.UDPConn
+	config       Config                    // Settings of the detector of the node
+	Drop         func(message string) bool // Messages it returns true for are ignored, nil keeps them all
 }
 
 var dropRate = 0.0
 
 // NewReceiver creates a new receiver with the specified address
-func NewReceiver(myaddr string, port string) *Receiver {
+func NewReceiver(myaddr string, port string, config Config) *Receiver {
 	return &Receiver{
 		localhost:    "0.0.0.0",
 		myaddress:    myaddr,
 		port:         port,
 		gossipBuffer: NewGossipBuffer(),
+		config:       config,
 	}
 }
 
-// Listen starts the UDP server to listen for incoming messages
-func (r *Receiver) Listen(ml *MembershipList) {
+// Bind opens the UDP socket of the receiver
+func (r *Receiver) Bind() error {
 	addr, err := net.ResolveUDPAddr("udp", r.localhost+":"+r.port)
 	if err != nil {
-		log.Fatal("Error (Listen) resolving UDP address:", err)
+		return fmt.Errorf("Error (Listen) resolving UDP address: %v", err)
 	}
 
 	conn, err := net.ListenUDP("udp", addr)
 	if err != nil {
-		log.Fatal("Error (Listen) starting UDP server:", err)
+		return fmt.Errorf("Error (Listen) starting UDP server: %v", err)
 	}
-	defer conn.Close()
-
+	r.conn = conn
 	log.Println("Receiver listening on", addr.String())
+	return nil
+}
+
+// Close stops Listen
+func (r *Receiver) Close() {
+	if r.conn != nil {
+		r.conn.Close()
+	}
+}
+
+// Listen starts the UDP server to listen for incoming messages, binding it first if needed
+func (r *Receiver) Listen(ml *MembershipList) {
+	if r.conn == nil {
+		if err := r.Bind(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	conn := r.conn
+	defer conn.Close()
 
 	for {
 		buffer := make([]byte, 1024)
 		n, senderAddr, err := conn.ReadFromUDP(buffer)
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			log.Println("Error (Listen) reading from UDP:", err)
 			continue
 		}
 
 		message := string(buffer[:n])
+		if r.Drop != nil && r.Drop(message) {
+			continue
+		}
 
 		randomValue := rand.Float64()
 		if randomValue < dropRate && !strings.HasPrefix(message, "SUS") {
@@ -82,7 +111,7 @@ func (r *Receiver) Listen(ml *MembershipList) {
 		// Print the bandwidth
 		// fmt.Println(len(message), time.Now())
 
-		if len(ml.Members) > 0 || r.myaddress == IntroducerAddr || strings.HasPrefix(message, "SUS") { // Only handle the requests if the node is in the network/ is the introducer
+		if ml.Len() > 0 || r.myaddress == r.config.IntroducerAddr || strings.HasPrefix(message, "SUS") { // Only handle the requests if the node is in the network/ is the introducer
 			if strings.HasPrefix(message, "PING") {
 				var senderLocalAddr string
 				_, err := fmt.Sscanf(message, "PING from %s", &senderLocalAddr)
@@ -98,7 +127,8 @@ func (r *Receiver) Listen(ml *MembershipList) {
 				_, err := fmt.Sscanf(message, "REPING from %s to %s", &requestAddr, &targetAddr)
 				if err == nil {
 					log.Printf("Reping Request from %s to ping %s received", requestAddr, targetAddr)
-					s := NewSender(targetAddr, PingPort, r.myaddress)
+					target := ml.Lookup(targetAddr)
+					s := NewSender(target.Host, target.PingPort, r.myaddress)
 					err = s.Ping(3 * time.Second)
 					if err != nil {
 						log.Printf("Ping to %s failed: %s\n", targetAddr, err)
@@ -130,7 +160,8 @@ func (r *Receiver) Listen(ml *MembershipList) {
 					parsedTime, _ := time.Parse(time.RFC3339, timeStamp)
 					switch state {
 					case "FAILED":
-						if exists && memberState != Failed {
+						// A failure detected before the member last changed state, e.g. before it joined again, is stale
+						if changed, _ := ml.GetMemberTimestamp(topicAddr); exists && memberState != Failed && !parsedTime.Before(changed) {
 							ml.UpdateMember(topicAddr, Failed, parsedTime, ml.GetIncNumber(topicAddr)) // Failed, we don't actually care about the incNum
 							log.Printf("Failure detection of %s at %s\n", topicAddr, time.Now())
 						}
@@ -188,8 +219,8 @@ func (r *Receiver) Listen(ml *MembershipList) {
 							}
 						}
 					case "JOIN":
-						if r.myaddress == IntroducerAddr {
-							if len(ml.Members) == 0 && topicAddr != r.myaddress {
+						if r.myaddress == r.config.IntroducerAddr {
+							if ml.Len() == 0 && topicAddr != r.myaddress {
 								conn.WriteToUDP([]byte(fmt.Sprintf("REFUSED")), senderAddr)
 								continue // Don't pass on the gossip
 							} else { // Add the member
@@ -206,16 +237,17 @@ func (r *Receiver) Listen(ml *MembershipList) {
 					}
 
 					currentTime := time.Now()
-					if currentTime.Sub(parsedTime) <= GossipDuration {
+					if currentTime.Sub(parsedTime) <= r.config.GossipDuration {
 						excludeList := []string{r.myaddress, requestAddr, topicAddr}
 						if state == "JOIN" {
-							excludeList = append(excludeList, IntroducerAddr)
+							excludeList = append(excludeList, r.config.IntroducerAddr)
 						}
-						gMembers := ml.GetRandomMembers(G, excludeList)
+						gMembers := ml.GetRandomMembers(r.config.G, excludeList)
 						log.Printf("Passing on gossip of timestamp %s from %s about %s with: \n", timeStamp, requestAddr, topicAddr)
 						for i, gMember := range gMembers {
 							log.Println(i, gMember.IP)
-							gSender := NewSender(gMember.IP, GossipPort, r.myaddress)
+							gNode := ml.Lookup(gMember.IP)
+							gSender := NewSender(gNode.Host, gNode.GossipPort, r.myaddress)
 							if err := gSender.Gossip(parsedTime, topicAddr, state, requestAddr, inc); err != nil {
 								log.Printf("Failed to send gossip to %s. With error: %s\n", gMember.IP, err.Error())
 							}
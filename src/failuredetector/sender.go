@@ -106,7 +106,7 @@ func (s *Sender) Gossip(timeStamp time.Time, topicaddr string, state string, sou
 
 	defer conn.Close()
 
-	_, err = conn.Write([]byte(fmt.Sprintf("GOSSIP from %s passed by %s update %s %s incNum %d timestamp %s", source, s.localAddr, topicaddr, state, inc, timeStamp.Format(time.RFC3339))))
+	_, err = conn.Write([]byte(fmt.Sprintf("GOSSIP from %s passed by %s update %s %s incNum %d timestamp %s", source, s.localAddr, topicaddr, state, inc, timeStamp.Format(time.RFC3339Nano))))
 	if err != nil {
 		return fmt.Errorf("Error sending Gossip: %v", err)
 	}
@@ -2,70 +2,118 @@ package main
 
 import (
 	"HyDFS/failuredetector"
-	"bytes"
-	"crypto/sha256"
-	"encoding/hex"
+	"HyDFS/registry"
+	"HyDFS/ring"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"math/big"
 	"net/http"
 	"os"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	REP_NUM          = 3
-	MAX_SERVER       = 10
-	HTTP_PORT        = "4444"
 	FILE_PATH_PREFIX = "../files/server/"
 	MOVE_TIMEOUT     = time.Second
 	MERGE_TIMEOUT    = 10 * time.Second
+	ONLINE_TIMEOUT   = time.Second // Wait for an answer to /online, a server that isn't serving yet doesn't answer
 )
 
+// Answered with 409 Conflict to an exclusive create of a name already taken
+var errExists = errors.New("file already exists")
+
 type File struct {
 	filename string // Gives the path to local file on the server
+	rf       int    // Number of servers storing the file, the primary included
+	version  int    // Number of writes merged into the stored content, the create included
+	size     int64  // Size and checksum of the stored content, appends waiting in cache excluded
+	checksum string
+	meta     fileMeta
 	Mutex    *sync.RWMutex
-	cache    map[time.Time]string
+	cache    map[appendKey]pendingAppend // Appends waiting for a merge, see appendlog.go
+	verified verification                // Last check of the stored content, see openVerified
 }
 
-func NewFile(filename string) *File {
+func NewFile(filename string, rf int) *File {
 	return &File{
 		filename: filename,
+		rf:       rf,
+		version:  1,
 		Mutex:    &sync.RWMutex{},
-		cache:    make(map[time.Time]string),
+		cache:    make(map[appendKey]pendingAppend),
 	}
 }
 
+// A create authorized by the coordinator, waiting for the file content
+type createRequest struct {
+	server int // Primary server of the file
+	rf     int // Replication factor asked by the client
+	w, r   int // Quorums asked by the client, 0 for the ones of the config
+}
+
 type FileServer struct {
 	aliveml            *failuredetector.MembershipList
+	nodes              *registry.Registry
 	pred_list          []int
 	succ_list          []int
 	p_files            map[string]File
 	r_files            map[string]File
 	id                 int
-	online             bool
+	file_dir           string
+	log_dir            string      // Append logs of the files, see appendlog.go
+	online             atomic.Bool // Set once the server joined the file system, read by the handlers
 	Mutex              sync.RWMutex
-	coord_create_queue map[string]int
+	catalog_mutex      sync.Mutex            // Serializes the writes of the catalog
+	catalog_saved      map[catalogKey]string // Entries of the catalog as last saved, JSON encoded, see catalog.go
+	catalog_journal    int                   // Records in the journal of the catalog
+	coord_create_queue map[string]createRequest
 	coord_append_queue map[string]int
 	mv_p_to_r          map[string]time.Time
+	repairing          map[string]bool       // Corrupt files being fetched again, see checksum.go
+	creating           map[string]bool       // Names taken by exclusive creates still storing their content
+	chain_heads        map[string]*chainHead // Serializes the appends to the files this server heads the chain of, see chain.go
+	tombstones         map[string]tombstone  // Deleted files, see tombstone.go
+	config             Config
+	append_seq         atomic.Uint64     // Numbers the appends of the clients without an id this server coordinates
+	transport          http.RoundTripper // Used for requests to other servers, nil for http.DefaultTransport
+	clock              hlc               // Orders the appends, carried by every request between servers, see hlc.go
+	stop               chan struct{}
 }
 
-func FileServerInit(ml *failuredetector.MembershipList, id int) *FileServer {
-	return &FileServer{
+func FileServerInit(ml *failuredetector.MembershipList, nodes *registry.Registry, id int, config Config) *FileServer {
+	// Every node keeps its files in its own directory, so that several nodes can share a host
+	file_dir := config.FileDir + strconv.Itoa(id) + "/"
+	if err := os.MkdirAll(file_dir, 0755); err != nil {
+		log.Fatalf("Failed to create file directory %s: %s", file_dir, err)
+	}
+	log_dir := appendLogDir(config, id)
+	if err := os.MkdirAll(log_dir, 0755); err != nil {
+		log.Fatalf("Failed to create append log directory %s: %s", log_dir, err)
+	}
+
+	fs := &FileServer{
 		// Fields that don't need lock protection
 		id:        id,
-		online:    false,                      // I assume a single flip doesn't need to be protected that much.
+		nodes:     nodes,
+		config:    config,
+		file_dir:  file_dir,
+		log_dir:   log_dir,
 		mv_p_to_r: make(map[string]time.Time), // Since this field is never used by HTTP handler
+		stop:      make(chan struct{}),
 
 		// Shared file lists
-		p_files: make(map[string]File),
-		r_files: make(map[string]File),
+		p_files:    make(map[string]File),
+		r_files:    make(map[string]File),
+		tombstones: make(map[string]tombstone),
+
+		catalog_saved: make(map[catalogKey]string),
 
 		// Shared membership
 		aliveml:   ml,
@@ -73,29 +121,36 @@ func FileServerInit(ml *failuredetector.MembershipList, id int) *FileServer {
 		succ_list: make([]int, 0),
 
 		// Shared by multiple http handlers
-		coord_create_queue: make(map[string]int),
+		coord_create_queue: make(map[string]createRequest),
 		coord_append_queue: make(map[string]int),
+		repairing:          make(map[string]bool),
+		creating:           make(map[string]bool),
+		chain_heads:        make(map[string]*chainHead),
 	}
+	// Numbers keep growing across restarts, copies would take smaller ones for appends they merged already
+	fs.append_seq.Store(uint64(time.Now().UnixNano()))
+	fs.recoverFiles()
+	return fs
 }
 
-func hashKey(input string) int {
-	// Create a new SHA256 hash
-	hash := sha256.New()
-	// Write the input string as bytes to the hash
-	hash.Write([]byte(input))
-	// Get the resulting hash as a byte slice
-	hashedBytes := hash.Sum(nil)
-	// Convert the hash bytes to a hexadecimal string
-	hashString := hex.EncodeToString(hashedBytes)
-
-	// Convert the hex string to a big.Int
-	bigIntHash := new(big.Int)
-	bigIntHash.SetString(hashString, 16)
+// Stop ends the maintenance of the file server
+func (fs *FileServer) Stop() {
+	if !fs.stopped() {
+		close(fs.stop)
+	}
+}
 
-	// Mod the big.Int by 1000 and add 1 to map to the range [1, 1000]
-	result := bigIntHash.Mod(bigIntHash, big.NewInt(1000)).Int64() + 1
+func (fs *FileServer) stopped() bool {
+	select {
+	case <-fs.stop:
+		return true
+	default:
+		return false
+	}
+}
 
-	return int(result)
+func (fs *FileServer) newClient(timeout time.Duration) *http.Client {
+	return &http.Client{Transport: &clockTransport{clock: &fs.clock, base: fs.transport}, Timeout: timeout}
 }
 
 func equalSlices(a, b []int) bool {
@@ -111,68 +166,73 @@ func equalSlices(a, b []int) bool {
 	return true
 }
 
-func findSuccessors(owner int, membershipList []int, n int) []int {
-	var successors []int
-	listLength := len(membershipList)
+// Snapshot of the ring formed by the servers currently alive
+func (fs *FileServer) currentRing() *ring.Ring {
+	return ring.New(fs.aliveml.Alive_Ids(), fs.config.VNodes)
+}
 
-	// Find the index of the owner in the membership list
-	ownerIndex := len(membershipList)
-	for i, node := range membershipList {
-		if node == owner {
-			ownerIndex = i
-			break
-		}
-	}
+// The primary server of a file followed by the servers holding its replicas, rf servers in total
+func fileReplicas(r *ring.Ring, filename string, rf int) []int {
+	return r.Replicas(ring.Hash(filename), rf)
+}
 
-	if listLength-1 < n {
-		n = listLength - 1
+// Parse a replication factor given in a request, falling back to the default one if it is missing
+func (fs *FileServer) parseRF(s string) (int, error) {
+	if s == "" {
+		return fs.config.DefaultRF, nil
 	}
-
-	for i := 1; i <= n; i++ {
-		successorIndex := (ownerIndex + i) % listLength
-		successor := membershipList[successorIndex]
-		successors = append(successors, successor)
+	rf, err := strconv.Atoi(s)
+	if err != nil || rf < 1 || rf > fs.config.MaxRF {
+		return 0, fmt.Errorf("replication factor must be an integer between 1 and %d", fs.config.MaxRF)
 	}
-
-	return successors
+	return rf, nil
 }
 
-func findPredecessors(owner int, membershipList []int, n int) []int {
-	var predecessors []int
-	listLength := len(membershipList)
+// Ask the primary server of a file for its replication factor, -1 if the file doesn't exist there
+func (fs *FileServer) fetchRF(p_server int, filename string) (int, error) {
+	rf, _, err := fs.fetchPrimary(p_server, filename)
+	return rf, err
+}
 
-	// Find the index of the owner in the membership list
-	ownerIndex := len(membershipList)
-	for i, node := range membershipList {
-		if node == owner {
-			ownerIndex = i
-			break
-		}
+// Like fetchRF, also returning the metadata of the file, which holds its quorums
+func (fs *FileServer) fetchPrimary(p_server int, filename string) (int, fileMeta, error) {
+	url := fmt.Sprintf("http://%s/existfile?filename=%s&ftype=p", fs.nodes.HTTPAddr(p_server), escapeName(filename))
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return 0, fileMeta{}, err
 	}
 
-	if listLength-1 < n {
-		n = listLength - 1
+	client := fs.newClient(0)
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, fileMeta{}, err
 	}
+	defer resp.Body.Close()
 
-	for i := 1; i <= n; i++ {
-		predecessorIndex := (ownerIndex - i + listLength) % listLength
-		predecessor := membershipList[predecessorIndex]
-		predecessors = append(predecessors, predecessor)
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) == "NO" {
+		return -1, fileMeta{}, nil
 	}
+	rf, err := fs.parseRF(resp.Header.Get("Replication-Factor"))
+	return rf, parseMeta(resp.Header.Get("Meta")), err
+}
 
-	return predecessors
+// Parse the version of a file given in a request, a missing one being the version of a new file
+func parseVersion(s string) int {
+	version, err := strconv.Atoi(s)
+	if err != nil || version < 1 {
+		return 1
+	}
+	return version
 }
 
-func findServerByfileID(ids []int, fileID int) int {
-	server_id := -1
-	min := 1000
+func containsId(ids []int, id int) bool {
 	for _, i := range ids {
-		if (i*100+1000-fileID)%1000 < min {
-			server_id = i
-			min = (i*100 + 1000 - fileID) % 1000
+		if i == id {
+			return true
 		}
 	}
-	return server_id
+	return false
 }
 
 func fileExistsinPrimary(fs *FileServer, filename string) bool {
@@ -197,48 +257,24 @@ func fileExistsinReplica(fs *FileServer, filename string) bool {
 	}
 }
 
-// Return a []int of int that appear in array2 but missing in array1
-func newComers(array1, array2 []int) []int {
-	diff := []int{}
-	elements := make(map[int]bool)
-
-	// Add all elements of array1 to a map for quick lookups
-	for _, num := range array1 {
-		elements[num] = true
-	}
-
-	// Check elements in array2 and add to result if not in array1
-	for _, num := range array2 {
-		if !elements[num] {
-			diff = append(diff, num)
-		}
-	}
-
-	return diff
-}
-
-func id_to_domain(id int) string {
-	return "fa24-cs425-68" + fmt.Sprintf("%02d", id) + ".cs.illinois.edu"
-}
-
 // Maintenance Thread
 func Maintenance(fs *FileServer) {
-	for {
-		// Update online=true only if all members are in the network.
-		if !fs.online && len(fs.aliveml.Alive_Ids()) == MAX_SERVER {
-			fs.online = true
+	for !fs.stopped() {
+		// Update online=true only if all registered nodes are in the network.
+		if !fs.online.Load() && len(fs.aliveml.Alive_Ids()) == fs.nodes.Len() {
+			fs.online.Store(true)
 		}
 
-		if !fs.online {
+		if !fs.online.Load() {
 			for _, i := range fs.aliveml.Alive_Ids() {
-				url := fmt.Sprintf("http://%s:%s/online", id_to_domain(i), HTTP_PORT)
+				url := fmt.Sprintf("http://%s/online", fs.nodes.HTTPAddr(i))
 				req, err := http.NewRequest(http.MethodGet, url, nil)
 				if err != nil {
 					log.Println("Error in creation of http.NewRequest", err)
 					continue
 				}
 
-				client := &http.Client{}
+				client := fs.newClient(ONLINE_TIMEOUT)
 				resp, err := client.Do(req)
 
 				if err != nil {
@@ -249,7 +285,7 @@ func Maintenance(fs *FileServer) {
 
 				body, _ := io.ReadAll(resp.Body)
 				if string(body) == "Yes" {
-					fs.online = true
+					fs.online.Store(true)
 					break
 				}
 			}
@@ -263,13 +299,15 @@ func Maintenance(fs *FileServer) {
 		updateSuccList(fs)
 		delayedMove(fs)
 		automerge(fs)
+		expireTombstones(fs)
 
 		time.Sleep(50 * time.Millisecond)
 	}
 }
 
 func updatePredList(fs *FileServer) {
-	new_pred_list := findPredecessors(fs.id, fs.aliveml.Alive_Ids(), REP_NUM)
+	ring_now := fs.currentRing()
+	new_pred_list := ring_now.Predecessors(fs.id, fs.config.MaxRF-1)
 	old_pred_list := fs.pred_list
 
 	if equalSlices(new_pred_list, old_pred_list) {
@@ -281,17 +319,26 @@ func updatePredList(fs *FileServer) {
 	fs.Mutex.Unlock()
 
 	// For replication restore
-	newPreds := newComers(old_pred_list[:], new_pred_list)
-	for _, i := range newPreds {
+	// Files have their own replication factors, so a change anywhere in pred_list may add this server to the
+	// replica set of a file whose primary was already a predecessor. Every predecessor is asked for the primary
+	// files this server should replicate, and only the missing ones are pulled. The successors are asked too, for
+	// the files deleted while this server was away: they replicated the files this server was the primary of.
+	servers := new_pred_list
+	for _, i := range ring_now.Successors(fs.id, fs.config.MaxRF-1) {
+		if !containsId(servers, i) {
+			servers = append(servers, i)
+		}
+	}
+	for _, i := range servers {
 		// Create a new request to the external server
-		url := fmt.Sprintf("http://%s:%s/storedfilenames?ftype=p", id_to_domain(i), HTTP_PORT)
+		url := fmt.Sprintf("http://%s/storedfilenames?ftype=p&replica=%d", fs.nodes.HTTPAddr(i), fs.id)
 		req, err := http.NewRequest(http.MethodGet, url, nil)
 		if err != nil {
 			log.Println("Error in request creation (when calling http.NewRequest) ", err)
 			continue
 		}
 
-		client := &http.Client{}
+		client := fs.newClient(0)
 		resp, err := client.Do(req)
 
 		// TODO: what if the new predecessor is busy?
@@ -301,25 +348,44 @@ func updatePredList(fs *FileServer) {
 		}
 		defer resp.Body.Close()
 
-		var filenames []string
+		// File names with their versions
+		var versions storedVersions
 
 		if resp.StatusCode == http.StatusOK {
-			body, _ := io.ReadAll(resp.Body)
-			filenames = strings.Split(string(body), " ")
+			if err := json.NewDecoder(resp.Body).Decode(&versions); err != nil {
+				log.Println("Invalid list of stored files from server", i, err)
+			}
+		}
+
+		// Copies of the files deleted while this server was away go first, so that none of them is pushed back
+		for filename, t := range versions.Tombstones {
+			local, exists := fs.storedFile(filename, "")
+			if (exists && local.version > t.Version) || (!exists && fs.buried(filename, t.Version)) {
+				continue
+			}
+			if exists {
+				log.Println("Deleting file " + filename + ", it was deleted while this server was away")
+			}
+			fs.deleteFile(filename, t.RF, t.Version)
 		}
 
-		for _, filename := range filenames {
-			if len(filename) == 0 {
+		for filename, version := range versions.Files {
+			// Only pull the files this server doesn't hold yet or holds an older version of, the rest stay where they are
+			fs.Mutex.Lock()
+			_, is_primary := fs.p_files[filename]
+			local, is_replica := fs.r_files[filename]
+			fs.Mutex.Unlock()
+			if is_primary || (is_replica && local.version >= version) || fs.buried(filename, version) {
 				continue
 			}
-			url := fmt.Sprintf("http://%s:%s/getting?filename=%s&ftype=p", id_to_domain(i), HTTP_PORT, filename)
+			url := fmt.Sprintf("http://%s/getting?filename=%s&ftype=p", fs.nodes.HTTPAddr(i), escapeName(filename))
 			req2, err := http.NewRequest(http.MethodGet, url, nil)
 			if err != nil {
 				log.Println("Error in request creation (when calling http.NewRequest) ", err)
 				continue
 			}
 
-			client := &http.Client{}
+			client := fs.newClient(0)
 			resp, err := client.Do(req2)
 			if err != nil {
 				log.Println("Failed when checking file ", filename, "'s existence", err)
@@ -331,56 +397,63 @@ func updatePredList(fs *FileServer) {
 				log.Println("Rejected, file " + filename + " doesn't exist")
 				continue
 			}
-			body, _ := io.ReadAll(resp.Body)
-
-			// Open the file in append mode, or create it if it doesn't exist
-			file, err := os.OpenFile(FILE_PATH_PREFIX+filename, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
+			rf, err := fs.parseRF(resp.Header.Get("Replication-Factor"))
 			if err != nil {
-				log.Println("Failed to open or create file " + filename)
+				log.Println("Invalid replication factor of file "+filename, err)
 				continue
 			}
-			defer file.Close()
+			version = parseVersion(resp.Header.Get("Version"))
 
-			// Write the received content to the file
-			_, err = file.Write(body)
+			// Write the received content to the file, once it matches the checksum of the sender
+			err = fs.storeFile(filename, resp.Body, func() string { return resp.Header.Get(CHECKSUM_HEADER) }, func(size int64, checksum string) error {
+				if err := fs.rewriteAppendLog(filename, nil); err != nil {
+					log.Println("Failed to remove the append log of "+filename, err)
+				}
+				f := NewFile(filename, rf)
+				f.version = version
+				f.size = size
+				f.checksum = checksum
+				f.meta = parseMeta(resp.Header.Get("Meta"))
+				fs.Mutex.Lock()
+				fs.r_files[filename] = *f
+				fs.Mutex.Unlock()
+				return nil
+			})
 			if err != nil {
-				log.Println("Failed to write content to file " + filename)
+				log.Println("Failed to write content to file "+filename, err)
 				continue
 			}
-
-			fs.Mutex.Lock()
-			fs.r_files[filename] = *NewFile(filename)
-			fs.Mutex.Unlock()
 		}
 	}
 
 	// For primary restore
-	movedFiles := make(map[string]bool)
+	movedFiles := make(map[string]File)
 
 	fs.Mutex.Lock()
 	for k, f := range fs.r_files {
-		if findServerByfileID(fs.aliveml.Alive_Ids(), hashKey(k)) == fs.id {
-			movedFiles[k] = true
+		if ring_now.Owner(ring.Hash(k)) == fs.id {
+			movedFiles[k] = f
 			fs.p_files[k] = f
 			delete(fs.r_files, k)
 		}
 	}
 	fs.Mutex.Unlock()
+	fs.saveCatalog()
 
-	// -> Now push the replicas that are moved from r_files to p_files
-	fs.Mutex.Lock()
-	succList := fs.succ_list
-	fs.Mutex.Unlock()
-	for k := range movedFiles {
-		for _, i := range succList {
-			fileContent, _ := os.ReadFile(FILE_PATH_PREFIX + k)
-			url := fmt.Sprintf("http://%s:%s/creating?filename=%s&ftype=r", id_to_domain(i), HTTP_PORT, k)
-			req, _ := http.NewRequest(http.MethodPut, url, bytes.NewReader(fileContent))
-
-			// Send the request
-			client := &http.Client{}
-			_, err := client.Do(req)
-			if err != nil {
+	// -> Now push the replicas that are moved from r_files to p_files, each to its own number of replicas
+	for k, f := range movedFiles {
+		for _, i := range fileReplicas(ring_now, k, f.rf) {
+			if i == fs.id {
+				continue
+			}
+			url := fmt.Sprintf("http://%s/creating?filename=%s&ftype=r&rf=%d&version=%d&%s", fs.nodes.HTTPAddr(i), escapeName(k), f.rf, f.version, metaQuery(f.meta))
+			if err := fs.putFile(url, k); errors.Is(err, errDeleted) {
+				// The file was deleted while this server was away
+				log.Println("Deleting file "+k+", a replica holds its tombstone", err)
+				fs.deleteFile(k, f.rf, f.version)
+				fs.saveCatalog(k)
+				break
+			} else if err != nil {
 				log.Println("Failed when pushing replicas with http request", err)
 			}
 		}
@@ -389,7 +462,7 @@ func updatePredList(fs *FileServer) {
 	// For rejoin (move those in p_files that no longer belong to yourself to r_files)
 	fs.Mutex.Lock()
 	for k := range fs.p_files {
-		if findServerByfileID(fs.aliveml.Alive_Ids(), hashKey(k)) != fs.id {
+		if ring_now.Owner(ring.Hash(k)) != fs.id {
 			_, exist := fs.mv_p_to_r[k]
 			if !exist {
 				fs.mv_p_to_r[k] = time.Now()
@@ -400,7 +473,7 @@ func updatePredList(fs *FileServer) {
 }
 
 func updateSuccList(fs *FileServer) {
-	new_succ_list := findSuccessors(fs.id, fs.aliveml.Alive_Ids(), REP_NUM)
+	new_succ_list := fs.currentRing().Successors(fs.id, fs.config.MaxRF-1)
 
 	if equalSlices(new_succ_list, fs.succ_list) {
 		return
@@ -417,22 +490,34 @@ func delayedMove(fs *FileServer) {
 	for k, t := range fs.mv_p_to_r {
 		if time.Now().After(t.Add(MOVE_TIMEOUT)) {
 			fs.Mutex.Lock()
-			owner := findServerByfileID(fs.aliveml.Alive_Ids(), hashKey(k))
+			owner := fs.currentRing().Owner(ring.Hash(k))
+			f, exists := fs.p_files[k]
 			fs.Mutex.Unlock()
-			fileContent, _ := os.ReadFile(FILE_PATH_PREFIX + k)
-			url := fmt.Sprintf("http://%s:%s/creating?filename=%s&ftype=p", id_to_domain(owner), HTTP_PORT, k)
-			req, _ := http.NewRequest(http.MethodPut, url, bytes.NewReader(fileContent))
-
-			// Send the request
-			client := &http.Client{}
-			_, err := client.Do(req)
-
+			// Deleted in the meantime
+			if !exists {
+				toDelete = append(toDelete, k)
+				continue
+			}
+			url := fmt.Sprintf("http://%s/creating?filename=%s&ftype=p&rf=%d&version=%d&%s", fs.nodes.HTTPAddr(owner), escapeName(k), f.rf, f.version, metaQuery(f.meta))
+			// The owner may not serve requests yet, keep the primary and try again later rather than lose the latest version
+			err := fs.putFile(url, k)
+			if errors.Is(err, errDeleted) {
+				log.Println("Deleting file "+k+", its owner holds its tombstone", err)
+				fs.deleteFile(k, f.rf, f.version)
+				toDelete = append(toDelete, k)
+				continue
+			}
 			if err != nil {
 				fmt.Println("Error in making creating of p_file "+k+" to owner", err)
+				fs.Mutex.Lock()
+				fs.mv_p_to_r[k] = time.Now()
+				fs.Mutex.Unlock()
+				continue
 			}
 			fs.Mutex.Lock()
 			fs.r_files[k] = fs.p_files[k]
 			delete(fs.p_files, k)
+			fs.dropChain(k)
 			fs.Mutex.Unlock()
 			toDelete = append(toDelete, k)
 		}
@@ -443,71 +528,56 @@ func delayedMove(fs *FileServer) {
 	}
 
 	// -> Then remove those replicas that are no longer needed.
+	ring_now := fs.currentRing()
+	removed := false
 	fs.Mutex.Lock()
-	for k := range fs.r_files {
-		p_server := findServerByfileID(fs.aliveml.Alive_Ids(), hashKey(k))
-		exist := false
-		for _, v := range fs.pred_list {
-			if v == p_server {
-				exist = true
-				break
-			}
-		}
-
-		if p_server != fs.id && !exist {
-			fmt.Println("Removing replica file " + k + " since " + strconv.Itoa(p_server) + " is not a predecessor.")
+	for k, f := range fs.r_files {
+		replicas := fileReplicas(ring_now, k, f.rf)
+		if !containsId(replicas, fs.id) {
+			fmt.Println("Removing replica file " + k + " since it is now replicated on " + fmt.Sprint(replicas))
 			delete(fs.r_files, k)
+			removed = true
 		}
 	}
 	fs.Mutex.Unlock()
+
+	if removed || len(toDelete) > 0 {
+		fs.saveCatalog()
+	}
 }
 
 func automerge(fs *FileServer) {
-	fs.Mutex.Lock()
-	current_p_files := fs.p_files
-	current_r_files := fs.r_files
-	fs.Mutex.Unlock()
-
-	for _, f := range current_p_files {
-		if len(f.cache) > 0 {
-			timestamps := make([]time.Time, 0, len(f.cache))
-			for t := range f.cache {
-				timestamps = append(timestamps, t)
-			}
-
-			sort.Slice(timestamps, func(i, j int) bool {
-				return timestamps[i].Before(timestamps[j])
-			})
-
-			if time.Now().After(timestamps[len(timestamps)-1].Add(MERGE_TIMEOUT)) {
-				url := fmt.Sprintf("http://%s:%s/merging?filename=%s", id_to_domain(fs.id), HTTP_PORT, f.filename)
-				req, _ := http.NewRequest(http.MethodGet, url, nil)
-
-				// Send the request
-				client := &http.Client{}
-				client.Do(req)
-			}
-		}
+	// Primary files merge MERGE_TIMEOUT after their last append, replicas sooner
+	fs.Mutex.RLock()
+	timeouts := make(map[string]time.Duration)
+	var files []File
+	for _, f := range fs.p_files {
+		timeouts[f.filename] = MERGE_TIMEOUT
+		files = append(files, f)
 	}
+	for _, f := range fs.r_files {
+		timeouts[f.filename] = 5 * time.Second
+		files = append(files, f)
+	}
+	fs.Mutex.RUnlock()
 
-	for _, f := range current_r_files {
+	for _, f := range files {
+		f.Mutex.RLock()
+		var last time.Time
 		if len(f.cache) > 0 {
-			timestamps := make([]time.Time, 0, len(f.cache))
-			for t := range f.cache {
-				timestamps = append(timestamps, t)
-			}
-
-			sort.Slice(timestamps, func(i, j int) bool {
-				return timestamps[i].Before(timestamps[j])
-			})
+			keys := sortedAppends(f.cache)
+			last = keys[len(keys)-1].stamp.Time()
+		}
+		f.Mutex.RUnlock()
 
-			if time.Now().After(timestamps[len(timestamps)-1].Add(5 * time.Second)) {
-				url := fmt.Sprintf("http://%s:%s/merging?filename=%s", id_to_domain(fs.id), HTTP_PORT, f.filename)
-				req, _ := http.NewRequest(http.MethodGet, url, nil)
+		if !last.IsZero() && time.Now().After(last.Add(timeouts[f.filename])) {
+			url := fmt.Sprintf("http://%s/merging?filename=%s", fs.nodes.HTTPAddr(fs.id), escapeName(f.filename))
+			req, _ := http.NewRequest(http.MethodGet, url, nil)
 
-				// Send the request
-				client := &http.Client{}
-				client.Do(req)
+			// Send the request
+			client := fs.newClient(0)
+			if resp, err := client.Do(req); err == nil {
+				resp.Body.Close()
 			}
 		}
 	}
@@ -516,81 +586,93 @@ func automerge(fs *FileServer) {
 // ------------------------- HTTP Handler -------------------------//
 // Function to start HTTP server
 func HTTPServer(fs *FileServer) {
+	fs.waitOnline()
 
-	for {
-		if fs.online {
-			break
+	me, _ := fs.nodes.Node(fs.id)
+	fmt.Println("Starting HTTP server on :" + me.HTTPPort)
+	log.Fatal(http.ListenAndServe(":"+me.HTTPPort, fs.Handler()))
+}
+
+// Block until the server has joined the file system, returns false if it was stopped before
+func (fs *FileServer) waitOnline() bool {
+	for !fs.stopped() {
+		if fs.online.Load() {
+			return true
 		}
 		time.Sleep(50 * time.Millisecond)
 	}
+	return false
+}
 
-	http.HandleFunc("/", fs.httpHandleSlash)        // Handle slash request (used when client search coordinator servers)
-	http.HandleFunc("/create", fs.httpHandleCreate) // Handle file creation requests
-	http.HandleFunc("/creating", fs.httpHandleCreating)
-	http.HandleFunc("/existfile", fs.httpHandleExistence)   // Handle file existence queries, return YES/NO
-	http.HandleFunc("/membership", fs.httpHandleMembership) // Return ids of online servers
-	http.HandleFunc("/online", fs.httpHandleOnline)         // Return YES/NO to indicate online/offline
-	http.HandleFunc("/append", fs.httpHandleAppend)
-	http.HandleFunc("/appending", fs.httpHandleAppending)
-	http.HandleFunc("/get", fs.httpHandleGet)
-	http.HandleFunc("/getfromreplica", fs.httpHandleGetfromreplica)
-	http.HandleFunc("/getting", fs.httpHandleGetting)
-	http.HandleFunc("/store", fs.httpHandleStore)
-	http.HandleFunc("/storedfilenames", fs.httpHandleStoredfilenames)
-	http.HandleFunc("/merging", fs.httpHandleMerging)
-	http.HandleFunc("/merge", fs.httpHandleMerge)
-	http.HandleFunc("/ls", fs.httpHandleLs)
-
-	fmt.Println("Starting HTTP server on :" + HTTP_PORT)
-	log.Fatal(http.ListenAndServe(":"+HTTP_PORT, nil))
+// Handler routes the requests of clients and other servers
+func (fs *FileServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", fs.httpHandleSlash)        // Handle slash request (used when client search coordinator servers)
+	mux.HandleFunc("/create", fs.httpHandleCreate) // Handle file creation requests
+	mux.HandleFunc("/creating", fs.httpHandleCreating)
+	mux.HandleFunc("/existfile", fs.httpHandleExistence)   // Handle file existence queries, return YES/NO
+	mux.HandleFunc("/membership", fs.httpHandleMembership) // Return ids of online servers
+	mux.HandleFunc("/online", fs.httpHandleOnline)         // Return YES/NO to indicate online/offline
+	mux.HandleFunc("/append", fs.httpHandleAppend)
+	mux.HandleFunc("/appending", fs.httpHandleAppending)
+	mux.HandleFunc("/get", fs.httpHandleGet)
+	mux.HandleFunc("/getfromreplica", fs.httpHandleGetfromreplica)
+	mux.HandleFunc("/getting", fs.httpHandleGetting)
+	mux.HandleFunc("/store", fs.httpHandleStore)
+	mux.HandleFunc("/storedfilenames", fs.httpHandleStoredfilenames)
+	mux.HandleFunc("/merging", fs.httpHandleMerging)
+	mux.HandleFunc("/merge", fs.httpHandleMerge)
+	mux.HandleFunc("/ls", fs.httpHandleLs)
+	mux.HandleFunc("/delete", fs.httpHandleDelete)
+	mux.HandleFunc("/deleting", fs.httpHandleDeleting)
+	mux.HandleFunc("/rename", fs.httpHandleRename)
+	mux.HandleFunc("/renaming", fs.httpHandleRenaming)
+	mux.HandleFunc("/mkdir", fs.httpHandleMkdir)
+	mux.HandleFunc("/find", fs.httpHandleFind)
+	mux.HandleFunc("/list", fs.httpHandleList)
+	mux.HandleFunc("/stat", fs.httpHandleStat)
+	mux.HandleFunc("/statting", fs.httpHandleStatting)
+	mux.HandleFunc("/storedfiles", fs.httpHandleStoredfiles)
+	mux.HandleFunc("/antientropy", fs.httpHandleAntiEntropy) // Merkle trees of the stored files, see antientropy.go
+	return fs.clock.handler(mux)
 }
 
 // HTTP handler functions
 func (fs *FileServer) httpHandleLs(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
-		filename := r.URL.Query().Get("filename")
-
-		fid := hashKey(filename)
-		fs.Mutex.Lock()
-		p_id := findServerByfileID(fs.aliveml.Alive_Ids(), fid)
-		fs.Mutex.Unlock()
+		// A name ending with "/" is a directory, other names too when no file has them
+		name := r.URL.Query().Get("filename")
+		if !strings.HasSuffix(name, DIR_SEPARATOR) {
+			filename, err := normalizeName(name)
+			if err != nil {
+				httpError(w, errorCode(err), "Rejected, "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if fs.lsFile(w, filename) {
+				return
+			}
+		}
 
-		url := fmt.Sprintf("http://%s:%s/existfile?filename=%s&ftype=p", id_to_domain(p_id), HTTP_PORT, filename)
-		req2, err := http.NewRequest(http.MethodGet, url, nil)
+		dir, err := normalizeDir(name)
 		if err != nil {
-			http.Error(w, "Failed when checking file existence", http.StatusInternalServerError)
+			httpError(w, errorCode(err), "Rejected, "+err.Error(), http.StatusBadRequest)
 			return
 		}
-
-		client := &http.Client{}
-		resp, err := client.Do(req2)
-		defer resp.Body.Close()
-
-		existFlag := true
-		if resp.StatusCode == http.StatusOK {
-			body, _ := io.ReadAll(resp.Body)
-			if string(body) == "NO" {
-				existFlag = false
-			}
+		names, err := fs.findNames(dir)
+		if err != nil {
+			httpError(w, errorCode(err), "Failed when listing the directory: "+err.Error(), http.StatusInternalServerError)
+			return
 		}
-
-		if !existFlag {
-			http.Error(w, "File doesn't exist on HyDFS", http.StatusInternalServerError)
+		if dir != "" && len(names) == 0 {
+			httpError(w, CODE_NOT_EXIST, "File doesn't exist on HyDFS", http.StatusInternalServerError)
 			return
 		}
-
-		response_s := "VM addresses and ids storing the file:\n" + id_to_domain(p_id) + " " + strconv.Itoa(p_id) + "\n"
-		fs.Mutex.Lock()
-		succ := findSuccessors(p_id, fs.aliveml.Alive_Ids(), REP_NUM)
-		fs.Mutex.Unlock()
-
-		for _, i := range succ {
-			response_s += id_to_domain(i) + " " + strconv.Itoa(i) + "\n"
+		entries := dirEntries(dir, names)
+		response_s := "Directory /" + dir + ", " + strconv.Itoa(len(entries)) + " entries:\n"
+		for _, entry := range entries {
+			response_s += entry + "\n"
 		}
-
-		response_s += "File id of " + filename + " is " + strconv.Itoa(fid)
-
 		w.Write([]byte(response_s))
 		return
 	default:
@@ -598,6 +680,46 @@ func (fs *FileServer) httpHandleLs(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Answer ls for a file, false if it doesn't exist
+func (fs *FileServer) lsFile(w http.ResponseWriter, filename string) bool {
+	fid := ring.Hash(filename)
+	ring_now := fs.currentRing()
+	p_id := ring_now.Owner(fid)
+	if p_id == -1 {
+		http.Error(w, "Rejected due to server internal error", http.StatusInternalServerError)
+		return true
+	}
+
+	// The primary knows the replication factor of the file, which tells how many servers store it
+	rf, err := fs.fetchRF(p_id, filename)
+	if err != nil {
+		http.Error(w, "Failed when checking file existence", http.StatusInternalServerError)
+		return true
+	}
+
+	if rf == -1 {
+		return false
+	}
+
+	response_s := "VM addresses and ids storing the file:\n"
+	for _, i := range fileReplicas(ring_now, filename, rf) {
+		response_s += fs.nodes.HTTPAddr(i) + " " + strconv.Itoa(i) + "\n"
+	}
+
+	response_s += "File id of " + filename + " is " + strconv.FormatUint(fid, 10) + ", replication factor " + strconv.Itoa(rf)
+
+	// Each block is on servers of its own
+	blocks, _, err := fs.fetchBlockMap(p_id, filename, "p", "")
+	if err != nil {
+		http.Error(w, "Failed when fetching the block map", http.StatusInternalServerError)
+		return true
+	}
+	response_s += "\n" + strconv.Itoa(len(blocks)) + " blocks:" + fs.describeBlocks(ring_now, blocks, rf)
+
+	w.Write([]byte(response_s))
+	return true
+}
+
 func (fs *FileServer) httpHandleCreate(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodPost:
@@ -616,20 +738,43 @@ func (fs *FileServer) httpHandleCreate(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		if hydfs, err = normalizeName(hydfs); err != nil {
+			httpError(w, errorCode(err), "Rejected, "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// The replication factor is optional
+		rf, err := fs.parseRF(req["rf"])
+		if err != nil {
+			httpError(w, errorCode(err), "Rejected, "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		// So are the quorums the file keeps
+		write_quorum, err := parseQuorum(req["w"])
+		if err != nil {
+			httpError(w, errorCode(err), "Rejected, "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		read_quorum, err := parseQuorum(req["r"])
+		if err != nil {
+			httpError(w, errorCode(err), "Rejected, "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		// Find out the primary server of the HyDFS file
-		fileID := hashKey(hydfs)
-		responsible_server_id := findServerByfileID(fs.aliveml.Alive_Ids(), fileID)
+		fileID := ring.Hash(hydfs)
+		responsible_server_id := fs.currentRing().Owner(fileID)
 		if responsible_server_id == -1 {
-			log.Println("Invalid findServerByfileID result in httpHandleCreate")
+			log.Println("Empty ring in httpHandleCreate")
 			http.Error(w, "Rejected due to server internal error", http.StatusBadRequest)
 			return
 		}
 
 		// Check if allowed to create
-		url := fmt.Sprintf("http://%s:%s/existfile?filename=%s&ftype=p", id_to_domain(responsible_server_id), HTTP_PORT, hydfs)
+		url := fmt.Sprintf("http://%s/existfile?filename=%s&ftype=p", fs.nodes.HTTPAddr(responsible_server_id), escapeName(hydfs))
 		req2, _ := http.NewRequest(http.MethodGet, url, nil)
 
-		client := &http.Client{}
+		client := fs.newClient(0)
 		resp, err := client.Do(req2)
 		if err != nil {
 			log.Println("Failed when checking file existence")
@@ -646,45 +791,77 @@ func (fs *FileServer) httpHandleCreate(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
+		// Nor can a file take the name of a directory made by mkdir
+		if !existFlag {
+			dir := hydfs + DIR_SEPARATOR
+			rf, err := fs.fetchRF(fs.currentRing().Owner(ring.Hash(dir)), dir)
+			if err != nil {
+				http.Error(w, "Failed when checking file existence", http.StatusInternalServerError)
+				return
+			}
+			existFlag = rf != -1
+		}
+
 		if !existFlag {
 			// Write the request into a cache
 			fs.Mutex.Lock()
 			defer fs.Mutex.Unlock()
 
-			fs.coord_create_queue[hydfs] = responsible_server_id
+			fs.coord_create_queue[hydfs] = createRequest{server: responsible_server_id, rf: rf, w: write_quorum, r: read_quorum}
 
 			fmt.Fprintf(w, "Authorized")
 		} else {
-			http.Error(w, "Rejected, file "+hydfs+" already exists", http.StatusBadRequest)
+			httpError(w, CODE_EXISTS, "Rejected, file "+hydfs+" already exists", http.StatusBadRequest)
 		}
 		return
 	case http.MethodPut:
-		filename := r.URL.Query().Get("filename")
-		if filename == "" {
-			http.Error(w, "HyDFS Filename not specified", http.StatusBadRequest)
-			return
-		}
-
-		// Read the file content from the request body
-		fileContent, err := io.ReadAll(r.Body)
+		filename, err := normalizeName(r.URL.Query().Get("filename"))
 		if err != nil {
-			http.Error(w, "Failed to read file content from request", http.StatusInternalServerError)
+			httpError(w, errorCode(err), "Rejected, "+err.Error(), http.StatusBadRequest)
 			return
 		}
 
 		fs.Mutex.Lock()
-		responsible_server_id, exist := fs.coord_create_queue[filename]
+		task, exist := fs.coord_create_queue[filename]
 		fs.Mutex.Unlock()
 
 		if !exist {
 			http.Error(w, "Invalid upload, file creation not allowed", http.StatusBadRequest)
 			return
 		}
-		// Create a new request to the external server
-		url := fmt.Sprintf("http://%s:%s/creating?filename=%s&ftype=p", id_to_domain(responsible_server_id), HTTP_PORT, filename)
-		req, _ := http.NewRequest(http.MethodPut, url, bytes.NewReader(fileContent))
+		responsible_server_id := task.server
+		// Store the blocks streamed from the client, then the block map on the primary of the file
+		content := newHashingReader(r.Body)
+		blocks, err := fs.writeBlocks(filename, task.rf, fs.writeQuorum(fileMeta{}, task.w, task.rf), content)
+		if errors.Is(err, errQuorum) {
+			log.Println("Failed to store the blocks of "+filename, err)
+			httpError(w, CODE_QUORUM, "Failed, "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			log.Println("Failed to store the blocks of "+filename, err)
+			http.Error(w, "Failed to store the blocks of the file", http.StatusInternalServerError)
+			return
+		}
+		// Blocks of content that doesn't match the checksum of the client never make it into a block map
+		if err := checkSum(requestChecksum(r), content.Sum()); err != nil {
+			log.Println("Rejected content of file "+filename, err)
+			httpError(w, errorCode(err), "Rejected, "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		var size int64
+		for _, blk := range blocks {
+			size += blk.size
+		}
+		url := fmt.Sprintf("http://%s/creating?filename=%s&ftype=p&exclusive=true&rf=%d&size=%d&creator=%s", fs.nodes.HTTPAddr(responsible_server_id), escapeName(filename), task.rf, size, escapeName(clientHost(r)))
+		if quorums := quorumQuery(task.w, task.r); quorums != "" {
+			url += "&" + quorums
+		}
+		block_map := formatBlockMap(blocks)
+		req, _ := http.NewRequest(http.MethodPut, url, strings.NewReader(block_map))
+		req.Header.Set(CHECKSUM_HEADER, stringChecksum(block_map))
 
-		client := &http.Client{}
+		client := fs.newClient(0)
 		resp, err := client.Do(req)
 		if err != nil {
 			log.Println("Failed to send creating request to primary owner server")
@@ -694,9 +871,15 @@ func (fs *FileServer) httpHandleCreate(w http.ResponseWriter, r *http.Request) {
 		defer resp.Body.Close()
 
 		// Check if the external server responded successfully
+		w.Header().Set(ACKS_HEADER, resp.Header.Get(ACKS_HEADER))
+		if resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusConflict {
+			body, _ := io.ReadAll(resp.Body)
+			httpError(w, resp.Header.Get(ERROR_HEADER), strings.TrimSpace(string(body)), resp.StatusCode)
+			return
+		}
 		if resp.StatusCode != http.StatusOK {
 			log.Println("External server error in create http handler when sending creating request: " + resp.Status)
-			http.Error(w, "External server error: "+resp.Status, resp.StatusCode)
+			httpError(w, resp.Header.Get(ERROR_HEADER), "External server error: "+resp.Status, resp.StatusCode)
 			return
 		}
 
@@ -704,7 +887,7 @@ func (fs *FileServer) httpHandleCreate(w http.ResponseWriter, r *http.Request) {
 		fs.Mutex.Lock()
 		delete(fs.coord_create_queue, filename)
 		fs.Mutex.Unlock()
-		fmt.Fprint(w, "File uploaded to external server "+id_to_domain(responsible_server_id)+" successfully")
+		fmt.Fprint(w, "File uploaded to external server "+fs.nodes.HTTPAddr(responsible_server_id)+" successfully, "+resp.Header.Get(ACKS_HEADER)+" copies acknowledged")
 		return
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -750,6 +933,10 @@ func (fs *FileServer) httpHandleExistence(w http.ResponseWriter, r *http.Request
 
 		if ftype == "p" {
 			if fileExistsinPrimary(fs, filename) {
+				fs.Mutex.Lock()
+				w.Header().Set("Replication-Factor", strconv.Itoa(fs.p_files[filename].rf))
+				w.Header().Set("Meta", encodeMeta(fs.p_files[filename].meta))
+				fs.Mutex.Unlock()
 				w.Write([]byte("YES"))
 			} else {
 				w.Write([]byte("NO"))
@@ -771,9 +958,7 @@ func (fs *FileServer) httpHandleExistence(w http.ResponseWriter, r *http.Request
 func (fs *FileServer) httpHandleOnline(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
-		fs.Mutex.Lock()
-		defer fs.Mutex.Unlock()
-		if fs.online {
+		if fs.online.Load() {
 			w.Write([]byte("Yes"))
 		} else {
 			w.Write([]byte("No"))
@@ -789,68 +974,131 @@ func (fs *FileServer) httpHandleAppending(w http.ResponseWriter, r *http.Request
 	case http.MethodPut:
 		// Get filename from query parameters
 		filename := r.URL.Query().Get("filename")
-		timeStampStr := r.URL.Query().Get("timestamp")
+		key := parseAppendKey(r.URL.Query())
 		initFlag := r.URL.Query().Get("init")
 
-		timestamp, _ := time.Parse(time.RFC3339Nano, timeStampStr)
 		if filename == "" {
 			log.Println("HandleAppending Filename not specified")
 			http.Error(w, "Filename not specified", http.StatusBadRequest)
 			return
 		}
 
-		// Read the content from the request body
-		content, err := io.ReadAll(r.Body)
-		if err != nil {
-			log.Println("HandleAppending Failed to read content from request body")
-			http.Error(w, "Failed to read content from request body", http.StatusInternalServerError)
-			return
-		}
-
 		if initFlag == "true" {
-			fmt.Println("Appending")
-			fmt.Println(string(content))
+			fmt.Println("Appending to " + filename)
+			// The head of a chain sends the appends down one at a time
+			if fs.chained() {
+				defer fs.lockChain(filename)()
+			}
 		}
 
 		fs.Mutex.Lock()
 		alive_ids := fs.aliveml.Alive_Ids()
-		_, exist := fs.p_files[filename]
-		if exist {
-			fs.p_files[filename].Mutex.Lock()
-			fs.p_files[filename].cache[timestamp] = string(content)
-			fs.p_files[filename].Mutex.Unlock()
-		} else {
-			fs.r_files[filename].Mutex.Lock()
-			fs.r_files[filename].cache[timestamp] = string(content)
-			fs.r_files[filename].Mutex.Unlock()
+		f, exist := fs.p_files[filename]
+		if !exist {
+			f, exist = fs.r_files[filename]
 		}
 		fs.Mutex.Unlock()
+		if !exist {
+			httpError(w, CODE_NOT_EXIST, "Rejected, file "+filename+" doesn't exist", http.StatusBadRequest)
+			return
+		}
+		// A client may send an append again, and a copy repaired by anti-entropy may have merged a forwarded append
+		// before it arrives
+		f.Mutex.RLock()
+		duplicate := duplicateAppend(f.cache, f.meta.Applied, key)
+		f.Mutex.RUnlock()
+		if duplicate {
+			w.Header().Set(ACKS_HEADER, "1")
+			fmt.Fprint(w, "File content already appended")
+			return
+		}
+		rf := f.rf
+		size, _ := strconv.ParseInt(r.URL.Query().Get("size"), 10, 64)
+		record := appendRecord{Time: key.stamp.Time(), Stamp: key.stamp, Size: size, Client: r.URL.Query().Get("host"), ClientID: key.client, Seq: key.seq}
+
+		// The append is streamed to the log under the lock of the file, so that a merge can't empty the log in between
+		content := newHashingReader(r.Body)
+		f.Mutex.Lock()
+		pending, err := fs.logAppend(filename, key, content)
+		if err == nil {
+			if err = checkSum(requestChecksum(r), content.Sum()); err == nil {
+				f.cache[key] = pending
+			} else if logErr := fs.rewriteAppendLog(filename, f.cache); logErr != nil {
+				// The rejected record stays in the log until it is rewritten, the cache doesn't refer to it
+				log.Println("Failed to rewrite the append log of "+filename, logErr)
+			}
+		}
+		f.Mutex.Unlock()
+		// A copy of a chain records the append once the rest of the chain acknowledged it
+		if err == nil && !fs.chained() {
+			fs.recordAppend(filename, f.Mutex, record)
+		}
+		if errors.Is(err, errChecksum) {
+			log.Println("Rejected append to file "+filename, err)
+			httpError(w, errorCode(err), "Rejected, "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Println("Failed to log append to file "+filename, err)
+			http.Error(w, "Failed to log append", http.StatusInternalServerError)
+			return
+		}
 
-		if initFlag == "true" {
-			// Now broadcast the change
-			p_server_id := findServerByfileID(alive_ids, hashKey(filename))
-			reps := findSuccessors(p_server_id, alive_ids, REP_NUM)
-			if p_server_id != fs.id {
-				// Create a new request to the external server
-				url := fmt.Sprintf("http://%s:%s/appending?filename=%s&timestamp=%s&init=false", id_to_domain(p_server_id), HTTP_PORT, filename, timestamp.Format(time.RFC3339Nano))
-				req, _ := http.NewRequest(http.MethodPut, url, bytes.NewReader(content))
-
-				// Send the request
-				client := &http.Client{}
-				client.Do(req)
+		// The append is acknowledged once W copies, this one included, logged it
+		acks := 1
+		if fs.chained() {
+			// The rest of the chain comes with the append, the head works it out
+			chain := parseChain(r.URL.Query().Get("chain"))
+			if initFlag == "true" {
+				chain = fs.chainAfter(alive_ids, filename, rf)
+			}
+			forwarded, err := fs.forwardChain(filename, appendKeyQuery(key)+"&"+appendQuery(record.Size, record.Client), pending, chain)
+			if err != nil {
+				log.Println("Dropping append to "+filename, err)
+				f.Mutex.Lock()
+				delete(f.cache, key)
+				if err := fs.rewriteAppendLog(filename, f.cache); err != nil {
+					log.Println("Failed to rewrite the append log of "+filename, err)
+				}
+				f.Mutex.Unlock()
+				httpError(w, CODE_QUORUM, fmt.Sprintf("Failed, %v, %v", errQuorum, err), http.StatusServiceUnavailable)
+				return
+			}
+			acks += forwarded
+			fs.recordAppend(filename, f.Mutex, record)
+			if _, err := fs.mergeCache(&f); err != nil {
+				log.Println("Failed to merge append to "+filename, err)
+				http.Error(w, "Failed to merge append", http.StatusInternalServerError)
+				return
 			}
+			fs.saveCatalog(filename)
+		} else if initFlag == "true" {
+			// Now broadcast the change to the primary and the other replicas
+			reps := fileReplicas(ring.New(alive_ids, fs.config.VNodes), filename, rf)
 			for _, i := range reps {
 				if i != fs.id {
-					// Create a new request to the external server
-					url := fmt.Sprintf("http://%s:%s/appending?filename=%s&timestamp=%s&init=false", id_to_domain(i), HTTP_PORT, filename, timestamp.Format(time.RFC3339Nano))
-					req, _ := http.NewRequest(http.MethodPut, url, bytes.NewReader(content))
-
-					// Send the request
-					client := &http.Client{}
-					client.Do(req)
+					// Create a new request to the external server, streaming the append back from the log
+					url := fmt.Sprintf("http://%s/appending?filename=%s&init=false&%s&%s", fs.nodes.HTTPAddr(i), escapeName(filename), appendKeyQuery(key), appendQuery(record.Size, record.Client))
+					content, err := fs.openAppend(filename, pending)
+					if err != nil {
+						log.Println("Failed to read back append to "+filename, err)
+						break
+					}
+					if err := fs.put(url, content); err != nil {
+						log.Println("Failed to forward append to "+filename, err)
+					} else {
+						acks++
+					}
+					content.Close()
 				}
 			}
 		}
+		w.Header().Set(ACKS_HEADER, strconv.Itoa(acks))
+		request, _ := parseQuorum(r.URL.Query().Get("w"))
+		if quorum := fs.writeQuorum(f.meta, request, rf); initFlag == "true" && acks < quorum {
+			httpError(w, CODE_QUORUM, fmt.Sprintf("Failed, %v, %d of %d copies of %s logged the append", errQuorum, acks, quorum, filename), http.StatusServiceUnavailable)
+			return
+		}
 
 		fmt.Fprint(w, "File content appended successfully")
 	default:
@@ -868,58 +1116,138 @@ func (fs *FileServer) httpHandleCreating(w http.ResponseWriter, r *http.Request)
 			http.Error(w, "Filename not specified", http.StatusBadRequest)
 			return
 		}
-
-		// Read the content from the request body
-		content, err := io.ReadAll(r.Body)
+		rf, err := fs.parseRF(r.URL.Query().Get("rf"))
 		if err != nil {
-			http.Error(w, "Failed to read content from request body", http.StatusInternalServerError)
+			httpError(w, errorCode(err), "Rejected, "+err.Error(), http.StatusBadRequest)
 			return
 		}
-
-		// Open the file in append mode, or create it if it doesn't exist
-		file, err := os.OpenFile(FILE_PATH_PREFIX+filename, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
-			http.Error(w, "Failed to open or create file", http.StatusInternalServerError)
-			return
+		// An exclusive create takes the name until its content is stored, and fails if a file or another create has it
+		if r.URL.Query().Get("exclusive") == "true" {
+			fs.Mutex.Lock()
+			_, primary := fs.p_files[filename]
+			_, replica := fs.r_files[filename]
+			taken := primary || replica || fs.creating[filename]
+			if !taken {
+				fs.creating[filename] = true
+			}
+			fs.Mutex.Unlock()
+			if taken {
+				httpError(w, CODE_EXISTS, fmt.Sprintf("Rejected, %v, %s", errExists, filename), http.StatusConflict)
+				return
+			}
+			defer func() {
+				fs.Mutex.Lock()
+				delete(fs.creating, filename)
+				fs.Mutex.Unlock()
+			}()
+		}
+		// Files moved between servers keep their version, new ones start at 1 or past the tombstone of a deleted file
+		version := parseVersion(r.URL.Query().Get("version"))
+		if r.URL.Query().Get("version") == "" {
+			fs.Mutex.Lock()
+			if t, exists := fs.tombstones[filename]; exists {
+				version = t.version + 1
+			}
+			fs.Mutex.Unlock()
+		} else {
+			// A server that missed the delete of a file may push it back
+			if fs.buried(filename, version) {
+				httpError(w, CODE_NOT_EXIST, "Rejected, file "+filename+" was deleted", http.StatusGone)
+				return
+			}
+			fs.Mutex.Lock()
+			held, exists := fs.p_files[filename]
+			if !exists {
+				held, exists = fs.r_files[filename]
+			}
+			fs.Mutex.Unlock()
+			// A server that was down may push an older copy than the one already here
+			if exists && held.version > version {
+				fmt.Fprint(w, "Kept newer version of the file")
+				return
+			}
 		}
-		defer file.Close()
 
-		// Write the received content to the file
-		_, err = file.Write(content)
-		if err != nil {
-			http.Error(w, "Failed to write content to file", http.StatusInternalServerError)
-			return
+		// Copies keep the metadata of the file, a new file is created now by the client of the coordinator
+		meta := parseMeta(r.URL.Query().Get("meta"))
+		fresh := meta.Created.IsZero()
+		if fresh {
+			meta = newMeta(r.URL.Query().Get("creator"))
+			meta.WriteQuorum, _ = parseQuorum(r.URL.Query().Get("w"))
+			meta.ReadQuorum, _ = parseQuorum(r.URL.Query().Get("r"))
 		}
+		content_size, _ := strconv.ParseInt(r.URL.Query().Get("size"), 10, 64)
 
-		fs.Mutex.Lock()
+		// A primary pushes the create to its replicas while it stores the content
+		var urls []string
 		if ftype == "p" {
-			fs.p_files[filename] = *NewFile(filename)
-		} else {
-			fs.r_files[filename] = *NewFile(filename)
+			for _, i := range fileReplicas(fs.currentRing(), filename, rf) {
+				if i != fs.id {
+					urls = append(urls, fmt.Sprintf("http://%s/creating?filename=%s&ftype=r&rf=%d&version=%d&%s", fs.nodes.HTTPAddr(i), escapeName(filename), rf, version, metaQuery(meta)))
+				}
+			}
 		}
-		fs.Mutex.Unlock()
-
-		// Pushing create to replicas
+		// The replicas are only told the content is complete once it matches the checksum of the sender. The file is
+		// kept once W copies, this one included, store it.
+		quorum := 1
 		if ftype == "p" {
+			quorum = fs.writeQuorum(meta, 0, rf)
+		}
+		pushes := fs.startPuts(urls)
+		finished := false
+		var pushErr error
+		err = fs.storeFile(filename, r.Body, func() string { return requestChecksum(r) }, func(size int64, checksum string) error {
+			finished = true
+			if failed := pushes.finish(nil); failed != nil && 1+pushes.acked < quorum {
+				pushErr = fmt.Errorf("%w, %d of %d copies of %s stored: %v", errQuorum, 1+pushes.acked, quorum, filename, failed)
+				return pushErr
+			} else if failed != nil {
+				log.Println("Failed to push file "+filename+" to a replica", failed)
+			}
+			// Appends waiting for the replaced content are dropped with it
+			if err := fs.rewriteAppendLog(filename, nil); err != nil {
+				log.Println("Failed to remove the append log of "+filename, err)
+			}
+			f := NewFile(filename, rf)
+			f.version = version
+			f.size = size
+			f.checksum = checksum
+			f.meta = meta
+			if fresh {
+				f.meta = fs.withVersion(meta, fileVersion{Version: version, Time: meta.Created, Size: content_size, MapSize: size})
+			}
 			fs.Mutex.Lock()
-			succ_list_temp := fs.succ_list
+			if ftype == "p" {
+				fs.p_files[filename] = *f
+				delete(fs.r_files, filename)
+			} else {
+				fs.r_files[filename] = *f
+			}
+			delete(fs.tombstones, filename)
 			fs.Mutex.Unlock()
-			for _, i := range succ_list_temp {
-				// Create a new request to the external server
-				url := fmt.Sprintf("http://%s:%s/creating?filename=%s&ftype=r", id_to_domain(i), HTTP_PORT, filename)
-				req, _ := http.NewRequest(http.MethodPut, url, bytes.NewReader(content))
-
-				// Send the request
-				client := &http.Client{}
-				resp, err := client.Do(req)
-				if err != nil {
-					http.Error(w, "Failed to send creating request to external server", http.StatusInternalServerError)
-					return
-				}
-				defer resp.Body.Close()
-			}
+			return nil
+		}, pushes.writers()...)
+		if !finished {
+			pushes.finish(err)
+		}
+		if pushErr != nil {
+			log.Println("Failed to push file "+filename+" to its replicas", pushErr)
+			w.Header().Set(ACKS_HEADER, strconv.Itoa(1+pushes.acked))
+			httpError(w, errorCode(pushErr), "Failed, "+pushErr.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if errors.Is(err, errChecksum) {
+			log.Println("Rejected content of file "+filename, err)
+			httpError(w, errorCode(err), "Rejected, "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to write content to file", http.StatusInternalServerError)
+			return
 		}
+		fs.saveCatalog(filename)
 
+		w.Header().Set(ACKS_HEADER, strconv.Itoa(1+pushes.acked))
 		fmt.Fprint(w, "File content created successfully")
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -943,41 +1271,96 @@ func (fs *FileServer) httpHandleGet(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Missing localfilename or HyDFSfilename in request", http.StatusBadRequest)
 			return
 		}
+		if hydfs, err = normalizeName(hydfs); err != nil {
+			httpError(w, errorCode(err), "Rejected, "+err.Error(), http.StatusBadRequest)
+			return
+		}
 
 		// Find out the primary server of the HyDFS file
-		fileID := hashKey(hydfs)
-		responsible_server_id := findServerByfileID(fs.aliveml.Alive_Ids(), fileID)
+		fileID := ring.Hash(hydfs)
+		responsible_server_id := fs.currentRing().Owner(fileID)
 		if responsible_server_id == -1 {
-			log.Println("Invalid findServerByfileID result in httpHandleCreate")
+			log.Println("Empty ring in httpHandleCreate")
 			http.Error(w, "Rejected due to server internal error", http.StatusBadRequest)
 			return
 		}
 
-		url := fmt.Sprintf("http://%s:%s/getting?filename=%s&ftype=p", id_to_domain(responsible_server_id), HTTP_PORT, hydfs)
-		req2, _ := http.NewRequest(http.MethodGet, url, nil)
-
-		client := &http.Client{Timeout: time.Minute * 2}
-		resp, err := client.Do(req2)
+		// An earlier version is asked by number or as of a time
+		var version int
+		var asOf time.Time
+		if req["version"] != "" {
+			if version, err = strconv.Atoi(req["version"]); err != nil || version < 1 {
+				http.Error(w, "Rejected, invalid version "+req["version"], http.StatusBadRequest)
+				return
+			}
+		}
+		if req["as_of"] != "" {
+			if asOf, err = time.Parse(time.RFC3339Nano, req["as_of"]); err != nil {
+				http.Error(w, "Rejected, invalid time "+req["as_of"], http.StatusBadRequest)
+				return
+			}
+		}
 
+		// R copies are read, an earlier version being the same on all of them
+		quorum, err := parseQuorum(req["r"])
 		if err != nil {
-			log.Println("Error in making getting requesting to external servers")
-			http.Error(w, "Error fetching the file, internal error", http.StatusInternalServerError)
+			httpError(w, errorCode(err), "Rejected, "+err.Error(), http.StatusBadRequest)
 			return
 		}
+		at := versionQuery(version, asOf)
+		if at != "" {
+			quorum = 1
+		}
+		// The current content is read from a copy that merged the last append of the client
+		if seq, _ := strconv.ParseUint(req["seq"], 10, 64); at == "" && req["client"] != "" && seq > 0 {
+			at = sessionQuery(req["client"], seq)
+		}
 
-		if resp.StatusCode != http.StatusOK {
-			http.Error(w, "Rejected, file "+hydfs+" doesn't exist", http.StatusBadRequest)
+		// The primary holds the block map, the blocks are then fetched from their own servers. A chain is read
+		// from its tail.
+		fetch := func() (storedCopy, int, error) {
+			if fs.chained() {
+				return fs.fetchTailBlockMap(responsible_server_id, hydfs, at)
+			}
+			return fs.fetchQuorumBlockMap(responsible_server_id, hydfs, at, quorum)
+		}
+		newest, acks, err := fetch()
+		if errors.Is(err, errNotApplied) {
+			if err = fs.mergeEverywhere(hydfs); err == nil {
+				newest, acks, err = fetch()
+			} else {
+				log.Println("Failed to merge "+hydfs+" for a get", err)
+				err = errNotApplied
+			}
+		}
+		if errors.Is(err, errNotStored) {
+			httpError(w, CODE_NOT_EXIST, "Rejected, file "+hydfs+" doesn't exist", http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, errNotApplied) {
+			httpError(w, CODE_STALE, "Rejected, no server merged the appends of client "+req["client"]+" to file "+hydfs+" yet", http.StatusConflict)
+			return
+		}
+		if errors.Is(err, errNoVersion) {
+			which := req["version"]
+			if version == 0 {
+				which = "as of " + req["as_of"]
+			}
+			httpError(w, CODE_NO_VERSION, "Rejected, file "+hydfs+" has no retained version "+which, http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, errQuorum) {
+			w.Header().Set(ACKS_HEADER, strconv.Itoa(acks))
+			httpError(w, errorCode(err), "Failed, "+err.Error(), http.StatusServiceUnavailable)
 			return
 		}
-		// Stream the response body to the response writer directly
-		w.Header().Set("Content-Type", "application/octet-stream")
-		_, err = io.Copy(w, resp.Body)
-
-		defer resp.Body.Close()
 		if err != nil {
-			log.Println("Error while sending file content:", err)
-			http.Error(w, "Error sending file content", http.StatusInternalServerError)
+			log.Println("Error in making getting requesting to external servers", err)
+			http.Error(w, "Error fetching the file, internal error", http.StatusInternalServerError)
+			return
 		}
+		w.Header().Set(ACKS_HEADER, strconv.Itoa(acks))
+		fs.sendBlocks(w, r, hydfs, newest.blocks, newest.rf)
 		return
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -1001,41 +1384,43 @@ func (fs *FileServer) httpHandleGetfromreplica(w http.ResponseWriter, r *http.Re
 			http.Error(w, "Missing localfilename or HyDFSfilename in request", http.StatusBadRequest)
 			return
 		}
+		if hydfs, err = normalizeName(hydfs); err != nil {
+			httpError(w, errorCode(err), "Rejected, "+err.Error(), http.StatusBadRequest)
+			return
+		}
 
 		// Find out the primary server of the HyDFS file
-		fileID := hashKey(hydfs)
-		responsible_server_id := findServerByfileID(fs.aliveml.Alive_Ids(), fileID)
+		fileID := ring.Hash(hydfs)
+		responsible_server_id := fs.currentRing().Owner(fileID)
 		if responsible_server_id == -1 {
-			log.Println("Invalid findServerByfileID result in httpHandleCreate")
+			log.Println("Empty ring in httpHandleCreate")
 			http.Error(w, "Rejected due to server internal error", http.StatusBadRequest)
 			return
 		}
 
-		url := fmt.Sprintf("%s:%s/getting?filename=%s&ftype=r", req["vm_add"], HTTP_PORT, hydfs)
-		req2, _ := http.NewRequest(http.MethodGet, url, nil)
-
-		client := &http.Client{Timeout: time.Minute * 2}
-		resp, err := client.Do(req2)
-
+		// The replica is named by its id and resolved through the node registry
+		vm_id, err := strconv.Atoi(req["vm_id"])
 		if err != nil {
-			log.Println("Error in making getting requesting to external servers")
-			http.Error(w, "Error fetching the file, internal error", http.StatusInternalServerError)
+			http.Error(w, "Invalid or missing vm_id in request", http.StatusBadRequest)
 			return
 		}
-
-		if resp.StatusCode != http.StatusOK {
-			http.Error(w, "Rejected, file "+hydfs+" doesn't exist", http.StatusBadRequest)
+		if _, exists := fs.nodes.Node(vm_id); !exists {
+			http.Error(w, "Rejected, server "+req["vm_id"]+" is not in the node registry", http.StatusBadRequest)
 			return
 		}
-		// Stream the response body to the response writer directly
-		w.Header().Set("Content-Type", "application/octet-stream")
-		_, err = io.Copy(w, resp.Body)
 
-		defer resp.Body.Close()
+		// The replica tells the blocks it knows of, which may lag behind the primary
+		blocks, rf, err := fs.fetchBlockMap(vm_id, hydfs, "r", "")
+		if errors.Is(err, errNotStored) {
+			httpError(w, CODE_NOT_EXIST, "Rejected, file "+hydfs+" doesn't exist", http.StatusBadRequest)
+			return
+		}
 		if err != nil {
-			log.Println("Error while sending file content:", err)
-			http.Error(w, "Error sending file content", http.StatusInternalServerError)
+			log.Println("Error in making getting requesting to external servers", err)
+			http.Error(w, "Error fetching the file, internal error", http.StatusInternalServerError)
+			return
 		}
+		fs.sendBlocks(w, r, hydfs, blocks, rf)
 		return
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -1047,32 +1432,67 @@ func (fs *FileServer) httpHandleGetting(w http.ResponseWriter, r *http.Request)
 	case http.MethodGet:
 		filename := r.URL.Query().Get("filename")
 		ftype := r.URL.Query().Get("ftype")
-
-		exist_flag := false
-		fs.Mutex.Lock()
-		if ftype == "p" {
-			_, exist_flag = fs.p_files[filename]
-		} else {
-			_, exist_flag = fs.r_files[filename]
+		if ftype != "p" {
+			ftype = "r"
 		}
-		fs.Mutex.Unlock()
 
-		if !exist_flag {
-			http.Error(w, "Rejected, file "+filename+" doesn't exist", http.StatusBadRequest)
+		// A corrupt file is refused, the servers asking for it turn to another copy
+		file, f, err := fs.openVerified(filename, ftype)
+		if errors.Is(err, errNotStored) {
+			httpError(w, CODE_NOT_EXIST, "Rejected, file "+filename+" doesn't exist", http.StatusBadRequest)
 			return
 		}
-
-		file, err := os.Open(FILE_PATH_PREFIX + filename)
 		if err != nil {
-			http.Error(w, "Could not open file: "+err.Error(), http.StatusInternalServerError)
+			log.Println("Refusing to send file "+filename, err)
+			httpError(w, errorCode(err), "Could not read file: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
 		defer file.Close()
 		fmt.Println("Reacting to get request for file " + filename)
 
-		w.WriteHeader(http.StatusOK)
-		if _, err := io.Copy(w, file); err != nil {
-			http.Error(w, "Failed to send file: "+err.Error(), http.StatusInternalServerError)
+		// An earlier version is the beginning of the block map
+		v, err := fs.selectVersion(f.meta, r.URL.Query())
+		if errors.Is(err, errInvalidVersion) {
+			httpError(w, errorCode(err), "Rejected, "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			httpError(w, errorCode(err), "Rejected, file "+filename+" has "+err.Error(), http.StatusNotFound)
+			return
+		}
+		if v != nil {
+			fs.sendVersion(w, file, f, *v)
+			return
+		}
+		// A client reading its own appends waits for a copy that merged them
+		if err := checkApplied(f.meta, r.URL.Query()); err != nil {
+			httpError(w, errorCode(err), "Rejected, file "+filename+" has "+err.Error(), http.StatusConflict)
+			return
+		}
+
+		// Servers pulling a replica learn how many copies of the file to keep
+		w.Header().Set("Replication-Factor", strconv.Itoa(f.rf))
+		w.Header().Set("Version", strconv.Itoa(f.version))
+		w.Header().Set("File-Size", strconv.FormatInt(f.size, 10))
+		w.Header().Set("Meta", encodeMeta(f.meta))
+
+		// A coordinator reading part of a file gets the range alone, which the checksum of the file doesn't cover
+		start, end, ranged, err := parseRange(r.Header.Get("Range"), f.size)
+		if err != nil {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", f.size))
+			httpError(w, CODE_RANGE, "Rejected, "+err.Error(), http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.FormatInt(end-start, 10))
+		if ranged {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, f.size))
+			w.WriteHeader(http.StatusPartialContent)
+		} else {
+			w.Header().Set(CHECKSUM_HEADER, f.checksum)
+			w.WriteHeader(http.StatusOK)
+		}
+		if _, err := io.Copy(w, io.NewSectionReader(file, start, end-start)); err != nil {
+			httpError(w, errorCode(err), "Failed to send file: "+err.Error(), http.StatusInternalServerError)
 		}
 
 		return
@@ -1098,25 +1518,29 @@ func (fs *FileServer) httpHandleAppend(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "Missing localfilename or HyDFSfilename in request", http.StatusBadRequest)
 			return
 		}
+		if hydfs, err = normalizeName(hydfs); err != nil {
+			httpError(w, errorCode(err), "Rejected, "+err.Error(), http.StatusBadRequest)
+			return
+		}
 
 		// Find out the primary server of the HyDFS file
-		fileID := hashKey(hydfs)
-		responsible_server_id := findServerByfileID(fs.aliveml.Alive_Ids(), fileID)
+		fileID := ring.Hash(hydfs)
+		responsible_server_id := fs.currentRing().Owner(fileID)
 		if responsible_server_id == -1 {
-			log.Println("Invalid findServerByfileID result in httpHandleAppend")
+			log.Println("Empty ring in httpHandleAppend")
 			http.Error(w, "Rejected due to server internal error", http.StatusBadRequest)
 			return
 		}
 
 		// Check if allowed to append
-		url := fmt.Sprintf("http://%s:%s/existfile?filename=%s&ftype=p", id_to_domain(responsible_server_id), HTTP_PORT, hydfs)
+		url := fmt.Sprintf("http://%s/existfile?filename=%s&ftype=p", fs.nodes.HTTPAddr(responsible_server_id), escapeName(hydfs))
 		req2, err := http.NewRequest(http.MethodGet, url, nil)
 		if err != nil {
 			http.Error(w, "Failed when checking file existence", http.StatusInternalServerError)
 			return
 		}
 
-		client := &http.Client{}
+		client := fs.newClient(0)
 		resp, err := client.Do(req2)
 		defer resp.Body.Close()
 
@@ -1137,50 +1561,95 @@ func (fs *FileServer) httpHandleAppend(w http.ResponseWriter, r *http.Request) {
 
 			fmt.Fprintf(w, "Authorized")
 		} else {
-			http.Error(w, "Rejected, file "+hydfs+" doesn't exist", http.StatusBadRequest)
+			httpError(w, CODE_NOT_EXIST, "Rejected, file "+hydfs+" doesn't exist", http.StatusBadRequest)
 		}
 		return
 	case http.MethodPut:
-		filename := r.URL.Query().Get("filename")
-		num := r.URL.Query().Get("num")
-		if filename == "" {
-			http.Error(w, "HyDFS Filename not specified", http.StatusBadRequest)
+		filename, err := normalizeName(r.URL.Query().Get("filename"))
+		if err != nil {
+			httpError(w, errorCode(err), "Rejected, "+err.Error(), http.StatusBadRequest)
 			return
 		}
-
-		// Read the file content from the request body
-		fileContent, err := io.ReadAll(r.Body)
+		num := r.URL.Query().Get("num")
+		quorum, err := parseQuorum(r.URL.Query().Get("w"))
 		if err != nil {
-			http.Error(w, "Failed to read file content from request", http.StatusInternalServerError)
+			httpError(w, errorCode(err), "Rejected, "+err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		fs.Mutex.Lock()
-		responsible_server_id := findServerByfileID(fs.aliveml.Alive_Ids(), hashKey(filename))
-		fs.Mutex.Unlock()
-
-		if num == "1" {
-			responsible_server_id = findSuccessors(responsible_server_id, fs.aliveml.Alive_Ids(), REP_NUM)[0]
+		ring_now := fs.currentRing()
+		responsible_server_id := ring_now.Owner(ring.Hash(filename))
+		if responsible_server_id == -1 {
+			http.Error(w, "Rejected due to server internal error", http.StatusInternalServerError)
+			return
 		}
 
-		if num == "2" {
-			responsible_server_id = findSuccessors(responsible_server_id, fs.aliveml.Alive_Ids(), REP_NUM)[1]
+		// The new blocks get the replication factor and the write quorum of the file
+		rf, meta, err := fs.fetchPrimary(responsible_server_id, filename)
+		if err != nil {
+			http.Error(w, "Failed when checking file existence", http.StatusInternalServerError)
+			return
+		}
+		if rf == -1 {
+			httpError(w, CODE_NOT_EXIST, "Rejected, file "+filename+" doesn't exist", http.StatusBadRequest)
+			return
 		}
 
-		if num == "3" {
-			responsible_server_id = findSuccessors(responsible_server_id, fs.aliveml.Alive_Ids(), REP_NUM)[2]
+		// num=k sends the append through the k-th replica, if the file has that many replicas. A chain starts at
+		// the primary.
+		if k, err := strconv.Atoi(num); err == nil && k > 0 && !fs.chained() {
+			if replicas := fileReplicas(ring_now, filename, rf); k < len(replicas) {
+				responsible_server_id = replicas[k]
+			}
 		}
 
-		// Create a new request to the external server
-		url := fmt.Sprintf("http://%s:%s/appending?filename=%s&timestamp=%s&init=true", id_to_domain(responsible_server_id), HTTP_PORT, filename, time.Now().Format(time.RFC3339Nano))
-		req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(fileContent))
+		// The content is stored as new blocks, and the append adds their lines to the block map
+		content := newHashingReader(r.Body)
+		blocks, err := fs.writeBlocks(filename, rf, fs.writeQuorum(meta, quorum, rf), content)
+		if errors.Is(err, errQuorum) {
+			log.Println("Failed to store the blocks of an append to "+filename, err)
+			httpError(w, CODE_QUORUM, "Failed, "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			log.Println("Failed to store the blocks of an append to "+filename, err)
+			http.Error(w, "Failed to store the blocks of the append", http.StatusInternalServerError)
+			return
+		}
+		if err := checkSum(requestChecksum(r), content.Sum()); err != nil {
+			log.Println("Rejected append to file "+filename, err)
+			httpError(w, errorCode(err), "Rejected, "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		var size int64
+		for _, blk := range blocks {
+			size += blk.size
+		}
+		// Appends are ordered by their client and its sequence numbers, see appendlog.go. A client without an id gets
+		// the one of the coordinator, whose appends are numbered in the order it receives them.
+		key := appendKey{client: r.URL.Query().Get("client")}
+		key.seq, _ = strconv.ParseUint(r.URL.Query().Get("seq"), 10, 64)
+		key.prev, _ = strconv.ParseUint(r.URL.Query().Get("prev"), 10, 64)
+		if key.client == "" {
+			key.client, key.seq, key.prev = "server-"+strconv.Itoa(fs.id), fs.append_seq.Add(1), 0
+		}
+		// The stamp is past the previous append of the client, given in after, whichever coordinator stamped it
+		after, _ := parseHLC(r.URL.Query().Get("after"))
+		key.stamp = fs.clock.update(after)
+		url := fmt.Sprintf("http://%s/appending?filename=%s&init=true&%s&%s", fs.nodes.HTTPAddr(responsible_server_id), escapeName(filename), appendKeyQuery(key), appendQuery(size, clientHost(r)))
+		if quorums := quorumQuery(quorum, 0); quorums != "" {
+			url += "&" + quorums
+		}
+		block_lines := formatBlockMap(blocks)
+		req, err := http.NewRequest(http.MethodPut, url, strings.NewReader(block_lines))
 		if err != nil {
 			http.Error(w, "Failed to create request to external server", http.StatusInternalServerError)
 			return
 		}
+		req.Header.Set(CHECKSUM_HEADER, stringChecksum(block_lines))
 
 		// Send the request
-		client := &http.Client{}
+		client := fs.newClient(0)
 		resp, err := client.Do(req)
 		if err != nil {
 			http.Error(w, "Failed to send request to external server", http.StatusInternalServerError)
@@ -1189,8 +1658,14 @@ func (fs *FileServer) httpHandleAppend(w http.ResponseWriter, r *http.Request) {
 		defer resp.Body.Close()
 
 		// Check if the external server responded successfully
+		w.Header().Set(ACKS_HEADER, resp.Header.Get(ACKS_HEADER))
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			body, _ := io.ReadAll(resp.Body)
+			httpError(w, resp.Header.Get(ERROR_HEADER), strings.TrimSpace(string(body)), resp.StatusCode)
+			return
+		}
 		if resp.StatusCode != http.StatusOK {
-			http.Error(w, "External server error: "+resp.Status, resp.StatusCode)
+			httpError(w, resp.Header.Get(ERROR_HEADER), "External server error: "+resp.Status, resp.StatusCode)
 			return
 		}
 
@@ -1198,7 +1673,9 @@ func (fs *FileServer) httpHandleAppend(w http.ResponseWriter, r *http.Request) {
 		fs.Mutex.Lock()
 		delete(fs.coord_append_queue, filename)
 		fs.Mutex.Unlock()
-		fmt.Fprint(w, "File uploaded to external server successfully")
+		// The client sends the timestamp with its next append, whichever coordinator gets it
+		w.Header().Set("Append-Timestamp", key.stamp.String())
+		fmt.Fprint(w, "File uploaded to external server successfully, "+resp.Header.Get(ACKS_HEADER)+" copies acknowledged")
 		return
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -1209,24 +1686,61 @@ func (fs *FileServer) httpHandleStoredfilenames(w http.ResponseWriter, r *http.R
 	switch r.Method {
 	case http.MethodGet:
 		ftype := r.URL.Query().Get("ftype")
+		// Optional, only list the files whose names start with prefix
+		prefix := r.URL.Query().Get("prefix")
+		// Optional, only list the files that should be replicated on this server
+		replica, err := strconv.Atoi(r.URL.Query().Get("replica"))
+		if err != nil {
+			replica = -1
+		}
 
-		var file_list map[string]File
+		ring_now := fs.currentRing()
+		// The server asking is alive, even if its join hasn't reached this server yet
+		if replica != -1 && !containsId(ring_now.Members(), replica) {
+			ring_now = ring.New(append(ring_now.Members(), replica), fs.config.VNodes)
+		}
+		keys := make([]string, 0)
+		versions := storedVersions{Files: make(map[string]int), Tombstones: make(map[string]storedTombstone)}
 		fs.Mutex.Lock()
+		// Both primaries and replicas without an ftype
+		file_lists := []map[string]File{fs.p_files, fs.r_files}
 		if ftype == "p" {
-			file_list = fs.p_files
-		} else {
-			file_list = fs.r_files
+			file_lists = file_lists[:1]
+		} else if ftype == "r" {
+			file_lists = file_lists[1:]
+		}
+		for _, file_list := range file_lists {
+			for key, f := range file_list {
+				if !strings.HasPrefix(key, prefix) {
+					continue
+				}
+				if replica == -1 {
+					keys = append(keys, key)
+				} else if containsId(fileReplicas(ring_now, key, f.rf), replica) {
+					versions.Files[key] = f.version
+				}
+			}
+		}
+		if replica != -1 {
+			for key, t := range fs.tombstones {
+				if containsId(fileReplicas(ring_now, key, t.rf), replica) {
+					versions.Tombstones[key] = storedTombstone{Version: t.version, RF: t.rf}
+				}
+			}
 		}
 		fs.Mutex.Unlock()
 
-		keys := make([]string, 0, len(file_list))
-		for key := range file_list {
-			keys = append(keys, key)
+		// A server looking for the files it should replicate also needs their versions, and the deleted ones
+		if replica != -1 {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(versions)
+			return
 		}
 
-		filenameString := strings.Join(keys, " ")
-
-		w.Write([]byte(filenameString))
+		// Names may contain any character, the list is in JSON too
+		sort.Strings(keys)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(keys)
 
 		return
 	default:
@@ -1246,31 +1760,37 @@ func (fs *FileServer) httpHandleStore(w http.ResponseWriter, r *http.Request) {
 		for _, i := range alive_ids {
 			response_string += "vm id " + strconv.Itoa(i) + ":\n"
 
-			url := fmt.Sprintf("http://%s:%s/storedfilenames?ftype=p", id_to_domain(i), HTTP_PORT)
+			url := fmt.Sprintf("http://%s/storedfilenames?ftype=p", fs.nodes.HTTPAddr(i))
 			req, err := http.NewRequest(http.MethodGet, url, nil)
 			if err != nil {
 				http.Error(w, "Failed when getting filenames", http.StatusInternalServerError)
 				return
 			}
-			client := &http.Client{}
+			client := fs.newClient(0)
 			resp, err := client.Do(req)
+			if err != nil {
+				response_string += "unreachable\n"
+				continue
+			}
 			defer resp.Body.Close()
 
-			body, _ := io.ReadAll(resp.Body)
-			response_string += "primaries: " + string(body) + "\n"
+			response_string += "primaries: " + quotedNames(resp.Body) + "\n"
 
-			url2 := fmt.Sprintf("http://%s:%s/storedfilenames?ftype=r", id_to_domain(i), HTTP_PORT)
+			url2 := fmt.Sprintf("http://%s/storedfilenames?ftype=r", fs.nodes.HTTPAddr(i))
 			req2, err := http.NewRequest(http.MethodGet, url2, nil)
 			if err != nil {
 				http.Error(w, "Failed when getting filenames", http.StatusInternalServerError)
 				return
 			}
-			client2 := &http.Client{}
+			client2 := fs.newClient(0)
 			resp2, err := client2.Do(req2)
+			if err != nil {
+				response_string += "replicas: unreachable\n"
+				continue
+			}
 			defer resp2.Body.Close()
 
-			body2, _ := io.ReadAll(resp2.Body)
-			response_string += "replicas: " + string(body2) + "\n"
+			response_string += "replicas: " + quotedNames(resp2.Body) + "\n"
 		}
 
 		w.Write([]byte(response_string))
@@ -1297,46 +1817,17 @@ func (fs *FileServer) httpHandleMerging(w http.ResponseWriter, r *http.Request)
 		fs.Mutex.Unlock()
 
 		if f != nil {
-			if len(f.cache) == 0 {
-				w.WriteHeader(http.StatusOK)
-				return
-			}
-
-			// Acquire write lock since we'll clear the cache after merging
-			f.Mutex.Lock()
-			defer f.Mutex.Unlock()
-
-			// Extract and sort timestamps
-			timestamps := make([]time.Time, 0, len(f.cache))
-			for t := range f.cache {
-				timestamps = append(timestamps, t)
+			merged, err := fs.mergeCache(f)
+			if merged > 0 {
+				fs.saveCatalog(filename)
 			}
-			sort.Slice(timestamps, func(i, j int) bool {
-				return timestamps[i].Before(timestamps[j])
-			})
-
-			// Open the file for appending
-			file, err := os.OpenFile(FILE_PATH_PREFIX+f.filename, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
 			if err != nil {
-				log.Println("Merging failed, couldn't open file " + f.filename)
+				log.Println("Merging failed for file "+f.filename, err)
 				http.Error(w, "Internal server error", http.StatusInternalServerError)
 				return
 			}
-			defer file.Close()
-
-			// Append contents in order of timestamps
-			for _, t := range timestamps {
-				content := f.cache[t]
-				if _, err := file.WriteString(content); err != nil {
-					log.Println("Merging failed, couldn't write to file " + f.filename)
-					http.Error(w, "Internal server error", http.StatusInternalServerError)
-					return
-				}
-				delete(f.cache, t)
-			}
-
 		} else {
-			http.Error(w, "Rejected, file "+filename+" doesn't exist", http.StatusBadRequest)
+			httpError(w, CODE_NOT_EXIST, "Rejected, file "+filename+" doesn't exist", http.StatusBadRequest)
 			return
 		}
 
@@ -1348,64 +1839,434 @@ func (fs *FileServer) httpHandleMerging(w http.ResponseWriter, r *http.Request)
 	}
 }
 
+// Append the cached appends of a file to its content in the order of their keys, returning how many were merged
+func (fs *FileServer) mergeCache(f *File) (int, error) {
+	// Acquire write lock since we'll clear the cache after merging
+	f.Mutex.Lock()
+	defer f.Mutex.Unlock()
+
+	if len(f.cache) == 0 {
+		return 0, nil
+	}
+
+	// Appends waiting for an earlier one of their client stay in the cache
+	fs.Mutex.RLock()
+	stored, exist := fs.p_files[f.filename]
+	if !exist {
+		stored = fs.r_files[f.filename]
+	}
+	fs.Mutex.RUnlock()
+	keys := readyAppends(f.cache, stored.meta.Applied, time.Now())
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	// Open the file for appending
+	file, err := os.OpenFile(fs.file_dir+diskName(f.filename), os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	appends, err := os.Open(fs.appendLogPath(f.filename))
+	if err != nil {
+		return 0, err
+	}
+	defer appends.Close()
+
+	// Append contents in the order of their keys, copying them from the append log
+	merged := 0
+	for _, k := range keys {
+		a := f.cache[k]
+		if _, err := io.Copy(file, io.NewSectionReader(appends, a.offset, a.size)); err != nil {
+			break
+		}
+		delete(f.cache, k)
+		merged++
+	}
+	if err = file.Sync(); err == nil && merged < len(keys) {
+		err = fmt.Errorf("only %d of %d appends written", merged, len(keys))
+	}
+
+	// Only the appends left in the cache stay in the log
+	if logErr := fs.rewriteAppendLog(f.filename, f.cache); logErr != nil {
+		log.Println("Failed to rewrite the append log of "+f.filename, logErr)
+	}
+
+	// Each merged append is a write, replicas merging the same appends reach the same version. The entry is
+	// updated under the lock of the file, so that the content is never read against the checksum of the old one.
+	content_size := fs.contentSize(f.filename)
+	fs.Mutex.Lock()
+	for _, files := range []map[string]File{fs.p_files, fs.r_files} {
+		if file, exist := files[f.filename]; exist && file.Mutex == f.Mutex && merged > 0 {
+			file.version += merged
+			file.meta.Merged = time.Now()
+			fs.digest(&file)
+			file.meta = fs.withVersion(file.meta, fileVersion{Version: file.version, Time: file.meta.Merged, Size: content_size, MapSize: file.size})
+			file.meta = file.meta.withApplied(keys[:merged])
+			files[f.filename] = file
+		}
+	}
+	fs.Mutex.Unlock()
+	return merged, err
+}
+
 func (fs *FileServer) httpHandleMerge(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
-		filename := r.URL.Query().Get("filename")
+		filename, err := normalizeName(r.URL.Query().Get("filename"))
+		if err != nil {
+			httpError(w, errorCode(err), "Rejected, "+err.Error(), http.StatusBadRequest)
+			return
+		}
 
 		fs.Mutex.Lock()
 		alive_ids := fs.aliveml.Alive_Ids()
 		fs.Mutex.Unlock()
 
-		p_server := findServerByfileID(alive_ids, hashKey(filename))
+		ring_now := ring.New(alive_ids, fs.config.VNodes)
+		p_server := ring_now.Owner(ring.Hash(filename))
+		if p_server == -1 {
+			http.Error(w, "Rejected due to server internal error", http.StatusInternalServerError)
+			return
+		}
+
+		// Every replica of the file is merged, how many there are depends on its replication factor
+		rf, err := fs.fetchRF(p_server, filename)
+		if err != nil {
+			httpError(w, errorCode(err), "Failed when checking file existence"+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if rf == -1 {
+			httpError(w, CODE_NOT_EXIST, "Rejected, file "+filename+" doesn't exist", http.StatusBadRequest)
+			return
+		}
+		replicas := fileReplicas(ring_now, filename, rf)
 
-		url := fmt.Sprintf("http://%s:%s/merging?filename=%s", id_to_domain(p_server), HTTP_PORT, filename)
+		url := fmt.Sprintf("http://%s/merging?filename=%s", fs.nodes.HTTPAddr(p_server), escapeName(filename))
 		req, err := http.NewRequest(http.MethodGet, url, nil)
 		if err != nil {
-			http.Error(w, "Failed to create request to external server"+err.Error(), http.StatusInternalServerError)
+			httpError(w, errorCode(err), "Failed to create request to external server"+err.Error(), http.StatusInternalServerError)
 			return
 		}
 
 		// Send the request
-		client := &http.Client{}
+		client := fs.newClient(0)
 		resp, err := client.Do(req)
 		if err != nil {
-			http.Error(w, "Failed to send request to external server"+err.Error(), http.StatusInternalServerError)
+			httpError(w, errorCode(err), "Failed to send request to external server"+err.Error(), http.StatusInternalServerError)
 			return
 		}
 		defer resp.Body.Close()
 
 		// Check if the external server responded successfully
 		if resp.StatusCode != http.StatusOK {
-			http.Error(w, "External server error: "+resp.Status, resp.StatusCode)
+			httpError(w, resp.Header.Get(ERROR_HEADER), "External server error: "+resp.Status, resp.StatusCode)
 			return
 		}
 
-		for _, i := range findSuccessors(p_server, alive_ids, REP_NUM) {
-			url := fmt.Sprintf("http://%s:%s/merging?filename=%s", id_to_domain(i), HTTP_PORT, filename)
+		for _, i := range replicas[1:] {
+			url := fmt.Sprintf("http://%s/merging?filename=%s", fs.nodes.HTTPAddr(i), escapeName(filename))
 			req, err := http.NewRequest(http.MethodGet, url, nil)
 			if err != nil {
-				http.Error(w, "Failed to create request to external server"+err.Error(), http.StatusInternalServerError)
+				httpError(w, errorCode(err), "Failed to create request to external server"+err.Error(), http.StatusInternalServerError)
 				return
 			}
 
 			// Send the request
-			client := &http.Client{}
+			client := fs.newClient(0)
 			resp, err := client.Do(req)
 			if err != nil {
-				http.Error(w, "Failed to send request to external server"+err.Error(), http.StatusInternalServerError)
+				httpError(w, errorCode(err), "Failed to send request to external server"+err.Error(), http.StatusInternalServerError)
 				return
 			}
 			defer resp.Body.Close()
 
 			// Check if the external server responded successfully
 			if resp.StatusCode != http.StatusOK {
-				http.Error(w, "External server error: "+resp.Status, resp.StatusCode)
+				httpError(w, resp.Header.Get(ERROR_HEADER), "External server error: "+resp.Status, resp.StatusCode)
+				return
+			}
+		}
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Delete a file from its primary and replicas, then its blocks. The servers keep tombstones, see tombstone.go.
+func (fs *FileServer) httpHandleDelete(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodDelete:
+		// A directory is deleted once it is empty, its name ends with "/"
+		filename := r.URL.Query().Get("filename")
+		var err error
+		if strings.HasSuffix(filename, DIR_SEPARATOR) {
+			filename, err = normalizeDir(filename)
+			if err == nil && filename == "" {
+				err = fmt.Errorf("%w: the root directory can't be deleted", errName)
+			}
+		} else {
+			filename, err = normalizeName(filename)
+		}
+		if err != nil {
+			httpError(w, errorCode(err), "Rejected, "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if strings.HasSuffix(filename, DIR_SEPARATOR) {
+			names, err := fs.findNames(filename)
+			if err != nil {
+				httpError(w, errorCode(err), "Failed when listing the directory: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if len(dirEntries(filename, names)) > 0 {
+				http.Error(w, "Rejected, directory "+filename+" isn't empty", http.StatusBadRequest)
+				return
+			}
+		}
+
+		ring_now := fs.currentRing()
+		p_server := ring_now.Owner(ring.Hash(filename))
+		if p_server == -1 {
+			http.Error(w, "Rejected due to server internal error", http.StatusInternalServerError)
+			return
+		}
+
+		// The primary deletes the block map and its replicas, and answers with the blocks it referred to
+		url := fmt.Sprintf("http://%s/deleting?filename=%s&ftype=p", fs.nodes.HTTPAddr(p_server), escapeName(filename))
+		req, _ := http.NewRequest(http.MethodDelete, url, nil)
+		client := fs.newClient(0)
+		resp, err := client.Do(req)
+		if err != nil {
+			httpError(w, errorCode(err), "Failed to send request to external server"+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(resp.Body)
+			httpError(w, resp.Header.Get(ERROR_HEADER), strings.TrimSpace(string(body)), resp.StatusCode)
+			return
+		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			httpError(w, errorCode(err), "Failed to read the blocks of the file"+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// The file is gone once its block map is, blocks left behind only take space
+		for _, name := range strings.Split(string(body), "\n") {
+			if name == "" {
+				continue
+			}
+			url := fmt.Sprintf("http://%s/deleting?filename=%s&ftype=p", fs.nodes.HTTPAddr(ring_now.Owner(ring.Hash(name))), escapeName(name))
+			req, _ := http.NewRequest(http.MethodDelete, url, nil)
+			resp, err := fs.newClient(0).Do(req)
+			if err != nil {
+				log.Println("Failed to delete block "+name, err)
+				continue
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				log.Println("Failed to delete block " + name + ": " + resp.Status)
+			}
+		}
+
+		fmt.Fprint(w, "File "+filename+" deleted")
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Delete a stored file and leave its tombstone, a primary passes the delete on to the replicas
+func (fs *FileServer) httpHandleDeleting(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodDelete:
+		filename := r.URL.Query().Get("filename")
+		ftype := r.URL.Query().Get("ftype")
+		if filename == "" {
+			http.Error(w, "Filename not specified", http.StatusBadRequest)
+			return
+		}
+		// Replicas are told the version the primary deleted, they may have missed some of it
+		version := 0
+		if r.URL.Query().Get("version") != "" {
+			version = parseVersion(r.URL.Query().Get("version"))
+		}
+
+		// A replica missing the file still keeps the tombstone, it may get the file from a server that missed the delete
+		f, exists := fs.storedFile(filename, "")
+		if !exists && ftype == "p" {
+			httpError(w, CODE_NOT_EXIST, "Rejected, file "+filename+" doesn't exist", http.StatusBadRequest)
+			return
+		}
+		rf := f.rf
+		if !exists {
+			var err error
+			if rf, err = fs.parseRF(r.URL.Query().Get("rf")); err != nil {
+				httpError(w, errorCode(err), "Rejected, "+err.Error(), http.StatusBadRequest)
 				return
 			}
 		}
 
+		blocks, t := fs.deleteFile(filename, rf, version)
+		fs.saveCatalog(filename)
+
+		if ftype == "p" {
+			fs.deleteReplicas(filename, t)
+		}
+
+		fmt.Fprint(w, strings.Join(blocks, "\n"))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Pass the delete of a primary file on to its replicas
+func (fs *FileServer) deleteReplicas(filename string, t tombstone) {
+	for _, i := range fileReplicas(fs.currentRing(), filename, t.rf) {
+		if i == fs.id {
+			continue
+		}
+		url := fmt.Sprintf("http://%s/deleting?filename=%s&ftype=r&rf=%d&version=%d", fs.nodes.HTTPAddr(i), escapeName(filename), t.rf, t.version)
+		req, _ := http.NewRequest(http.MethodDelete, url, nil)
+		resp, err := fs.newClient(0).Do(req)
+		if err != nil {
+			log.Println("Failed to delete file "+filename+" from server", i, err)
+			continue
+		}
+		resp.Body.Close()
+	}
+}
+
+// Rename a file, checking that the old name exists and the new one doesn't. The primary of the old name does the move.
+func (fs *FileServer) httpHandleRename(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		filename, err := normalizeName(r.URL.Query().Get("filename"))
+		if err != nil {
+			httpError(w, errorCode(err), "Rejected, "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		newname, err := normalizeName(r.URL.Query().Get("newname"))
+		if err != nil {
+			httpError(w, errorCode(err), "Rejected, "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if filename == newname {
+			httpError(w, CODE_EXISTS, "Rejected, file "+newname+" already exists", http.StatusBadRequest)
+			return
+		}
+
+		ring_now := fs.currentRing()
+		p_server := ring_now.Owner(ring.Hash(filename))
+		if p_server == -1 {
+			http.Error(w, "Rejected due to server internal error", http.StatusInternalServerError)
+			return
+		}
+		rf, err := fs.fetchRF(p_server, filename)
+		if err != nil {
+			httpError(w, errorCode(err), "Failed when checking file existence"+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if rf == -1 {
+			httpError(w, CODE_NOT_EXIST, "Rejected, file "+filename+" doesn't exist", http.StatusBadRequest)
+			return
+		}
+		rf, err = fs.fetchRF(ring_now.Owner(ring.Hash(newname)), newname)
+		if err != nil {
+			httpError(w, errorCode(err), "Failed when checking file existence"+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if rf != -1 {
+			httpError(w, CODE_EXISTS, "Rejected, file "+newname+" already exists", http.StatusBadRequest)
+			return
+		}
+
+		url := fmt.Sprintf("http://%s/renaming?filename=%s&newname=%s", fs.nodes.HTTPAddr(p_server), escapeName(filename), escapeName(newname))
+		req, _ := http.NewRequest(http.MethodPost, url, nil)
+		resp, err := fs.newClient(0).Do(req)
+		if err != nil {
+			httpError(w, errorCode(err), "Failed to send request to external server"+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			httpError(w, resp.Header.Get(ERROR_HEADER), strings.TrimSpace(string(body)), resp.StatusCode)
+			return
+		}
+		w.Write(body)
 	default:
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 	}
 }
+
+// Move a primary file to the primary of its new name, with its pending appends, and delete it under the old name.
+// The file stays locked all along, so no append or merge happens in between and none is lost.
+func (fs *FileServer) httpHandleRenaming(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		filename := r.URL.Query().Get("filename")
+		newname := r.URL.Query().Get("newname")
+
+		f, exists, unlock := fs.lockFile(filename, "p", true)
+		if !exists {
+			unlock()
+			httpError(w, CODE_NOT_EXIST, "Rejected, file "+filename+" doesn't exist", http.StatusBadRequest)
+			return
+		}
+		if err := fs.copyFile(f, newname); errors.Is(err, errExists) {
+			unlock()
+			httpError(w, CODE_EXISTS, "Rejected, file "+newname+" already exists", http.StatusBadRequest)
+			return
+		} else if err != nil {
+			unlock()
+			log.Println("Failed to rename file "+filename+" to "+newname, err)
+			http.Error(w, "Failed to copy the file to its new name", http.StatusInternalServerError)
+			return
+		}
+		// The blocks now belong to the new name
+		_, t := fs.buryFile(filename, f, true, f.rf, 0)
+		unlock()
+		fs.saveCatalog(filename, newname)
+		fs.deleteReplicas(filename, t)
+
+		fmt.Fprint(w, "File "+filename+" renamed to "+newname)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Create a locked primary file under another name, unless a file has it already, then append its pending appends with
+// their keys. The copy is deleted again if any of them fails.
+func (fs *FileServer) copyFile(f File, newname string) error {
+	p_server := fs.currentRing().Owner(ring.Hash(newname))
+	file, err := os.Open(fs.file_dir + diskName(f.filename))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// A renamed file keeps its metadata, where the pending appends are recorded already
+	url := fmt.Sprintf("http://%s/creating?filename=%s&ftype=p&exclusive=true&rf=%d&%s", fs.nodes.HTTPAddr(p_server), escapeName(newname), f.rf, metaQuery(f.meta))
+	if err := fs.putChecksum(url, io.LimitReader(file, f.size), func() string { return f.checksum }); err != nil {
+		return err
+	}
+	for _, k := range sortedAppends(f.cache) {
+		url := fmt.Sprintf("http://%s/appending?filename=%s&init=true&%s", fs.nodes.HTTPAddr(p_server), escapeName(newname), appendKeyQuery(k))
+		content, err := fs.openAppend(f.filename, f.cache[k])
+		if err == nil {
+			err = fs.put(url, content)
+			content.Close()
+		}
+		if err != nil {
+			url := fmt.Sprintf("http://%s/deleting?filename=%s&ftype=p", fs.nodes.HTTPAddr(p_server), escapeName(newname))
+			req, _ := http.NewRequest(http.MethodDelete, url, nil)
+			if resp, err := fs.newClient(0).Do(req); err == nil {
+				resp.Body.Close()
+			}
+			return err
+		}
+	}
+	return nil
+}
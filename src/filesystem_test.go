@@ -0,0 +1,419 @@
+package main
+
+import (
+	"HyDFS/client"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCreateReplicatesToReplicationFactor(t *testing.T) {
+	c := newTestCluster(t, 5)
+	cl := c.Client()
+
+	c.mustCreate(cl, "scratch.txt", "scratch", 1)
+	c.mustCreate(cl, "default.txt", "default", 0)
+	c.mustCreate(cl, "critical.txt", "critical", 4)
+	c.WaitReplicas(5 * time.Second)
+
+	for name, rf := range map[string]int{"scratch.txt": 1, "default.txt": c.config.DefaultRF, "critical.txt": 4} {
+		if holders := c.holders(name); len(holders) != rf {
+			t.Errorf("%s is stored on %v, expected %d servers", name, holders, rf)
+		}
+	}
+	if got := c.mustGet(cl, "critical.txt"); got != "critical" {
+		t.Errorf("Get critical.txt = %q", got)
+	}
+
+	err := cl.Create("default.txt", strings.NewReader("again"), 0)
+	if !errors.Is(err, client.ErrExists) {
+		t.Errorf("Create of an existing file returned %v, expected ErrExists", err)
+	}
+	err = cl.Get("missing.txt", &strings.Builder{})
+	if !errors.Is(err, client.ErrNotExist) {
+		t.Errorf("Get of a missing file returned %v, expected ErrNotExist", err)
+	}
+}
+
+func TestFailureRestoresReplicas(t *testing.T) {
+	c := newTestCluster(t, 5)
+	cl := c.Client()
+
+	c.mustCreate(cl, "file.txt", "hello", 3)
+	c.WaitReplicas(5 * time.Second)
+
+	// Losing the primary promotes a replica, and a new server joins the replica set
+	primary := c.holders("file.txt")[0]
+	c.Kill(primary)
+	c.WaitMembership(10 * time.Second)
+	c.WaitReplicas(10 * time.Second)
+
+	if holders := c.holders("file.txt"); len(holders) != 3 {
+		t.Errorf("file.txt is stored on %v after the failure of %d", holders, primary)
+	}
+	if got := c.mustGet(cl, "file.txt"); got != "hello" {
+		t.Errorf("Get file.txt = %q after the failure of %d", got, primary)
+	}
+}
+
+func TestPartitionedNodeIsReplaced(t *testing.T) {
+	c := newTestCluster(t, 5)
+	cl := c.Client()
+
+	c.mustCreate(cl, "file.txt", "hello", 2)
+	c.WaitReplicas(5 * time.Second)
+
+	replica := c.holders("file.txt")[1]
+	c.Partition(replica)
+	c.WaitMembership(10 * time.Second)
+	c.WaitReplicas(10 * time.Second)
+
+	if got := c.mustGet(c.Client(), "file.txt"); got != "hello" {
+		t.Errorf("Get file.txt = %q while %d is partitioned", got, replica)
+	}
+}
+
+func TestAppendAndMerge(t *testing.T) {
+	c := newTestCluster(t, 4)
+	cl := c.Client()
+
+	c.mustCreate(cl, "log.txt", "a", 0)
+	c.WaitReplicas(5 * time.Second)
+	for _, s := range []string{"b", "c"} {
+		if err := cl.Append("log.txt", strings.NewReader(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cl.Merge("log.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.mustGet(cl, "log.txt"); got != "abc" {
+		t.Errorf("Get log.txt = %q after merge", got)
+	}
+}
+
+func TestAppendsOfEachClientStayInOrder(t *testing.T) {
+	c := newTestCluster(t, 4)
+	c.mustCreate(c.Client(), "log.txt", "", 3)
+	c.WaitReplicas(5 * time.Second)
+
+	// Two clients append at once through different coordinators
+	errs := make(chan error, 2)
+	for id, name := range map[int]string{1: "a", 2: "b"} {
+		cl := client.New([]string{c.nodes.HTTPAddr(id)})
+		go func(name string) {
+			for i := 0; i < 10; i++ {
+				if err := cl.Append("log.txt", strings.NewReader(fmt.Sprintf("%s%d ", name, i))); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}(name)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	cl := c.Client()
+	if err := cl.Merge("log.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	got := c.mustGet(cl, "log.txt")
+	next := map[byte]int{'a': 0, 'b': 0}
+	for _, s := range strings.Fields(got) {
+		if s != fmt.Sprintf("%c%d", s[0], next[s[0]]) {
+			t.Fatalf("Get log.txt = %q, %s out of order", got, s)
+		}
+		next[s[0]]++
+	}
+	if next['a'] != 10 || next['b'] != 10 {
+		t.Errorf("Get log.txt = %q, expected 10 appends of each client", got)
+	}
+	// Every replica merged the appends in the same order
+	holders := c.holders("log.txt")
+	for _, id := range holders[1:] {
+		if c.content(id, "log.txt") != c.content(holders[0], "log.txt") {
+			t.Errorf("Replica %d differs from the primary %d", id, holders[0])
+		}
+	}
+}
+
+func TestRenameKeepsPendingAppends(t *testing.T) {
+	c := newTestCluster(t, 4)
+	cl := c.Client()
+
+	c.mustCreate(cl, "old.txt", "hello", 2)
+	c.mustCreate(cl, "taken.txt", "taken", 2)
+	if err := cl.Append("old.txt", strings.NewReader(" world")); err != nil {
+		t.Fatal(err)
+	}
+	c.WaitReplicas(5 * time.Second)
+
+	if err := cl.Rename("old.txt", "taken.txt"); !errors.Is(err, client.ErrExists) {
+		t.Errorf("Rename to an existing file returned %v, expected ErrExists", err)
+	}
+	if err := cl.Rename("old.txt", "new.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Get("old.txt", &strings.Builder{}); !errors.Is(err, client.ErrNotExist) {
+		t.Errorf("Get of the old name returned %v, expected ErrNotExist", err)
+	}
+	if err := cl.Rename("old.txt", "other.txt"); !errors.Is(err, client.ErrNotExist) {
+		t.Errorf("Rename of the old name returned %v, expected ErrNotExist", err)
+	}
+	if holders := c.holders("new.txt"); len(holders) != 2 {
+		t.Errorf("new.txt is stored on %v, expected 2 servers", holders)
+	}
+	// The append was still pending, it comes with the file
+	if err := cl.Merge("new.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.mustGet(cl, "new.txt"); got != "hello world" {
+		t.Errorf("Get new.txt = %q after the rename", got)
+	}
+}
+
+func TestRenameRacingCreate(t *testing.T) {
+	c := newTestCluster(t, 4)
+	cl := c.Client()
+
+	// Whichever of the rename and the create takes the new name first, the other one fails instead of replacing it
+	for i := 0; i < 10; i++ {
+		oldname, newname := fmt.Sprintf("old%d.txt", i), fmt.Sprintf("new%d.txt", i)
+		c.mustCreate(cl, oldname, "renamed", 2)
+		var renameErr, createErr error
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			renameErr = c.Client().Rename(oldname, newname)
+		}()
+		go func() {
+			defer wg.Done()
+			createErr = c.Client().Create(newname, strings.NewReader("created"), 2)
+		}()
+		wg.Wait()
+
+		switch {
+		case renameErr == nil && errors.Is(createErr, client.ErrExists):
+			if got := c.mustGet(cl, newname); got != "renamed" {
+				t.Errorf("Get %s = %q after the rename won", newname, got)
+			}
+		case createErr == nil && errors.Is(renameErr, client.ErrExists):
+			if got := c.mustGet(cl, newname); got != "created" {
+				t.Errorf("Get %s = %q after the create won", newname, got)
+			}
+			if got := c.mustGet(cl, oldname); got != "renamed" {
+				t.Errorf("Get %s = %q after its rename failed", oldname, got)
+			}
+		default:
+			t.Fatalf("rename returned %v and create %v, expected one of them to fail with ErrExists", renameErr, createErr)
+		}
+	}
+}
+
+func TestFileIsSplitIntoBlocks(t *testing.T) {
+	c := newTestCluster(t, 4)
+	cl := c.Client()
+
+	data := make([]byte, 2*testBlockSize+testBlockSize/2)
+	rand.New(rand.NewSource(1)).Read(data)
+	if err := cl.Create("blocks.bin", bytes.NewReader(data[:2*testBlockSize+1]), 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Append("blocks.bin", bytes.NewReader(data[2*testBlockSize+1:])); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Merge("blocks.bin"); err != nil {
+		t.Fatal(err)
+	}
+	c.WaitReplicas(5 * time.Second)
+
+	if got := c.mustGet(cl, "blocks.bin"); got != string(data) {
+		t.Errorf("Get blocks.bin returned %d bytes other than created and appended", len(got))
+	}
+	// Three blocks for the create, one for the append, each of them stored like a file with the rf of blocks.bin
+	blocks, err := parseBlockMap(strings.NewReader(c.content(c.holders("blocks.bin")[0], "blocks.bin")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 4 {
+		t.Fatalf("blocks.bin has %d blocks, expected 4", len(blocks))
+	}
+	for _, blk := range blocks {
+		if holders := c.holders(blk.name); len(holders) != 2 {
+			t.Errorf("Block %s is stored on %v", blk.name, holders)
+		}
+	}
+	out, err := cl.Ls("blocks.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "4 blocks") || !strings.Contains(out, blocks[3].name) {
+		t.Errorf("ls blocks.bin doesn't list its blocks:\n%s", out)
+	}
+}
+
+func TestGetRange(t *testing.T) {
+	c := newTestCluster(t, 4)
+	cl := c.Client()
+
+	data := make([]byte, 2*testBlockSize+100)
+	rand.New(rand.NewSource(1)).Read(data)
+	if err := cl.Create("range.bin", bytes.NewReader(data), 2); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range []struct{ offset, length, end int64 }{
+		{testBlockSize - 10, 20, testBlockSize + 10},  // Across two blocks
+		{10, 0, int64(len(data))},                     // To the end of the file
+		{int64(len(data)) - 5, 100, int64(len(data))}, // Past the end of the file
+	} {
+		var b bytes.Buffer
+		size, err := cl.GetRange("range.bin", r.offset, r.length, &b)
+		if err != nil {
+			t.Fatalf("Get %d bytes at %d: %s", r.length, r.offset, err)
+		}
+		if size != int64(len(data)) {
+			t.Errorf("Get %d bytes at %d: file size %d, expected %d", r.length, r.offset, size, len(data))
+		}
+		if !bytes.Equal(b.Bytes(), data[r.offset:r.end]) {
+			t.Errorf("Get %d bytes at %d returned %d other bytes", r.length, r.offset, b.Len())
+		}
+	}
+	if _, err := cl.GetRange("range.bin", int64(len(data)), 1, io.Discard); !errors.Is(err, client.ErrRange) {
+		t.Errorf("Get past the end of the file: %v, expected ErrRange", err)
+	}
+}
+
+func TestRestartedNodeRejoins(t *testing.T) {
+	c := newTestCluster(t, 4)
+	cl := c.Client()
+
+	c.mustCreate(cl, "file.txt", "hello", 2)
+	c.WaitReplicas(5 * time.Second)
+
+	// The introducer restarts with an empty membership list, restart another holder
+	holder := c.holders("file.txt")[0]
+	if holder == 1 {
+		holder = c.holders("file.txt")[1]
+	}
+	c.Kill(holder)
+	c.WaitMembership(10 * time.Second)
+	c.WaitReplicas(10 * time.Second)
+	c.Start(holder)
+	c.WaitJoined(holder, 5*time.Second)
+	c.WaitMembership(10 * time.Second)
+	c.WaitReplicas(10 * time.Second)
+
+	if holders := c.holders("file.txt"); len(holders) != 2 {
+		t.Errorf("file.txt is stored on %v after the restart of %d", holders, holder)
+	}
+	if got := c.mustGet(c.Client(), "file.txt"); got != "hello" {
+		t.Errorf("Get file.txt = %q after the restart of %d", got, holder)
+	}
+}
+
+func TestRestartedNodePullsOnlyStaleFiles(t *testing.T) {
+	c := newTestCluster(t, 4)
+	cl := c.Client()
+
+	// Every node stores both files
+	c.mustCreate(cl, "changed.txt", "a", 4)
+	c.mustCreate(cl, "unchanged.txt", "b", 4)
+	c.WaitReplicas(5 * time.Second)
+
+	c.Kill(3)
+	c.WaitMembership(10 * time.Second)
+	c.WaitReplicas(10 * time.Second)
+	cl = c.Client()
+	if err := cl.Append("changed.txt", strings.NewReader("c")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Merge("changed.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	pulled := len(c.Pulled(3))
+	c.Start(3)
+	c.WaitJoined(3, 5*time.Second)
+	c.WaitMembership(10 * time.Second)
+	c.WaitReplicas(10 * time.Second)
+
+	// Node 1 was up all along, node 3 should store the same block maps
+	c.waitFor("node 3 to catch up", 5*time.Second, func() error {
+		if got, expected := c.content(3, "changed.txt"), c.content(1, "changed.txt"); got != expected {
+			return fmt.Errorf("node 3 stores changed.txt as %q instead of %q", got, expected)
+		}
+		return nil
+	})
+	if got, expected := c.content(3, "unchanged.txt"), c.content(1, "unchanged.txt"); got != expected {
+		t.Errorf("node 3 stores unchanged.txt as %q instead of %q", got, expected)
+	}
+	for _, name := range c.Pulled(3)[pulled:] {
+		if strings.HasPrefix(name, "unchanged.txt") {
+			t.Errorf("node 3 pulled %s again after its restart", name)
+		}
+	}
+}
+
+func TestLargeFileIsStreamed(t *testing.T) {
+	const size = 64 << 20
+	c := newTestCluster(t, 4)
+	cl := c.Client()
+
+	// The heap is sampled while the file goes through a coordinator, a primary and two replicas
+	defer debug.SetGCPercent(debug.SetGCPercent(20))
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+	peak := uint64(0)
+	done := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		var m runtime.MemStats
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(20 * time.Millisecond):
+				runtime.ReadMemStats(&m)
+				if m.HeapAlloc > peak {
+					peak = m.HeapAlloc
+				}
+			}
+		}
+	}()
+
+	uploaded := sha256.New()
+	content := io.TeeReader(io.LimitReader(rand.New(rand.NewSource(1)), size), uploaded)
+	if err := cl.Create("large.bin", content, 3); err != nil {
+		t.Fatal(err)
+	}
+	downloaded := sha256.New()
+	if err := cl.Get("large.bin", downloaded); err != nil {
+		t.Fatal(err)
+	}
+	close(done)
+	<-sampled
+
+	if !bytes.Equal(uploaded.Sum(nil), downloaded.Sum(nil)) {
+		t.Errorf("Get large.bin returned other content than created")
+	}
+	if peak > before.HeapAlloc && peak-before.HeapAlloc > size/2 {
+		t.Errorf("The heap grew by %d MB for a %d MB file", (peak-before.HeapAlloc)>>20, size>>20)
+	}
+}
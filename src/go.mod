@@ -2,4 +2,4 @@ module HyDFS
 
 go 1.21.0
 
-require gopkg.in/yaml.v2 v2.4.0 // indirect
+require gopkg.in/yaml.v2 v2.4.0
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Servers order appends with a hybrid logical clock. A timestamp is the physical time in nanoseconds and a counter
+// ordering the events that share it. Every request between servers carries the clock of the sender in the HLC header,
+// and so does every response, and a server receiving a timestamp moves its clock past it. An append is therefore
+// stamped past everything its coordinator heard of before, however far behind its physical clock is, and an append
+// made after another was seen, by any client through any server, is merged after it.
+
+const HLC_HEADER = "HLC"
+
+type hlcTime struct {
+	wall    int64  // Physical time in nanoseconds since the epoch
+	logical uint32 // Events stamped at the same physical time
+}
+
+func (t hlcTime) before(o hlcTime) bool {
+	if t.wall != o.wall {
+		return t.wall < o.wall
+	}
+	return t.logical < o.logical
+}
+
+func (t hlcTime) isZero() bool {
+	return t.wall == 0 && t.logical == 0
+}
+
+// Physical time of a timestamp
+func (t hlcTime) Time() time.Time {
+	return time.Unix(0, t.wall).UTC()
+}
+
+// "wall.logical", which never contains a space
+func (t hlcTime) String() string {
+	return strconv.FormatInt(t.wall, 10) + "." + strconv.FormatUint(uint64(t.logical), 10)
+}
+
+func (t hlcTime) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+func (t *hlcTime) UnmarshalText(data []byte) error {
+	parsed, err := parseHLC(string(data))
+	*t = parsed
+	return err
+}
+
+// Timestamp written by String, the zero one for "". The RFC 3339 times of earlier servers have no logical part.
+func parseHLC(s string) (hlcTime, error) {
+	if s == "" {
+		return hlcTime{}, nil
+	}
+	wall, logical, found := strings.Cut(s, ".")
+	if !found || strings.ContainsAny(s, "-:") {
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return hlcTime{}, fmt.Errorf("invalid HLC timestamp %q", s)
+		}
+		return hlcTime{wall: t.UnixNano()}, nil
+	}
+	w, err1 := strconv.ParseInt(wall, 10, 64)
+	l, err2 := strconv.ParseUint(logical, 10, 32)
+	if err1 != nil || err2 != nil {
+		return hlcTime{}, fmt.Errorf("invalid HLC timestamp %q", s)
+	}
+	return hlcTime{wall: w, logical: uint32(l)}, nil
+}
+
+type hlc struct {
+	mu       sync.Mutex
+	last     hlcTime
+	physical func() int64 // Physical clock in nanoseconds, nil for the one of the host
+}
+
+func (c *hlc) physicalNow() int64 {
+	if c.physical != nil {
+		return c.physical()
+	}
+	return time.Now().UnixNano()
+}
+
+// Timestamp of a local event or of a message sent
+func (c *hlc) now() hlcTime {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if pt := c.physicalNow(); pt > c.last.wall {
+		c.last = hlcTime{wall: pt}
+	} else {
+		c.last.logical++
+	}
+	return c.last
+}
+
+// Timestamp of the receipt of a message stamped remote, past both remote and every earlier timestamp of the clock
+func (c *hlc) update(remote hlcTime) hlcTime {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pt := c.physicalNow()
+	switch {
+	case pt > c.last.wall && pt > remote.wall:
+		c.last = hlcTime{wall: pt}
+	case remote.wall > c.last.wall:
+		c.last = hlcTime{wall: remote.wall, logical: remote.logical + 1}
+	case remote.wall == c.last.wall:
+		c.last.logical = max(c.last.logical, remote.logical) + 1
+	default:
+		c.last.logical++
+	}
+	return c.last
+}
+
+// Move the clock past the timestamp in the HLC header of a request or response, if there is one
+func (c *hlc) observe(header http.Header) {
+	if remote, err := parseHLC(header.Get(HLC_HEADER)); err == nil && !remote.isZero() {
+		c.update(remote)
+	}
+}
+
+// Transport stamping the requests of a server with its clock, and moving the clock past the responses
+type clockTransport struct {
+	clock *hlc
+	base  http.RoundTripper
+}
+
+func (t *clockTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A RoundTripper must not modify the request it is given. The trailer is filled in as the body is read, so the
+	// clone shares it rather than a copy.
+	trailer := req.Trailer
+	req = req.Clone(req.Context())
+	req.Trailer = trailer
+	req.Header.Set(HLC_HEADER, t.clock.now().String())
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	resp, err := base.RoundTrip(req)
+	if err == nil {
+		t.clock.observe(resp.Header)
+	}
+	return resp, err
+}
+
+// Handler moving the clock past the requests it receives and stamping its responses
+func (c *hlc) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.observe(r.Header)
+		next.ServeHTTP(&clockWriter{ResponseWriter: w, clock: c}, r)
+	})
+}
+
+// Response writer stamping the response as its header is written, past what the handler heard from other servers
+type clockWriter struct {
+	http.ResponseWriter
+	clock   *hlc
+	stamped bool
+}
+
+func (w *clockWriter) stamp() {
+	if !w.stamped {
+		w.stamped = true
+		w.Header().Set(HLC_HEADER, w.clock.now().String())
+	}
+}
+
+func (w *clockWriter) WriteHeader(code int) {
+	w.stamp()
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *clockWriter) Write(b []byte) (int, error) {
+	w.stamp()
+	return w.ResponseWriter.Write(b)
+}
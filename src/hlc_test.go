@@ -0,0 +1,49 @@
+package main
+
+import (
+	"HyDFS/client"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAppendSeenBeforeIsMergedFirst(t *testing.T) {
+	c := newTestCluster(t, 4)
+	c.mustCreate(c.Client(), "file.txt", "x", 2)
+	c.WaitReplicas(5 * time.Second)
+
+	// A server storing no copy of the file coordinates for a client, with a clock an hour behind
+	holders := c.holders("file.txt")
+	var behind, other int
+	for _, id := range c.nodes.IDs() {
+		if !containsId(holders, id) && behind == 0 {
+			behind = id
+		} else if id != behind && other == 0 {
+			other = id
+		}
+	}
+	clock := &c.node(behind).fs.clock
+	clock.mu.Lock()
+	clock.physical = func() int64 { return time.Now().Add(-time.Hour).UnixNano() }
+	clock.mu.Unlock()
+
+	first, second := client.New([]string{c.nodes.HTTPAddr(other)}), client.New([]string{c.nodes.HTTPAddr(behind)})
+	if err := first.Append("file.txt", strings.NewReader("a")); err != nil {
+		t.Fatal(err)
+	}
+	// The second client reads the file after the append, then appends in turn
+	if got := c.mustGet(second, "file.txt"); got != "x" {
+		t.Fatalf("get = %q before the merge", got)
+	}
+	if err := second.Append("file.txt", strings.NewReader("b")); err != nil {
+		t.Fatal(err)
+	}
+
+	cl := c.Client()
+	if err := cl.Merge("file.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.mustGet(cl, "file.txt"); got != "xab" {
+		t.Errorf("get = %q, expected the append seen first to be merged first", got)
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// list gathers what every live server stores, in parallel, and reports each file once with the metadata of its
+// primary, or of its most recent copy while it has no primary, and the servers actually storing it. Servers that fail
+// to answer are named in the Failed-Servers header of the listing, which misses the files and copies only they store.
+
+const FAILED_HEADER = "Failed-Servers" // Ids of the servers a /list couldn't ask, comma separated
+
+// A file stored on a server, as listed by /storedfiles
+type storedFileInfo struct {
+	Name    string    `json:"name"`
+	Primary bool      `json:"primary"`
+	RF      int       `json:"rf"`
+	Version int       `json:"version"`
+	Size    int64     `json:"size"` // Of the content the block map refers to, pending appends excluded
+	Created time.Time `json:"created"`
+	Merged  time.Time `json:"merged"`
+	Pending int       `json:"pending"` // Appends waiting for a merge
+}
+
+// A file of the cluster, as listed by /list
+type listEntry struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Created  time.Time `json:"created"`
+	Merged   time.Time `json:"merged"`
+	Pending  int       `json:"pending"`
+	Replicas int       `json:"replicas"` // Servers storing the file, the primary included
+	Owners   []int     `json:"owners"`   // Ids of the servers storing the file, the primary first
+	RF       int       `json:"rf"`
+	Version  int       `json:"version"`
+}
+
+// Ways /list sorts files, a "-" before the key reversing the order
+var listOrders = map[string]func(a, b listEntry) bool{
+	"name":     func(a, b listEntry) bool { return a.Name < b.Name },
+	"size":     func(a, b listEntry) bool { return a.Size < b.Size },
+	"created":  func(a, b listEntry) bool { return a.Created.Before(b.Created) },
+	"merged":   func(a, b listEntry) bool { return a.Merged.Before(b.Merged) },
+	"pending":  func(a, b listEntry) bool { return a.Pending < b.Pending },
+	"replicas": func(a, b listEntry) bool { return a.Replicas < b.Replicas },
+}
+
+// Servers that failed to answer a request sent to every live server
+type serversError struct {
+	failed []int
+	errs   []string
+}
+
+func (e *serversError) Error() string {
+	return strings.Join(e.errs, ", ")
+}
+
+// Send a GET request to every live server at once, handing each answer to handle. The servers that fail are
+// reported by the error, a *serversError, once every server answered.
+func (fs *FileServer) askServers(path string, handle func(id int, body io.Reader) error) error {
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	failed := &serversError{}
+	for _, i := range fs.currentRing().Members() {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s%s", fs.nodes.HTTPAddr(i), path), nil)
+			resp, err := fs.newClient(0).Do(req)
+			if err == nil {
+				if resp.StatusCode != http.StatusOK {
+					err = fmt.Errorf("answered %s", resp.Status)
+				} else {
+					err = handle(i, resp.Body)
+				}
+				resp.Body.Close()
+			}
+			if err != nil {
+				mutex.Lock()
+				failed.failed = append(failed.failed, i)
+				failed.errs = append(failed.errs, fmt.Sprintf("server %d: %s", i, err))
+				mutex.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if len(failed.failed) > 0 {
+		sort.Ints(failed.failed)
+		return failed
+	}
+	return nil
+}
+
+// Files of the cluster whose names start with prefix, directories and blocks excluded, with the servers that failed
+// to answer
+func (fs *FileServer) listFiles(prefix string) ([]listEntry, []int, error) {
+	found := make(map[string][]storedFileInfo)
+	holders := make(map[string][]int)
+	var mutex sync.Mutex
+	err := fs.askServers("/storedfiles?prefix="+escapeName(prefix), func(id int, body io.Reader) error {
+		var infos []storedFileInfo
+		if err := json.NewDecoder(body).Decode(&infos); err != nil {
+			return err
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, info := range infos {
+			found[info.Name] = append(found[info.Name], info)
+			if info.Primary {
+				holders[info.Name] = append([]int{id}, holders[info.Name]...)
+			} else {
+				holders[info.Name] = append(holders[info.Name], id)
+			}
+		}
+		return nil
+	})
+	// Every file is on several servers, the others are enough
+	if err != nil && len(found) == 0 {
+		return nil, nil, err
+	}
+	var failed []int
+	var servers *serversError
+	if errors.As(err, &servers) {
+		failed = servers.failed
+	}
+
+	entries := make([]listEntry, 0, len(found))
+	for name, infos := range found {
+		best := infos[0]
+		for _, info := range infos[1:] {
+			if !best.Primary && (info.Primary || info.Version > best.Version) {
+				best = info
+			}
+		}
+		entries = append(entries, listEntry{
+			Name:     name,
+			Size:     best.Size,
+			Created:  best.Created,
+			Merged:   best.Merged,
+			Pending:  best.Pending,
+			Replicas: len(holders[name]),
+			Owners:   holders[name],
+			RF:       best.RF,
+			Version:  best.Version,
+		})
+	}
+	return entries, failed, nil
+}
+
+// List the files this server stores with their metadata, in JSON
+func (fs *FileServer) httpHandleStoredfiles(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		prefix := r.URL.Query().Get("prefix")
+		var infos []storedFileInfo
+		fs.Mutex.Lock()
+		for role, files := range map[string]map[string]File{"p": fs.p_files, "r": fs.r_files} {
+			for name, f := range files {
+				if !strings.HasPrefix(name, prefix) || isBlockName(name) || strings.HasSuffix(name, DIR_SEPARATOR) {
+					continue
+				}
+				infos = append(infos, storedFileInfo{
+					Name:    name,
+					Primary: role == "p",
+					RF:      f.rf,
+					Version: f.version,
+					Created: f.meta.Created,
+					Merged:  f.meta.Merged,
+					Pending: len(f.cache),
+				})
+			}
+		}
+		fs.Mutex.Unlock()
+
+		// Block maps are small, the size of a file is the sum of its blocks
+		for i := range infos {
+			infos[i].Size = fs.contentSize(infos[i].Name)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(infos)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// List every file of the cluster once with its metadata, in JSON. The files can be filtered by a prefix of their
+// names and sorted by name, size, created, merged, pending or replicas.
+func (fs *FileServer) httpHandleList(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		order := r.URL.Query().Get("sort")
+		if order == "" {
+			order = "name"
+		}
+		reverse := strings.HasPrefix(order, "-")
+		less, exists := listOrders[strings.TrimPrefix(order, "-")]
+		if !exists {
+			http.Error(w, "Rejected, files can't be sorted by "+order, http.StatusBadRequest)
+			return
+		}
+
+		entries, failed, err := fs.listFiles(r.URL.Query().Get("prefix"))
+		if err != nil {
+			httpError(w, errorCode(err), "Failed when listing files: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(failed) > 0 {
+			ids := make([]string, len(failed))
+			for i, id := range failed {
+				ids[i] = strconv.Itoa(id)
+			}
+			log.Println("Listing files without servers", ids)
+			w.Header().Set(FAILED_HEADER, strings.Join(ids, ","))
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			a, b := entries[i], entries[j]
+			if reverse {
+				a, b = b, a
+			}
+			if less(a, b) != less(b, a) {
+				return less(a, b)
+			}
+			return entries[i].Name < entries[j].Name
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
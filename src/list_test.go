@@ -0,0 +1,103 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListDescribesEachFileOnce(t *testing.T) {
+	c := newTestCluster(t, 5)
+	cl := c.Client()
+
+	c.mustCreate(cl, "logs/small.txt", "hi", 2)
+	c.mustCreate(cl, "logs/large.txt", strings.Repeat("x", 100), 4)
+	c.mustCreate(cl, "top.txt", "top", 3)
+	if err := cl.Mkdir("empty"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Append("top.txt", strings.NewReader(" more")); err != nil {
+		t.Fatal(err)
+	}
+	c.WaitReplicas(5 * time.Second)
+
+	files, err := cl.List("", "-size")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name)
+	}
+	if expected := []string{"logs/large.txt", "top.txt", "logs/small.txt"}; strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Fatalf("list sorted by -size = %q, expected %q", names, expected)
+	}
+	for i, expected := range []struct {
+		size    int64
+		pending int
+		rf      int
+	}{{100, 0, 4}, {3, 1, 3}, {2, 0, 2}} {
+		f := files[i]
+		if f.Size != expected.size || f.Pending != expected.pending || f.RF != expected.rf || f.Replicas != expected.rf {
+			t.Errorf("%s: size %d, pending %d, rf %d, replicas %d, expected %+v", f.Name, f.Size, f.Pending, f.RF, f.Replicas, expected)
+		}
+		holders := c.holders(f.Name)
+		if len(f.Owners) == 0 || f.Owners[0] != holders[0] {
+			t.Errorf("%s: owners %v, expected the primary %d first", f.Name, f.Owners, holders[0])
+		}
+		owners := append([]int(nil), f.Owners...)
+		sort.Ints(owners)
+		sort.Ints(holders)
+		if !reflect.DeepEqual(owners, holders) {
+			t.Errorf("%s: owners %v, expected %v", f.Name, owners, holders)
+		}
+		if f.Created.IsZero() || !f.Merged.IsZero() {
+			t.Errorf("%s: created %v, merged %v", f.Name, f.Created, f.Merged)
+		}
+	}
+
+	if err := cl.Merge("top.txt"); err != nil {
+		t.Fatal(err)
+	}
+	files, err = cl.List("top", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Size != 8 || files[0].Pending != 0 || files[0].Merged.IsZero() {
+		t.Errorf("list top after a merge = %+v", files)
+	}
+
+	if files, err := cl.List("logs/", "name"); err != nil || len(files) != 2 || files[0].Name != "logs/large.txt" {
+		t.Errorf("list logs/ = %+v, %v", files, err)
+	}
+	if _, err := cl.List("", "owner"); err == nil {
+		t.Errorf("list sorted by an unknown key succeeded")
+	}
+}
+
+func TestListNamesTheServersThatFailed(t *testing.T) {
+	c := newTestCluster(t, 4)
+	cl := c.Client()
+	c.mustCreate(cl, "file.txt", "hello", 3)
+	c.WaitReplicas(5 * time.Second)
+
+	holders := c.holders("file.txt")
+	c.Drop(holders[1], "/storedfiles")
+	files, failed, err := cl.ListPartial("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(failed, []int{holders[1]}) {
+		t.Errorf("failed servers %v, expected [%d]", failed, holders[1])
+	}
+	if len(files) != 1 || files[0].Replicas != 2 {
+		t.Errorf("list without server %d = %+v, expected file.txt on the other 2 servers", holders[1], files)
+	}
+
+	c.Drop(holders[1], "")
+	if files, failed, err := cl.ListPartial("", ""); err != nil || len(failed) != 0 || len(files) != 1 || files[0].Replicas != 3 {
+		t.Errorf("list = %+v, failed servers %v, %v", files, failed, err)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"HyDFS/failuredetector"
+	"HyDFS/registry"
 	"fmt"
 	"log"
 	"net/http"
@@ -25,7 +26,7 @@ func main() {
 	}()
 
 	if len(os.Args) < 2 {
-		log.Fatal("Usage: go run . <vm_number>")
+		log.Fatal("Usage: go run . <vm_number> [config_file]")
 	}
 	logFile, err := os.OpenFile("../machine.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
@@ -40,18 +41,39 @@ func main() {
 
 	// Get the second argument which is the VM number
 	vmNumber, err := strconv.Atoi(os.Args[1])
-	if err != nil || vmNumber < 1 || vmNumber > 10 {
-		log.Fatal("The VM number must be an integer between 1 and 10.")
+	if err != nil || vmNumber < 1 {
+		log.Fatal("The VM number must be a positive integer.")
+	}
+
+	// Node addresses are read from the config file, ../config.yaml unless given
+	configFile := "../config.yaml"
+	if len(os.Args) > 2 {
+		configFile = os.Args[2]
+	}
+	nodes, err := registry.Load(configFile)
+	if err != nil {
+		log.Fatalf("Failed to load node registry: %s", err)
+	}
+	if _, exists := nodes.Node(vmNumber); !exists {
+		log.Fatalf("VM number %d is not listed in %s", vmNumber, configFile)
+	}
+	config, err := LoadConfig(configFile)
+	if err != nil {
+		log.Fatalf("Failed to load file server config: %s", err)
 	}
 
 	//------------------------- Main Logic ------------------------//
-	ml := failuredetector.NewMembershipList()
+	ml := failuredetector.NewMembershipList(nodes)
 	// 1. Failure Detection Service
-	go failuredetector.Failuredetect(ml, vmNumber)
+	go failuredetector.Failuredetect(ml, vmNumber, configFile)
 
-	fs := FileServerInit(ml, vmNumber)
+	fs := FileServerInit(ml, nodes, vmNumber, config)
 	// 2. Maintenance Daemon
 	go Maintenance(fs)
-	// 3. HTTP Request handling
+	// 3. Anti-entropy between the copies of the files
+	go AntiEntropy(fs)
+	// 4. Scrubbing of the stored files
+	go Scrubber(fs)
+	// 5. HTTP Request handling
 	HTTPServer(fs)
 }
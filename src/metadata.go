@@ -0,0 +1,219 @@
+package main
+
+import (
+	"HyDFS/ring"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Every copy of a file keeps its metadata record. The primary starts it at the create and every copy records the
+// appends it logs, with the timestamp given by the coordinator, so that the copies agree. A server pushing or
+// serving a copy sends the record along, and the server storing the copy keeps it as is.
+
+// Appends a record remembers, the oldest ones being forgotten first
+const APPEND_HISTORY = 100
+
+type fileMeta struct {
+	Creator  string            `json:"creator"`           // Host of the client that created the file
+	Created  time.Time         `json:"created"`           // Time of the create
+	Modified time.Time         `json:"modified"`          // Time of the last write accepted, create or append
+	Merged   time.Time         `json:"merged"`            // Time of the last merge applying appends, zero before the first one
+	Appends  []appendRecord    `json:"appends"`           // Last appends accepted, oldest first
+	Versions []fileVersion     `json:"versions"`          // Versions that can be read, oldest first
+	Applied  map[string]uint64 `json:"applied,omitempty"` // Highest sequence number merged of each client, see session.go
+	// Quorums given at the create, 0 for the ones of the config, see quorum.go
+	WriteQuorum int `json:"write_quorum,omitempty"`
+	ReadQuorum  int `json:"read_quorum,omitempty"`
+}
+
+type appendRecord struct {
+	Time     time.Time `json:"time"`  // Physical time of the stamp
+	Stamp    hlcTime   `json:"stamp"` // Stamp ordering the append, see hlc.go
+	Size     int64     `json:"size"`  // Bytes appended
+	Client   string    `json:"client"`
+	ClientID string    `json:"client_id"` // Id the client numbers its appends under
+	Seq      uint64    `json:"seq"`       // Number of the append among those of its client
+}
+
+func (a appendRecord) key() appendKey {
+	return appendKey{stamp: a.Stamp, client: a.ClientID, seq: a.Seq}
+}
+
+// A file as described by /stat
+type statInfo struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"` // Of the content the block map refers to, pending appends excluded
+	RF       int    `json:"rf"`
+	Version  int    `json:"version"`
+	Pending  int    `json:"pending"`  // Appends waiting for a merge
+	Replicas []int  `json:"replicas"` // Ids of the servers the file belongs to, the primary first
+	fileMeta
+}
+
+// Metadata of a file in the Meta header of a served copy, on a single line
+func encodeMeta(meta fileMeta) string {
+	data, _ := json.Marshal(meta)
+	return string(data)
+}
+
+// Query giving the metadata of a file to the server a copy of it is pushed to
+func metaQuery(meta fileMeta) string {
+	return url.Values{"meta": {encodeMeta(meta)}}.Encode()
+}
+
+// Metadata sent in a query or a header, the zero record if there is none
+func parseMeta(s string) fileMeta {
+	var meta fileMeta
+	if s != "" {
+		json.Unmarshal([]byte(s), &meta)
+	}
+	return meta
+}
+
+// Metadata of a new file
+func newMeta(creator string) fileMeta {
+	now := time.Now()
+	return fileMeta{Creator: creator, Created: now, Modified: now}
+}
+
+// Record an append, once however many times it is forwarded
+func (m fileMeta) withAppend(a appendRecord) fileMeta {
+	for _, known := range m.Appends {
+		if known.key().equal(a.key()) {
+			return m
+		}
+	}
+	// The history is copied, copies of the entry share the previous one
+	appends := append(append(make([]appendRecord, 0, len(m.Appends)+1), m.Appends...), a)
+	sort.Slice(appends, func(i, j int) bool { return appends[i].key().before(appends[j].key()) })
+	if len(appends) > APPEND_HISTORY {
+		appends = appends[len(appends)-APPEND_HISTORY:]
+	}
+	m.Appends = appends
+	if a.Time.After(m.Modified) {
+		m.Modified = a.Time
+	}
+	return m
+}
+
+// Query describing an append to the servers logging it
+func appendQuery(size int64, host string) string {
+	return url.Values{"size": {strconv.FormatInt(size, 10)}, "host": {host}}.Encode()
+}
+
+// Record an append in the metadata of the stored entry of a file, unless the entry was replaced meanwhile
+func (fs *FileServer) recordAppend(filename string, mutex *sync.RWMutex, a appendRecord) {
+	fs.Mutex.Lock()
+	defer fs.Mutex.Unlock()
+	for _, files := range []map[string]File{fs.p_files, fs.r_files} {
+		if file, exist := files[filename]; exist && file.Mutex == mutex {
+			file.meta = file.meta.withAppend(a)
+			files[filename] = file
+		}
+	}
+}
+
+// Host of the client sending a request
+func clientHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Size of the content of a stored file, the sum of its blocks
+func (fs *FileServer) contentSize(filename string) int64 {
+	data, err := os.ReadFile(fs.file_dir + diskName(filename))
+	if err != nil {
+		return 0
+	}
+	blocks, _ := parseBlockMap(bytes.NewReader(data))
+	var size int64
+	for _, blk := range blocks {
+		size += blk.size
+	}
+	return size
+}
+
+// Describe a file of the cluster in JSON, as its primary knows it
+func (fs *FileServer) httpHandleStat(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		filename, err := normalizeName(r.URL.Query().Get("filename"))
+		if err != nil {
+			httpError(w, errorCode(err), "Rejected, "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		ring_now := fs.currentRing()
+		p_server := ring_now.Owner(ring.Hash(filename))
+		if p_server == -1 {
+			http.Error(w, "Rejected due to server internal error", http.StatusInternalServerError)
+			return
+		}
+
+		url := fmt.Sprintf("http://%s/statting?filename=%s", fs.nodes.HTTPAddr(p_server), escapeName(filename))
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		resp, err := fs.newClient(0).Do(req)
+		if err != nil {
+			http.Error(w, "Failed to ask the primary of the file", http.StatusInternalServerError)
+			return
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(resp.Body)
+			httpError(w, resp.Header.Get(ERROR_HEADER), string(body), resp.StatusCode)
+			return
+		}
+		var info statInfo
+		if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+			http.Error(w, "Invalid answer of the primary of the file", http.StatusInternalServerError)
+			return
+		}
+		info.Replicas = fileReplicas(ring_now, filename, info.RF)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(info)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Describe a file stored on this server in JSON
+func (fs *FileServer) httpHandleStatting(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		filename := r.URL.Query().Get("filename")
+		fs.Mutex.Lock()
+		f, exist := fs.p_files[filename]
+		if !exist {
+			f, exist = fs.r_files[filename]
+		}
+		fs.Mutex.Unlock()
+		if !exist {
+			httpError(w, CODE_NOT_EXIST, "Rejected, file "+filename+" doesn't exist", http.StatusBadRequest)
+			return
+		}
+
+		f.Mutex.RLock()
+		info := statInfo{Name: filename, RF: f.rf, Version: f.version, Pending: len(f.cache), fileMeta: f.meta}
+		f.Mutex.RUnlock()
+		info.Versions = fs.retainedVersions(info.Versions)
+		info.Size = fs.contentSize(filename)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(info)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"HyDFS/client"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetaRecordsAppendsOnce(t *testing.T) {
+	created := time.Now()
+	meta := fileMeta{Created: created, Modified: created}
+	for i := 0; i < APPEND_HISTORY+10; i++ {
+		at := created.Add(time.Duration(i+1) * time.Second)
+		a := appendRecord{Time: at, Stamp: hlcTime{wall: at.UnixNano()}, Size: int64(i)}
+		meta = meta.withAppend(a).withAppend(a)
+	}
+	if len(meta.Appends) != APPEND_HISTORY || meta.Appends[0].Size != 10 {
+		t.Errorf("history of %d appends starting with %+v, expected the last %d", len(meta.Appends), meta.Appends[0], APPEND_HISTORY)
+	}
+	if last := meta.Appends[len(meta.Appends)-1]; !meta.Modified.Equal(last.Time) {
+		t.Errorf("modified %v, expected the time of the last append %v", meta.Modified, last.Time)
+	}
+}
+
+func TestStatSurvivesPrimaryFailure(t *testing.T) {
+	c := newTestCluster(t, 5)
+	cl := c.Client()
+
+	before := time.Now()
+	c.mustCreate(cl, "file.txt", "hello", 3)
+	for _, s := range []string{" big", " world"} {
+		if err := cl.Append("file.txt", strings.NewReader(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.WaitReplicas(5 * time.Second)
+
+	stat, err := cl.Stat("file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size != 5 || stat.Pending != 2 || stat.RF != 3 || stat.Creator != "127.0.0.1" {
+		t.Errorf("stat = %+v", stat)
+	}
+	if holders := c.holders("file.txt"); len(stat.Replicas) != 3 || stat.Replicas[0] != holders[0] {
+		t.Errorf("replicas %v, expected 3 servers, primary %d first", stat.Replicas, holders[0])
+	}
+	if stat.Created.Before(before) || len(stat.Appends) != 2 || stat.Appends[0].Size != 4 || stat.Appends[1].Size != 6 {
+		t.Fatalf("created %v, appends %+v", stat.Created, stat.Appends)
+	}
+	if !stat.Modified.Equal(stat.Appends[1].Time) || !stat.Merged.IsZero() {
+		t.Errorf("modified %v, merged %v, expected the time of the last append and no merge", stat.Modified, stat.Merged)
+	}
+	// Every copy recorded the same appends
+	for id, node := range c.live() {
+		node.fs.Mutex.Lock()
+		f, exist := node.fs.r_files["file.txt"]
+		node.fs.Mutex.Unlock()
+		if exist && len(f.meta.Appends) != 2 {
+			t.Errorf("node %d recorded appends %+v", id, f.meta.Appends)
+		}
+	}
+
+	// The new primary has the record of the old one
+	c.Kill(c.holders("file.txt")[0])
+	c.WaitMembership(10 * time.Second)
+	c.WaitReplicas(10 * time.Second)
+	cl = c.Client()
+	c.waitFor("the new primary to describe the file", 10*time.Second, func() error {
+		after, err := cl.Stat("file.txt")
+		if err != nil {
+			return err
+		}
+		if after.Creator != stat.Creator || !after.Created.Equal(stat.Created) || len(after.Appends) != 2 {
+			return fmt.Errorf("stat = %+v", after)
+		}
+		return nil
+	})
+
+	if err := cl.Merge("file.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if stat, err = cl.Stat("file.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size != 15 || stat.Pending != 0 || stat.Merged.IsZero() {
+		t.Errorf("stat after a merge = %+v", stat)
+	}
+	if _, err := cl.Stat("missing.txt"); !errors.Is(err, client.ErrNotExist) {
+		t.Errorf("Stat of a missing file returned %v, expected ErrNotExist", err)
+	}
+}
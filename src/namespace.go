@@ -0,0 +1,214 @@
+package main
+
+import (
+	"HyDFS/ring"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// HyDFS file names are paths of "/"-separated elements. Coordinators normalize the names clients give, and servers
+// only ever see normalized names. A directory is implied by the names under it, or made explicit by mkdir, which
+// stores an empty object under the name of the directory followed by "/". Every stored file sits flat in the file
+// directory of its server, under its name escaped so that it is a single path element.
+
+const DIR_SEPARATOR = "/"
+
+var errName = errors.New("invalid file name")
+
+// Normalize the name of a file: empty and "." elements are dropped, while "..", control characters and names of
+// directories are refused
+func normalizeName(name string) (string, error) {
+	if strings.HasSuffix(name, DIR_SEPARATOR) {
+		return "", fmt.Errorf("%w: %q is the name of a directory", errName, name)
+	}
+	return normalizePath(name)
+}
+
+// Normalize the name of a directory, ending with "/", the root being ""
+func normalizeDir(name string) (string, error) {
+	if strings.Trim(name, DIR_SEPARATOR) == "" {
+		return "", nil
+	}
+	dir, err := normalizePath(name)
+	if err != nil {
+		return "", err
+	}
+	return dir + DIR_SEPARATOR, nil
+}
+
+func normalizePath(name string) (string, error) {
+	var elements []string
+	for _, e := range strings.Split(name, DIR_SEPARATOR) {
+		switch e {
+		case "", ".":
+			continue
+		case "..":
+			return "", fmt.Errorf("%w: %q refers to a parent directory", errName, name)
+		}
+		elements = append(elements, e)
+	}
+	if len(elements) == 0 {
+		return "", fmt.Errorf("%w: %q is empty", errName, name)
+	}
+	if strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return "", fmt.Errorf("%w: %q contains control characters", errName, name)
+	}
+	if isBlockName(name) {
+		return "", fmt.Errorf("%w: file names can't contain %s", errName, BLOCK_SEPARATOR)
+	}
+	return strings.Join(elements, DIR_SEPARATOR), nil
+}
+
+// Name of a stored file in the file directory and of its append log, a single path element that is never "." or ".."
+func diskName(name string) string {
+	return url.PathEscape(name)
+}
+
+// Name in HyDFS of a file in the file directory, "" for a name diskName doesn't give
+func hydfsName(disk string) string {
+	name, err := url.PathUnescape(disk)
+	if err != nil {
+		return ""
+	}
+	return name
+}
+
+// File name of a URL query
+func escapeName(name string) string {
+	return url.QueryEscape(name)
+}
+
+// Entries of a directory among file names, those of its subdirectories ending with "/"
+func dirEntries(dir string, names []string) []string {
+	seen := make(map[string]bool)
+	var entries []string
+	for _, name := range names {
+		rest, found := strings.CutPrefix(name, dir)
+		if !found || rest == "" {
+			continue
+		}
+		if i := strings.Index(rest, DIR_SEPARATOR); i >= 0 {
+			rest = rest[:i+1]
+		}
+		if !seen[rest] {
+			seen[rest] = true
+			entries = append(entries, rest)
+		}
+	}
+	sort.Strings(entries)
+	return entries
+}
+
+// Names of the files and directories stored on the live servers under a prefix, blocks excluded, sorted.
+// Replicas are listed too, so that a file whose primary is moving is still found.
+func (fs *FileServer) findNames(prefix string) ([]string, error) {
+	found := make(map[string]bool)
+	var mutex sync.Mutex
+	err := fs.askServers("/storedfilenames?prefix="+escapeName(prefix), func(id int, body io.Reader) error {
+		var names []string
+		if err := json.NewDecoder(body).Decode(&names); err != nil {
+			return err
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, name := range names {
+			found[name] = true
+		}
+		return nil
+	})
+	// Every file is on several servers, the others are enough
+	if err != nil && len(found) == 0 {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(found))
+	for name := range found {
+		if !isBlockName(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// List the files whose names start with a prefix, one per line
+func (fs *FileServer) httpHandleFind(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		names, err := fs.findNames(r.URL.Query().Get("prefix"))
+		if err != nil {
+			httpError(w, errorCode(err), "Failed when listing files: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, name := range names {
+			fmt.Fprintln(w, name)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Create an empty directory, stored as an empty object under its name
+func (fs *FileServer) httpHandleMkdir(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		dir, err := normalizeDir(r.URL.Query().Get("dirname"))
+		if err == nil && dir == "" {
+			err = fmt.Errorf("%w: the root directory always exists", errName)
+		}
+		if err != nil {
+			httpError(w, errorCode(err), "Rejected, "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ring_now := fs.currentRing()
+		file := strings.TrimSuffix(dir, DIR_SEPARATOR)
+		for _, name := range []string{dir, file} {
+			rf, err := fs.fetchRF(ring_now.Owner(ring.Hash(name)), name)
+			if err != nil {
+				http.Error(w, "Failed when checking file existence", http.StatusInternalServerError)
+				return
+			}
+			if rf != -1 {
+				httpError(w, CODE_EXISTS, "Rejected, file "+name+" already exists", http.StatusBadRequest)
+				return
+			}
+		}
+
+		url := fmt.Sprintf("http://%s/creating?filename=%s&ftype=p&exclusive=true&rf=%d&creator=%s", fs.nodes.HTTPAddr(ring_now.Owner(ring.Hash(dir))), escapeName(dir), fs.config.DefaultRF, escapeName(clientHost(r)))
+		if err := fs.put(url, strings.NewReader("")); errors.Is(err, errExists) {
+			httpError(w, CODE_EXISTS, "Rejected, file "+dir+" already exists", http.StatusBadRequest)
+			return
+		} else if err != nil {
+			log.Println("Failed to create directory "+dir, err)
+			http.Error(w, "Failed to create the directory", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, "Directory "+dir+" created")
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// List of file names sent by /storedfilenames, quoted so that names with spaces can be told apart
+func quotedNames(body io.Reader) string {
+	var names []string
+	if err := json.NewDecoder(body).Decode(&names); err != nil {
+		return "invalid list"
+	}
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = strconv.Quote(name)
+	}
+	return strings.Join(quoted, " ")
+}
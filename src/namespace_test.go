@@ -0,0 +1,94 @@
+package main
+
+import (
+	"HyDFS/client"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalizeName(t *testing.T) {
+	for name, expected := range map[string]string{
+		"file.txt":             "file.txt",
+		"/logs//day1.txt":      "logs/day1.txt",
+		"./logs/./day 1 &.txt": "logs/day 1 &.txt",
+	} {
+		if got, err := normalizeName(name); err != nil || got != expected {
+			t.Errorf("normalizeName(%q) = %q, %v, expected %q", name, got, err, expected)
+		}
+	}
+	for _, name := range []string{"", "/", "logs/", "../../etc/x", "logs/../x", "a~b", "line\nbreak"} {
+		if got, err := normalizeName(name); !errors.Is(err, errName) {
+			t.Errorf("normalizeName(%q) = %q, %v, expected errName", name, got, err)
+		}
+	}
+	if got, err := normalizeDir("//logs/2024"); err != nil || got != "logs/2024/" {
+		t.Errorf("normalizeDir = %q, %v", got, err)
+	}
+
+	for _, name := range []string{"logs/day1.txt", "100%.txt", "a b?c=d&e#f"} {
+		if disk := diskName(name); strings.Contains(disk, "/") || hydfsName(disk) != name {
+			t.Errorf("diskName(%q) = %q", name, disk)
+		}
+	}
+}
+
+func TestDirectories(t *testing.T) {
+	c := newTestCluster(t, 4)
+	cl := c.Client()
+
+	names := []string{"logs/day 1.txt", "logs/2024/jan?&=.txt", "/logs//day2.txt", "top.txt"}
+	for _, name := range names {
+		c.mustCreate(cl, name, "content of "+name, 2)
+	}
+	if err := cl.Mkdir("logs/empty"); err != nil {
+		t.Fatal(err)
+	}
+	c.WaitReplicas(5 * time.Second)
+
+	if got := c.mustGet(cl, "logs/2024/jan?&=.txt"); got != "content of logs/2024/jan?&=.txt" {
+		t.Errorf("Get logs/2024/jan?&=.txt = %q", got)
+	}
+	if got := c.mustGet(cl, "logs/day2.txt"); got != "content of /logs//day2.txt" {
+		t.Errorf("Get logs/day2.txt = %q", got)
+	}
+	if err := cl.Create("../../etc/x", strings.NewReader("x"), 0); err == nil {
+		t.Errorf("Create of ../../etc/x succeeded")
+	}
+	if err := cl.Create("logs/empty", strings.NewReader("x"), 0); !errors.Is(err, client.ErrExists) {
+		t.Errorf("Create of a file named like a directory returned %v, expected ErrExists", err)
+	}
+
+	out, err := cl.Ls("logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range []string{"2024/", "day 1.txt", "day2.txt", "empty/"} {
+		if !strings.Contains(out, "\n"+entry+"\n") {
+			t.Errorf("ls logs doesn't list %q:\n%s", entry, out)
+		}
+	}
+	if strings.Contains(out, "top.txt") || strings.Contains(out, "jan") || strings.Contains(out, BLOCK_SEPARATOR) {
+		t.Errorf("ls logs lists entries of other directories:\n%s", out)
+	}
+
+	found, err := cl.Find("logs/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"logs/day 1.txt", "logs/day2.txt"}; !reflect.DeepEqual(found, expected) {
+		t.Errorf("find logs/d = %q, expected %q", found, expected)
+	}
+
+	if err := cl.Delete("logs/"); err == nil {
+		t.Errorf("Delete of a directory that isn't empty succeeded")
+	}
+	if err := cl.Delete("logs/empty/"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cl.Ls("logs/empty/"); !errors.Is(err, client.ErrNotExist) {
+		t.Errorf("ls of a deleted directory returned %v, expected ErrNotExist", err)
+	}
+}
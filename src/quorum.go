@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// A create or an append succeeds once W copies of the file hold it, and a get reads the block map of R copies and
+// serves the newest one. A request may give W or R, else the file keeps the ones given at its create, else the config
+// gives them. Neither goes past the replication factor of the file. A write that fails its quorum stays on the copies
+// that acknowledged it. A copy that missed a write lags behind the others until anti-entropy repairs it, see
+// antientropy.go, and reading R copies makes up for it in the meantime.
+
+// Header of the responses giving the copies that acknowledged a write or answered a get
+const ACKS_HEADER = "Replica-Acks"
+
+var errQuorum = errors.New("quorum not reached")
+
+// Quorum given in a request, 0 if there is none
+func parseQuorum(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("invalid quorum %s", s)
+	}
+	return n, nil
+}
+
+// Query giving the quorums of a request to the server applying it, the missing ones left out
+func quorumQuery(w int, r int) string {
+	query := url.Values{}
+	if w > 0 {
+		query.Set("w", strconv.Itoa(w))
+	}
+	if r > 0 {
+		query.Set("r", strconv.Itoa(r))
+	}
+	return query.Encode()
+}
+
+// Quorum of a request on a file, the one of the request, of the file or of the config, at most rf
+func resolveQuorum(rf int, quorums ...int) int {
+	for _, q := range quorums {
+		if q > 0 {
+			return min(q, rf)
+		}
+	}
+	return 1
+}
+
+func (fs *FileServer) writeQuorum(meta fileMeta, request int, rf int) int {
+	return resolveQuorum(rf, request, meta.WriteQuorum, fs.config.WriteQuorum)
+}
+
+func (fs *FileServer) readQuorum(meta fileMeta, request int, rf int) int {
+	return resolveQuorum(rf, request, meta.ReadQuorum, fs.config.ReadQuorum)
+}
+
+// Whether a copy of a file holds more writes than another, later merges raising the version
+func (c storedCopy) newer(other storedCopy) bool {
+	if c.version != other.version {
+		return c.version > other.version
+	}
+	return len(c.blocks) > len(other.blocks)
+}
+
+// Fetch the block map of a file from R copies, the primary first, and keep the newest one. Copies that haven't
+// merged the appends of the client of a session answer without being read.
+func (fs *FileServer) fetchQuorumBlockMap(p_server int, filename string, at string, request int) (storedCopy, int, error) {
+	first, err := fs.fetchCopy(p_server, filename, "p", at)
+	if errors.Is(err, errNotStored) || errors.Is(err, errNoVersion) {
+		return first, 0, err
+	}
+	rf := first.rf
+	if err != nil {
+		var rfErr error
+		if rf, rfErr = fs.fetchRF(p_server, filename); rfErr != nil || rf < 1 {
+			return storedCopy{}, 0, err
+		}
+	}
+
+	// R is known once a copy describes the file
+	quorum := 0
+	var newest *storedCopy
+	answered := 0
+	try := func(c storedCopy, err error) {
+		if errors.Is(err, errNotApplied) {
+			answered++
+		}
+		if err != nil {
+			return
+		}
+		answered++
+		if quorum == 0 {
+			quorum = fs.readQuorum(c.meta, request, c.rf)
+		}
+		if newest == nil || c.newer(*newest) {
+			newest = &c
+		}
+	}
+	try(first, err)
+	for _, server := range fileReplicas(fs.currentRing(), filename, rf) {
+		if quorum > 0 && answered >= quorum {
+			break
+		}
+		if server == p_server {
+			continue
+		}
+		c, err := fs.fetchCopy(server, filename, "r", at)
+		try(c, err)
+	}
+	if newest == nil && answered > 0 {
+		return storedCopy{}, answered, fmt.Errorf("%s: %w", filename, errNotApplied)
+	}
+	if newest == nil {
+		return storedCopy{}, 0, err
+	}
+	if answered < quorum {
+		return storedCopy{}, answered, fmt.Errorf("%w, %d of %d copies of %s answered", errQuorum, answered, quorum, filename)
+	}
+	return *newest, answered, nil
+}
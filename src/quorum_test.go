@@ -0,0 +1,100 @@
+package main
+
+import (
+	"HyDFS/client"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuorumsOfWritesAndGets(t *testing.T) {
+	c := newTestCluster(t, 3)
+	cl := c.Client()
+
+	acks, err := cl.CreateQuorum("file.txt", strings.NewReader("hello"), 3, client.Quorum{})
+	if err != nil || acks != 3 {
+		t.Fatalf("create acknowledged by %d copies, %v", acks, err)
+	}
+	// The file keeps the quorums of its create
+	if _, err := cl.CreateQuorum("strict.txt", strings.NewReader("hello"), 3, client.Quorum{W: 3, R: 3}); err != nil {
+		t.Fatal(err)
+	}
+	c.WaitReplicas(5 * time.Second)
+
+	// Two copies of each file are left
+	for _, id := range c.nodes.IDs() {
+		if id != c.holders("file.txt")[0] && id != c.holders("strict.txt")[0] {
+			c.Kill(id)
+			break
+		}
+	}
+	c.WaitMembership(10 * time.Second)
+	cl = c.Client()
+
+	if acks, err := cl.AppendQuorum("file.txt", strings.NewReader(" world"), 0); err != nil || acks != 2 {
+		t.Errorf("append acknowledged by %d copies, %v", acks, err)
+	}
+	if acks, err := cl.AppendQuorum("file.txt", strings.NewReader(" again"), 3); !errors.Is(err, client.ErrQuorum) || acks != 2 {
+		t.Errorf("append with W = 3 acknowledged by %d copies, %v, expected ErrQuorum", acks, err)
+	}
+	if acks, err := cl.AppendQuorum("strict.txt", strings.NewReader(" world"), 0); !errors.Is(err, client.ErrQuorum) || acks != 2 {
+		t.Errorf("append to a file of W = 3 acknowledged by %d copies, %v, expected ErrQuorum", acks, err)
+	}
+	if acks, err := cl.AppendQuorum("strict.txt", strings.NewReader(" again"), 2); err != nil || acks != 2 {
+		t.Errorf("append with W = 2 acknowledged by %d copies, %v", acks, err)
+	}
+
+	if _, err := cl.GetQuorum("strict.txt", 0, &strings.Builder{}); !errors.Is(err, client.ErrQuorum) {
+		t.Errorf("get of a file of R = 3 returned %v, expected ErrQuorum", err)
+	}
+	// The append that missed its quorum stays on the copies that logged it
+	for name, expected := range map[string]string{"file.txt": "hello world again", "strict.txt": "hello world again"} {
+		var b strings.Builder
+		if acks, err := cl.GetQuorum(name, 2, &b); err != nil || acks != 2 || b.String() != expected {
+			t.Errorf("get of %s with R = 2 = %q from %d copies, %v, expected %q", name, b.String(), acks, err, expected)
+		}
+	}
+}
+
+func TestBlocksOfWritesNeedTheirQuorum(t *testing.T) {
+	c := newTestCluster(t, 3)
+	cl := c.Client()
+
+	// Block creates reach the primaries of the blocks alone, the copies of block maps still go through
+	blockCopies := func(req *http.Request) bool {
+		query := req.URL.Query()
+		return req.URL.Path == "/creating" && query.Get("ftype") == "r" && isBlockName(query.Get("filename"))
+	}
+	for _, id := range c.nodes.IDs() {
+		c.DropWhere(id, blockCopies)
+	}
+	if _, err := cl.CreateQuorum("strict.txt", strings.NewReader("hello"), 3, client.Quorum{W: 2}); !errors.Is(err, client.ErrQuorum) {
+		t.Fatalf("create with W = 2 whose blocks have one copy returned %v, expected ErrQuorum", err)
+	}
+	if err := cl.Get("strict.txt", &strings.Builder{}); !errors.Is(err, client.ErrNotExist) {
+		t.Errorf("get of a create that missed its quorum returned %v, expected ErrNotExist", err)
+	}
+	if _, err := cl.CreateQuorum("file.txt", strings.NewReader("hello"), 3, client.Quorum{W: 1}); err != nil {
+		t.Fatalf("create with W = 1: %v", err)
+	}
+	if _, err := cl.AppendQuorum("file.txt", strings.NewReader(" world"), 2); !errors.Is(err, client.ErrQuorum) {
+		t.Errorf("append with W = 2 whose blocks have one copy returned %v, expected ErrQuorum", err)
+	}
+
+	for _, id := range c.nodes.IDs() {
+		c.DropWhere(id, nil)
+	}
+	if _, err := cl.CreateQuorum("strict.txt", strings.NewReader("hello"), 3, client.Quorum{W: 3}); err != nil {
+		t.Fatalf("create with W = 3 once the blocks are copied: %v", err)
+	}
+	if _, err := cl.AppendQuorum("file.txt", strings.NewReader(" world"), 3); err != nil {
+		t.Errorf("append with W = 3 once the blocks are copied: %v", err)
+	}
+	for name, expected := range map[string]string{"strict.txt": "hello", "file.txt": "hello world"} {
+		if got := c.mustGet(cl, name); got != expected {
+			t.Errorf("%s = %q, expected %q", name, got, expected)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package registry
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Node describes where a single HyDFS server can be reached
+type Node struct {
+	ID         int    `yaml:"id"`
+	Host       string `yaml:"host"`
+	HTTPPort   string `yaml:"http_port"`
+	PingPort   string `yaml:"ping_port"`
+	RepingPort string `yaml:"reping_port"`
+	GossipPort string `yaml:"gossip_port"`
+	CmdPort    string `yaml:"cmd_port"`
+}
+
+// Domain is the name the node goes by in the membership list.
+// Host alone is not unique once several nodes share a machine, so the ping port is included.
+func (n Node) Domain() string {
+	return net.JoinHostPort(n.Host, n.PingPort)
+}
+
+func (n Node) HTTPAddr() string {
+	return net.JoinHostPort(n.Host, n.HTTPPort)
+}
+
+// Registry maps node ids to their addresses
+type Registry struct {
+	nodes    map[int]Node
+	byDomain map[string]int
+}
+
+// New builds a registry from a list of nodes, rejecting duplicated ids or addresses
+func New(nodes []Node) (*Registry, error) {
+	r := &Registry{
+		nodes:    make(map[int]Node),
+		byDomain: make(map[string]int),
+	}
+	for _, n := range nodes {
+		if n.Host == "" || n.HTTPPort == "" || n.PingPort == "" || n.RepingPort == "" || n.GossipPort == "" || n.CmdPort == "" {
+			return nil, fmt.Errorf("node %d is missing its host or one of its ports", n.ID)
+		}
+		if _, exists := r.nodes[n.ID]; exists {
+			return nil, fmt.Errorf("node id %d is listed more than once", n.ID)
+		}
+		if _, exists := r.byDomain[n.Domain()]; exists {
+			return nil, fmt.Errorf("address %s is used by more than one node", n.Domain())
+		}
+		r.nodes[n.ID] = n
+		r.byDomain[n.Domain()] = n.ID
+	}
+	return r, nil
+}
+
+// Load reads the "nodes" section of a config file
+func Load(filename string) (*Registry, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var config struct {
+		Nodes []Node `yaml:"nodes"`
+	}
+	if err := yaml.NewDecoder(file).Decode(&config); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", filename, err)
+	}
+	if len(config.Nodes) == 0 {
+		return nil, fmt.Errorf("no nodes listed in %s", filename)
+	}
+	return New(config.Nodes)
+}
+
+// Node returns the node registered with the given id
+func (r *Registry) Node(id int) (Node, bool) {
+	n, exists := r.nodes[id]
+	return n, exists
+}
+
+// IDOf returns the id of the node whose membership domain is given
+func (r *Registry) IDOf(domain string) (int, bool) {
+	id, exists := r.byDomain[domain]
+	return id, exists
+}
+
+// HTTPAddr returns host:port of the node's file server, or an unroutable placeholder for unknown ids
+func (r *Registry) HTTPAddr(id int) string {
+	n, exists := r.nodes[id]
+	if !exists {
+		return "unknown-node-" + strconv.Itoa(id)
+	}
+	return n.HTTPAddr()
+}
+
+// IDs returns all registered node ids in ascending order
+func (r *Registry) IDs() []int {
+	ids := make([]int, 0, len(r.nodes))
+	for id := range r.nodes {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func (r *Registry) Len() int {
+	return len(r.nodes)
+}
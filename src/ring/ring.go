@@ -0,0 +1,162 @@
+package ring
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+// Hash maps a key (a filename or a virtual node) to a token in the 64-bit ring space
+func Hash(input string) uint64 {
+	sum := sha256.Sum256([]byte(input))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// Tokens returns the positions of the vnodes virtual nodes of a server, derived from its id the same way files are placed
+func Tokens(id int, vnodes int) []uint64 {
+	tokens := make([]uint64, vnodes)
+	for v := 0; v < vnodes; v++ {
+		tokens[v] = Hash("node-" + strconv.Itoa(id) + "-" + strconv.Itoa(v))
+	}
+	return tokens
+}
+
+type token struct {
+	pos uint64
+	id  int
+}
+
+// Ring is a snapshot of the servers currently on the ring, each owning several virtual nodes
+type Ring struct {
+	tokens  []token
+	members []int
+}
+
+// New places the given server ids on the ring with vnodes virtual nodes each
+func New(ids []int, vnodes int) *Ring {
+	if vnodes < 1 {
+		vnodes = 1
+	}
+	r := &Ring{
+		tokens:  make([]token, 0, len(ids)*vnodes),
+		members: make([]int, len(ids)),
+	}
+	copy(r.members, ids)
+	sort.Ints(r.members)
+
+	for _, id := range r.members {
+		for _, pos := range Tokens(id, vnodes) {
+			r.tokens = append(r.tokens, token{pos: pos, id: id})
+		}
+	}
+	// Tokens sharing a position are ordered by id, so that every node agrees on the ring
+	sort.Slice(r.tokens, func(i, j int) bool {
+		if r.tokens[i].pos != r.tokens[j].pos {
+			return r.tokens[i].pos < r.tokens[j].pos
+		}
+		return r.tokens[i].id < r.tokens[j].id
+	})
+	return r
+}
+
+// Members returns the server ids on the ring in ascending order
+func (r *Ring) Members() []int {
+	return r.members
+}
+
+// search returns the index of the first token at or after key, wrapping around the ring
+func (r *Ring) search(key uint64) int {
+	i := sort.Search(len(r.tokens), func(i int) bool {
+		return r.tokens[i].pos >= key
+	})
+	return i % len(r.tokens)
+}
+
+// Owner returns the primary server of key, the server of the first token at or after it.
+// Returns -1 if the ring is empty.
+func (r *Ring) Owner(key uint64) int {
+	if len(r.tokens) == 0 {
+		return -1
+	}
+	return r.tokens[r.search(key)].id
+}
+
+// Replicas returns up to n distinct servers met walking clockwise from key, the owner first
+func (r *Ring) Replicas(key uint64, n int) []int {
+	if len(r.tokens) == 0 {
+		return nil
+	}
+	return r.walk(r.search(key), n, -1)
+}
+
+// walk collects up to n distinct servers other than skip, clockwise from token start
+func (r *Ring) walk(start int, n int, skip int) []int {
+	var servers []int
+	seen := make(map[int]bool)
+	for i := 0; i < len(r.tokens) && len(servers) < n; i++ {
+		id := r.tokens[(start+i)%len(r.tokens)].id
+		if id == skip || seen[id] {
+			continue
+		}
+		seen[id] = true
+		servers = append(servers, id)
+	}
+	return servers
+}
+
+// Successors returns the servers that replicate keys owned by id, i.e. the n distinct servers
+// following each of its virtual nodes. The result is in ring order and never includes id itself.
+func (r *Ring) Successors(id int, n int) []int {
+	var successors []int
+	seen := make(map[int]bool)
+	for i, t := range r.tokens {
+		if t.id != id {
+			continue
+		}
+		for _, s := range r.walk(i+1, n, id) {
+			if !seen[s] {
+				seen[s] = true
+				successors = append(successors, s)
+			}
+		}
+	}
+	return successors
+}
+
+// Predecessors returns the servers owning keys that id replicates, i.e. the n distinct servers
+// preceding each of its virtual nodes. The result is in ring order and never includes id itself.
+func (r *Ring) Predecessors(id int, n int) []int {
+	var predecessors []int
+	seen := make(map[int]bool)
+	for i, t := range r.tokens {
+		if t.id != id {
+			continue
+		}
+		for _, p := range r.walkBack(i, n, id) {
+			if !seen[p] {
+				seen[p] = true
+				predecessors = append(predecessors, p)
+			}
+		}
+	}
+	return predecessors
+}
+
+// walkBack collects up to n distinct servers counter-clockwise from token i, stopping at the previous
+// virtual node of id, since the keys before it are replicated through that virtual node.
+func (r *Ring) walkBack(i int, n int, id int) []int {
+	var servers []int
+	seen := make(map[int]bool)
+	for k := 1; k < len(r.tokens) && len(servers) < n; k++ {
+		p := r.tokens[(i-k+len(r.tokens))%len(r.tokens)].id
+		if p == id {
+			break
+		}
+		if !seen[p] {
+			seen[p] = true
+			servers = append(servers, p)
+		}
+	}
+	return servers
+}
@@ -0,0 +1,93 @@
+package ring
+
+import (
+	"fmt"
+	"testing"
+)
+
+func keys(n int) []uint64 {
+	hashes := make([]uint64, n)
+	for i := range hashes {
+		hashes[i] = Hash(fmt.Sprintf("file-%d.txt", i))
+	}
+	return hashes
+}
+
+func ids(from int, to int) []int {
+	var servers []int
+	for id := from; id <= to; id++ {
+		servers = append(servers, id)
+	}
+	return servers
+}
+
+func TestPlacementIsDeterministic(t *testing.T) {
+	// Every node builds the ring from its own membership list, in any order
+	a := New([]int{3, 1, 7, 2, 9, 5}, 16)
+	b := New([]int{9, 7, 5, 3, 2, 1}, 16)
+	for _, key := range keys(1000) {
+		ra, rb := a.Replicas(key, 3), b.Replicas(key, 3)
+		if fmt.Sprint(ra) != fmt.Sprint(rb) {
+			t.Fatalf("Replicas(%d) = %v and %v", key, ra, rb)
+		}
+		if ra[0] != a.Owner(key) || ra[0] != b.Owner(key) {
+			t.Fatalf("Replicas(%d) = %v, owner %d", key, ra, a.Owner(key))
+		}
+		seen := make(map[int]bool)
+		for _, id := range ra {
+			if seen[id] {
+				t.Fatalf("Replicas(%d) = %v repeats a server", key, ra)
+			}
+			seen[id] = true
+		}
+	}
+	for _, id := range a.Members() {
+		if fmt.Sprint(a.Successors(id, 2)) != fmt.Sprint(b.Successors(id, 2)) || fmt.Sprint(a.Predecessors(id, 2)) != fmt.Sprint(b.Predecessors(id, 2)) {
+			t.Errorf("server %d has other neighbours on the two rings", id)
+		}
+	}
+
+	// The replicas of a key are successors of its owner, which is one of their predecessors
+	for _, key := range keys(1000) {
+		replicas := a.Replicas(key, 3)
+		for _, id := range replicas[1:] {
+			if !contains(a.Successors(replicas[0], 2), id) || !contains(a.Predecessors(id, 2), replicas[0]) {
+				t.Fatalf("replica %d of key %d isn't a neighbour of its owner %d", id, key, replicas[0])
+			}
+		}
+	}
+}
+
+func contains(ids []int, id int) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+func TestMembershipChangesMoveFewKeys(t *testing.T) {
+	const n = 10
+	all := keys(20000)
+	before := New(ids(1, n), 16)
+
+	// A join only moves keys to the new server, a failure only the keys of the failed one
+	for name, after := range map[string]*Ring{"join": New(ids(1, n+1), 16), "failure": New(ids(2, n), 16)} {
+		moved := 0
+		for _, key := range all {
+			from, to := before.Owner(key), after.Owner(key)
+			if from == to {
+				continue
+			}
+			moved++
+			if (name == "join" && to != n+1) || (name == "failure" && from != 1) {
+				t.Fatalf("%s moved key %d from %d to %d", name, key, from, to)
+			}
+		}
+		// About 1/N of the keys, the virtual nodes keeping the share of a server near it
+		if fraction := float64(moved) / float64(len(all)); fraction > 2.0/n || fraction < 0.25/n {
+			t.Errorf("%s moved %.3f of the keys, expected about %.3f", name, fraction, 1.0/n)
+		}
+	}
+}
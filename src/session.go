@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// A get sees the appends its client made before. The client sends the sequence number of its last acknowledged
+// append to the file along with the get, and a server only serves the block map of the file once it has merged that
+// append. Every copy of a file records the highest sequence number of each client it merged, in its metadata record.
+// The coordinator turns to the replicas when the primary hasn't merged the append yet, and merges the file everywhere
+// when none has.
+
+var errNotApplied = errors.New("append not merged yet")
+
+// Query giving the last append of a client to the server sending the block map of a file
+func sessionQuery(client string, seq uint64) string {
+	return url.Values{"client": {client}, "seq": {strconv.FormatUint(seq, 10)}}.Encode()
+}
+
+// Record the merge of appends, the highest sequence number of each client
+func (m fileMeta) withApplied(keys []appendKey) fileMeta {
+	// The map is copied, copies of the entry share the previous one
+	applied := make(map[string]uint64, len(m.Applied)+len(keys))
+	for client, seq := range m.Applied {
+		applied[client] = seq
+	}
+	for _, k := range keys {
+		if k.seq > applied[k.client] {
+			applied[k.client] = k.seq
+		}
+	}
+	m.Applied = applied
+	return m
+}
+
+// Check that a copy merged the last append of the client of a request
+func checkApplied(meta fileMeta, query url.Values) error {
+	client := query.Get("client")
+	seq, _ := strconv.ParseUint(query.Get("seq"), 10, 64)
+	if client == "" || seq == 0 || meta.Applied[client] >= seq {
+		return nil
+	}
+	return fmt.Errorf("%w, append %d of client %s", errNotApplied, seq, client)
+}
+
+// Merge a file on all its servers, through the coordinator of this server
+func (fs *FileServer) mergeEverywhere(filename string) error {
+	url := fmt.Sprintf("http://%s/merge?filename=%s", fs.nodes.HTTPAddr(fs.id), escapeName(filename))
+	req, _ := http.NewRequest(http.MethodGet, url, nil)
+	resp, err := fs.newClient(0).Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("merge answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGetReadsOwnAppends(t *testing.T) {
+	c := newTestCluster(t, 4)
+	writer, reader := c.Client(), c.Client()
+
+	c.mustCreate(writer, "file.txt", "hello", 3)
+	if err := writer.Append("file.txt", strings.NewReader(" big")); err != nil {
+		t.Fatal(err)
+	}
+	// Another client reads the merged content, the writer its own appends
+	if got := c.mustGet(reader, "file.txt"); got != "hello" {
+		t.Errorf("get of another client = %q, expected the content before the append", got)
+	}
+	if got := c.mustGet(writer, "file.txt"); got != "hello big" {
+		t.Errorf("get of the writer = %q, expected its append", got)
+	}
+
+	// An append through a replica is read as well
+	if err := writer.AppendThrough("file.txt", strings.NewReader(" world"), 1); err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	if _, err := writer.GetRange("file.txt", 6, 0, &b); err != nil || b.String() != "big world" {
+		t.Errorf("range get of the writer = %q, %v, expected its appends", b.String(), err)
+	}
+
+	// Every copy records the appends it merged
+	for id, node := range c.live() {
+		node.fs.Mutex.Lock()
+		f, exist := node.fs.p_files["file.txt"]
+		if !exist {
+			f, exist = node.fs.r_files["file.txt"]
+		}
+		node.fs.Mutex.Unlock()
+		if exist && f.meta.Applied[writer.ID()] != 2 {
+			t.Errorf("node %d merged appends %v, expected 2 of the writer", id, f.meta.Applied)
+		}
+	}
+}
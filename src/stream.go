@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// File contents are streamed between clients and servers rather than read in memory,
+// so that the memory a transfer takes doesn't depend on the size of the file.
+
+func uploadPattern(id int) string {
+	return strconv.Itoa(id) + ".upload-*"
+}
+
+// Stream content into a stored file, copying it to the given writers on the way. Once the whole content is written
+// and matches the checksum given by expected, the file is replaced and commit records it in the entry of the file,
+// both under the lock of the file, so a reader finding the new entry finds the new content. A failed transfer or
+// commit leaves the previous content in place.
+func (fs *FileServer) storeFile(filename string, content io.Reader, expected func() string, commit func(size int64, checksum string) error, copies ...io.Writer) error {
+	// Temporary files are kept out of the file directory, where they could clash with a HyDFS file name
+	tmp, err := os.CreateTemp(fs.config.FileDir, uploadPattern(fs.id))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(append([]io.Writer{tmp, h}, copies...)...), content)
+	if err != nil {
+		return err
+	}
+	checksum := hex.EncodeToString(h.Sum(nil))
+	if err := checkSum(expected(), checksum); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+
+	_, _, unlock := fs.lockFile(filename, "", true)
+	defer unlock()
+	path := fs.file_dir + diskName(filename)
+	stored, err := tmp.Stat()
+	if err != nil {
+		return err
+	}
+	// The previous content is kept aside until the commit
+	backup := tmp.Name() + ".old"
+	if err := os.Link(path, backup); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	defer os.Remove(backup)
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	if err := commit(size, checksum); err != nil {
+		// A file created meanwhile by a writer that found no entry to lock is left to it
+		if current, statErr := os.Stat(path); statErr == nil && os.SameFile(current, stored) {
+			if os.Rename(backup, path) != nil {
+				os.Remove(path)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// Remove the temporary files of the transfers cut short by a crash
+func (fs *FileServer) removeUploads() {
+	paths, _ := filepath.Glob(fs.config.FileDir + uploadPattern(fs.id))
+	for _, path := range paths {
+		os.Remove(path)
+	}
+}
+
+// PUT requests sending the same content to several servers as it is written
+type fanOut struct {
+	pipes   []*io.PipeWriter
+	results chan error
+	acked   int // Servers that answered 200 OK, once finished
+}
+
+func (fs *FileServer) startPuts(urls []string) *fanOut {
+	f := &fanOut{results: make(chan error, len(urls))}
+	for _, url := range urls {
+		pr, pw := io.Pipe()
+		f.pipes = append(f.pipes, pw)
+		go func(url string) {
+			err := fs.put(url, pr)
+			// Writes fail instead of blocking once the server stopped reading
+			pr.CloseWithError(err)
+			f.results <- err
+		}(url)
+	}
+	return f
+}
+
+// Writers of the request bodies, a failed request leaving the others going until finish reports it
+func (f *fanOut) writers() []io.Writer {
+	writers := make([]io.Writer, len(f.pipes))
+	for i, pw := range f.pipes {
+		writers[i] = &pipeWriter{pw: pw}
+	}
+	return writers
+}
+
+// Writer of a request body that stops writing once the request failed
+type pipeWriter struct {
+	pw     *io.PipeWriter
+	failed bool
+}
+
+func (p *pipeWriter) Write(b []byte) (int, error) {
+	if !p.failed {
+		if _, err := p.pw.Write(b); err != nil {
+			p.failed = true
+		}
+	}
+	return len(b), nil
+}
+
+// End the request bodies, aborting the requests if err isn't nil, and wait for the responses
+func (f *fanOut) finish(err error) error {
+	for _, pw := range f.pipes {
+		pw.CloseWithError(err)
+	}
+	var first error
+	for range f.pipes {
+		result := <-f.results
+		if result == nil {
+			f.acked++
+		} else if first == nil {
+			first = result
+		}
+	}
+	return first
+}
+
+// Send a PUT request streaming body, failing unless the server answers 200 OK
+func (fs *FileServer) put(url string, body io.Reader) error {
+	content := newHashingReader(body)
+	return fs.putChecksum(url, content, content.Sum)
+}
+
+// Send a PUT request streaming body, ending with the checksum trailer that checksum gives once body is read
+func (fs *FileServer) putChecksum(url string, body io.Reader, checksum func() string) error {
+	_, err := fs.putHeader(url, body, checksum)
+	return err
+}
+
+// Like putChecksum, returning the header of the response
+func (fs *FileServer) putHeader(url string, body io.Reader, checksum func() string) (http.Header, error) {
+	req, err := http.NewRequest(http.MethodPut, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	// A body of unknown length is sent in chunks, which leaves room for the trailer
+	req.Trailer = http.Header{CHECKSUM_HEADER: nil}
+	req.Body = io.NopCloser(&trailerReader{r: body, trailer: req.Trailer, checksum: checksum})
+	req.ContentLength = -1
+	client := fs.newClient(0)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		return resp.Header, fmt.Errorf("%w: %s answered %s", errDeleted, url, resp.Status)
+	}
+	if resp.StatusCode == http.StatusConflict {
+		return resp.Header, fmt.Errorf("%w: %s answered %s", errExists, url, resp.Status)
+	}
+	if resp.StatusCode == http.StatusServiceUnavailable && resp.Header.Get(ERROR_HEADER) == CODE_QUORUM {
+		return resp.Header, fmt.Errorf("%w: %s answered %s", errQuorum, url, resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return resp.Header, fmt.Errorf("%s answered %s", url, resp.Status)
+	}
+	return resp.Header, nil
+}
+
+// Send a PUT request streaming a stored file, once its content is checked
+func (fs *FileServer) putFile(url string, filename string) error {
+	file, f, err := fs.openVerified(filename, "")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return fs.putChecksum(url, io.LimitReader(file, f.size), func() string { return f.checksum })
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// A deleted file leaves a tombstone on the servers that stored it, so that a copy on a server that missed the delete
+// is neither pulled nor pushed back into place. A tombstone covers the versions of the file up to its own, a file
+// created again under the same name starts past it. Tombstones are kept in the catalog until tombstone_ttl.
+
+var errDeleted = errors.New("file was deleted")
+
+type tombstone struct {
+	version int // Latest version of the file deleted
+	rf      int // Servers that stored the file, so that the tombstone reaches the same ones
+	deleted time.Time
+}
+
+// Tombstones listed to a server looking for the files it should replicate
+type storedTombstone struct {
+	Version int `json:"version"`
+	RF      int `json:"rf"`
+}
+
+// Files and tombstones listed to a server looking for the files it should replicate, with their versions
+type storedVersions struct {
+	Files      map[string]int             `json:"files"`
+	Tombstones map[string]storedTombstone `json:"tombstones"`
+}
+
+// Tell if a version of a file was deleted
+func (fs *FileServer) buried(filename string, version int) bool {
+	fs.Mutex.Lock()
+	defer fs.Mutex.Unlock()
+	t, exists := fs.tombstones[filename]
+	return exists && t.version >= version
+}
+
+// Delete the stored copy of a file, if any, and bury the file under a tombstone covering the given version and
+// every version of the copy, its pending appends included. The names of the blocks the copy refers to are returned.
+func (fs *FileServer) deleteFile(filename string, rf int, version int) ([]string, tombstone) {
+	f, exists, unlock := fs.lockFile(filename, "", true)
+	defer unlock()
+	return fs.buryFile(filename, f, exists, rf, version)
+}
+
+// deleteFile for a caller already holding the write lock of the stored copy
+func (fs *FileServer) buryFile(filename string, f File, exists bool, rf int, version int) ([]string, tombstone) {
+	var blocks []string
+	if exists {
+		if !isBlockName(filename) {
+			blocks = fs.referencedBlocks(f)
+		}
+		version = max(version, f.version+len(f.cache))
+		rf = f.rf
+		if err := os.Remove(fs.file_dir + diskName(filename)); err != nil && !os.IsNotExist(err) {
+			log.Println("Failed to remove deleted file "+filename, err)
+		}
+		if err := fs.rewriteAppendLog(filename, nil); err != nil {
+			log.Println("Failed to remove the append log of "+filename, err)
+		}
+	}
+
+	fs.Mutex.Lock()
+	defer fs.Mutex.Unlock()
+	delete(fs.p_files, filename)
+	delete(fs.r_files, filename)
+	fs.dropChain(filename)
+	t := tombstone{version: version, rf: rf, deleted: time.Now()}
+	if old, exists := fs.tombstones[filename]; exists && old.version > t.version {
+		t.version = old.version
+	}
+	fs.tombstones[filename] = t
+	return blocks, t
+}
+
+// Names of the blocks in the block map of a stored file and in its pending appends
+func (fs *FileServer) referencedBlocks(f File) []string {
+	var maps []string
+	if data, err := os.ReadFile(fs.file_dir + diskName(f.filename)); err == nil {
+		maps = append(maps, string(data))
+	}
+	for _, k := range sortedAppends(f.cache) {
+		if content, err := fs.openAppend(f.filename, f.cache[k]); err == nil {
+			if data, err := io.ReadAll(content); err == nil {
+				maps = append(maps, string(data))
+			}
+			content.Close()
+		}
+	}
+
+	var names []string
+	for _, m := range maps {
+		blocks, err := parseBlockMap(strings.NewReader(m))
+		if err != nil {
+			log.Println("Invalid block map in deleted file "+f.filename, err)
+		}
+		for _, blk := range blocks {
+			names = append(names, blk.name)
+		}
+	}
+	return names
+}
+
+// Drop the tombstones older than tombstone_ttl, a copy missing the delete for longer may come back
+func expireTombstones(fs *FileServer) {
+	expired := false
+	fs.Mutex.Lock()
+	for filename, t := range fs.tombstones {
+		if time.Since(t.deleted) > fs.config.TombstoneTTL {
+			delete(fs.tombstones, filename)
+			expired = true
+		}
+	}
+	fs.Mutex.Unlock()
+
+	if expired {
+		fs.saveCatalog()
+	}
+}
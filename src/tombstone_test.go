@@ -0,0 +1,93 @@
+package main
+
+import (
+	"HyDFS/client"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeleteRemovesFileAndBlocks(t *testing.T) {
+	c := newTestCluster(t, 4)
+	cl := c.Client()
+
+	c.mustCreate(cl, "file.txt", "hello", 3)
+	if err := cl.Append("file.txt", strings.NewReader(" world")); err != nil {
+		t.Fatal(err)
+	}
+	c.WaitReplicas(5 * time.Second)
+	blocks, err := parseBlockMap(strings.NewReader(c.content(c.holders("file.txt")[0], "file.txt")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cl.Delete("file.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.Get("file.txt", &strings.Builder{}); !errors.Is(err, client.ErrNotExist) {
+		t.Errorf("Get of a deleted file returned %v, expected ErrNotExist", err)
+	}
+	if err := cl.Delete("file.txt"); !errors.Is(err, client.ErrNotExist) {
+		t.Errorf("Delete of a deleted file returned %v, expected ErrNotExist", err)
+	}
+	// The block of the appended content is only referenced by the append log until a merge
+	for _, name := range []string{"file.txt", blocks[0].name} {
+		if holders := c.holders(name); len(holders) != 0 {
+			t.Errorf("%s is still stored on %v", name, holders)
+		}
+	}
+	for id, node := range c.live() {
+		node.fs.Mutex.Lock()
+		for name := range node.fs.p_files {
+			t.Errorf("Node %d still stores %s", id, name)
+		}
+		for name := range node.fs.r_files {
+			t.Errorf("Node %d still stores %s", id, name)
+		}
+		node.fs.Mutex.Unlock()
+	}
+
+	// The name can be used again
+	c.mustCreate(cl, "file.txt", "again", 3)
+	if got := c.mustGet(cl, "file.txt"); got != "again" {
+		t.Errorf("Get file.txt = %q after it was created again", got)
+	}
+}
+
+func TestDeletedFileIsNotResurrected(t *testing.T) {
+	c := newTestCluster(t, 4)
+	cl := c.Client()
+
+	// Every node stores the file
+	c.mustCreate(cl, "file.txt", "hello", 4)
+	c.WaitReplicas(5 * time.Second)
+
+	// Node 3 misses the delete and comes back with its copy
+	c.Kill(3)
+	c.WaitMembership(10 * time.Second)
+	c.WaitReplicas(10 * time.Second)
+	cl = c.Client()
+	if err := cl.Delete("file.txt"); err != nil {
+		t.Fatal(err)
+	}
+	c.Start(3)
+	c.WaitJoined(3, 5*time.Second)
+	c.WaitMembership(10 * time.Second)
+
+	c.waitFor("node 3 to drop its copy", 10*time.Second, func() error {
+		for id, node := range c.live() {
+			node.fs.Mutex.Lock()
+			stored := len(node.fs.p_files) + len(node.fs.r_files)
+			node.fs.Mutex.Unlock()
+			if stored > 0 {
+				return fmt.Errorf("node %d still stores %d files", id, stored)
+			}
+		}
+		return nil
+	})
+	if err := c.Client().Get("file.txt", &strings.Builder{}); !errors.Is(err, client.ErrNotExist) {
+		t.Errorf("Get of a deleted file returned %v after node 3 rejoined, expected ErrNotExist", err)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// A merge only adds lines at the end of a block map, so the block map of an earlier version of a file is a prefix of
+// the current one and its blocks are still stored. The metadata record of a file lists the versions it retains with
+// the length of their block maps: the create, then the version each merge reaches. Versions are numbered like the
+// writes of the file, a merge of k appends going from version v to v+k.
+
+var errNoVersion = errors.New("no retained version")
+
+var errInvalidVersion = errors.New("invalid version")
+
+type fileVersion struct {
+	Version int       `json:"version"`
+	Time    time.Time `json:"time"`     // Of the create or of the merge
+	Size    int64     `json:"size"`     // Of the content
+	MapSize int64     `json:"map_size"` // Of the block map
+}
+
+// Versions of a file retained under kept_versions and version_ttl, the current one always being
+func (fs *FileServer) retainedVersions(versions []fileVersion) []fileVersion {
+	if fs.config.KeptVersions > 0 && len(versions) > fs.config.KeptVersions {
+		versions = versions[len(versions)-fs.config.KeptVersions:]
+	}
+	for len(versions) > 1 && fs.config.VersionTTL > 0 && time.Since(versions[0].Time) > fs.config.VersionTTL {
+		versions = versions[1:]
+	}
+	return versions
+}
+
+// Record a new version of a file, forgetting the versions that are no longer retained
+func (fs *FileServer) withVersion(meta fileMeta, v fileVersion) fileMeta {
+	// The history is copied, copies of the entry share the previous one
+	versions := append(append(make([]fileVersion, 0, len(meta.Versions)+1), meta.Versions...), v)
+	meta.Versions = fs.retainedVersions(versions)
+	return meta
+}
+
+// Query selecting a version of a file, by number or as of a time, "" for the current content
+func versionQuery(version int, asOf time.Time) string {
+	query := url.Values{}
+	if version > 0 {
+		query.Set("version", strconv.Itoa(version))
+	}
+	if !asOf.IsZero() {
+		query.Set("asof", asOf.Format(time.RFC3339Nano))
+	}
+	return query.Encode()
+}
+
+// Version of a file a query selects, nil for the current content. A query that can't be parsed gives errInvalidVersion.
+func (fs *FileServer) selectVersion(meta fileMeta, query url.Values) (*fileVersion, error) {
+	versions := fs.retainedVersions(meta.Versions)
+	if s := query.Get("version"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("%w %q", errInvalidVersion, s)
+		}
+		for _, v := range versions {
+			if v.Version == n {
+				return &v, nil
+			}
+		}
+		return nil, fmt.Errorf("%w %s", errNoVersion, s)
+	}
+	if s := query.Get("asof"); s != "" {
+		asOf, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return nil, fmt.Errorf("%w, time %q: %v", errInvalidVersion, s, err)
+		}
+		for i := len(versions) - 1; i >= 0; i-- {
+			if !versions[i].Time.After(asOf) {
+				return &versions[i], nil
+			}
+		}
+		return nil, fmt.Errorf("%w as of %s", errNoVersion, s)
+	}
+	return nil, nil
+}
+
+// Send the block map of a version of a file, read from the opened block map of the current one
+func (fs *FileServer) sendVersion(w http.ResponseWriter, file *os.File, f File, v fileVersion) {
+	block_map, err := io.ReadAll(io.NewSectionReader(file, 0, v.MapSize))
+	if err == nil && int64(len(block_map)) < v.MapSize {
+		err = fmt.Errorf("block map of %d bytes, version %d has %d", len(block_map), v.Version, v.MapSize)
+	}
+	if err != nil {
+		httpError(w, errorCode(err), "Could not read file: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sum := sha256.Sum256(block_map)
+	w.Header().Set("Replication-Factor", strconv.Itoa(f.rf))
+	w.Header().Set("Version", strconv.Itoa(v.Version))
+	w.Header().Set("File-Size", strconv.Itoa(len(block_map)))
+	w.Header().Set("Content-Length", strconv.Itoa(len(block_map)))
+	w.Header().Set(CHECKSUM_HEADER, hex.EncodeToString(sum[:]))
+	io.Copy(w, bytes.NewReader(block_map))
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"HyDFS/client"
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetEarlierVersions(t *testing.T) {
+	c := newTestCluster(t, 4)
+	cl := c.Client()
+
+	// The test cluster keeps 3 versions
+	c.mustCreate(cl, "file.txt", "v1", 3)
+	times := map[int]time.Time{1: time.Now()}
+	for _, appends := range [][]string{{"a"}, {"b", "c"}, {"d"}} {
+		for _, s := range appends {
+			if err := cl.Append("file.txt", strings.NewReader(s)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := cl.Merge("file.txt"); err != nil {
+			t.Fatal(err)
+		}
+		times[len(times)+1] = time.Now()
+	}
+
+	versions, err := cl.Versions("file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var numbers []int
+	for _, v := range versions {
+		numbers = append(numbers, v.Version)
+	}
+	if len(versions) != 3 || numbers[0] != 2 || numbers[1] != 4 || numbers[2] != 5 || versions[1].Size != 5 {
+		t.Fatalf("versions = %+v, expected 2, 4 and 5", versions)
+	}
+
+	for version, expected := range map[int]string{2: "v1a", 4: "v1abc", 5: "v1abcd"} {
+		var b strings.Builder
+		if err := cl.GetVersion("file.txt", version, &b); err != nil || b.String() != expected {
+			t.Errorf("GetVersion %d = %q, %v, expected %q", version, b.String(), err, expected)
+		}
+	}
+	for _, version := range []int{1, 3, 6} {
+		if err := cl.GetVersion("file.txt", version, &strings.Builder{}); !errors.Is(err, client.ErrVersion) {
+			t.Errorf("GetVersion %d returned %v, expected ErrVersion", version, err)
+		}
+	}
+
+	// times[1] follows the create and times[i+1] the i-th merge, which made versions 2, 4 and 5
+	for i, expected := range map[int]string{2: "v1a", 3: "v1abc", 4: "v1abcd"} {
+		var b strings.Builder
+		if err := cl.GetAsOf("file.txt", times[i], &b); err != nil || b.String() != expected {
+			t.Errorf("GetAsOf %v = %q, %v, expected %q", times[i], b.String(), err, expected)
+		}
+	}
+	if err := cl.GetAsOf("file.txt", times[1], &strings.Builder{}); !errors.Is(err, client.ErrVersion) {
+		t.Errorf("GetAsOf before the retained versions returned %v, expected ErrVersion", err)
+	}
+
+	// The current content is unchanged
+	if got := c.mustGet(cl, "file.txt"); got != "v1abcd" {
+		t.Errorf("Get file.txt = %q", got)
+	}
+}
+
+func TestSelectVersionRejectsInvalidQueries(t *testing.T) {
+	fs := &FileServer{}
+	meta := fileMeta{Versions: []fileVersion{{Version: 1, Time: time.Now()}}}
+	for _, query := range []url.Values{{"version": {"abc"}}, {"version": {"0"}}, {"asof": {"yesterday"}}} {
+		if _, err := fs.selectVersion(meta, query); !errors.Is(err, errInvalidVersion) {
+			t.Errorf("selectVersion(%v) returned %v, expected errInvalidVersion", query, err)
+		}
+	}
+	if _, err := fs.selectVersion(meta, url.Values{"version": {"2"}}); !errors.Is(err, errNoVersion) {
+		t.Errorf("selectVersion of a version not retained returned %v, expected errNoVersion", err)
+	}
+}
@@ -1,28 +1,85 @@
+import hashlib
 import requests
 import random
+import sys
+import threading
+import uuid
+import yaml
 from concurrent.futures import ThreadPoolExecutor
 
-HTTP_PORT = "4444"
 FILE_PATH_PREFIX = "../files/client/"
+CONFIG_FILE = sys.argv[1] if len(sys.argv) > 1 else "../config.yaml"
+
+
+def load_registry(filename):
+    # Node id -> "http://host:port" of its file server, as listed in the config file
+    with open(filename) as f:
+        config = yaml.safe_load(f)
+    return {node["id"]: f"http://{node['host']}:{node['http_port']}" for node in config["nodes"]}
+
 
 # List of server addresses to check
-server_addresses = ["http://fa24-cs425-6801.cs.illinois.edu", 
-                    "http://fa24-cs425-6802.cs.illinois.edu",
-                    "http://fa24-cs425-6803.cs.illinois.edu", 
-                    "http://fa24-cs425-6804.cs.illinois.edu",
-                    "http://fa24-cs425-6805.cs.illinois.edu", 
-                    "http://fa24-cs425-6806.cs.illinois.edu",
-                    "http://fa24-cs425-6807.cs.illinois.edu", 
-                    "http://fa24-cs425-6808.cs.illinois.edu",
-                    "http://fa24-cs425-6809.cs.illinois.edu", 
-                    "http://fa24-cs425-6810.cs.illinois.edu"]
+server_addresses = load_registry(CONFIG_FILE)
+
+
+# Appends are numbered and sent with the latest clock of the servers this client heard from, so that the servers apply
+# them after the previous ones and after everything this client saw, whichever coordinators they go through
+CLIENT_ID = uuid.uuid4().hex
+append_state = {"seq": 0, "after": ""}
+# Last append to each file, sent with the gets of the file so that they read the appends of this client
+written = {}
+append_lock = threading.Lock()
+
+
+def checksum_header(path):
+    # The servers reject uploads that don't give the SHA-256 of their content
+    h = hashlib.sha256()
+    with open(path, 'rb') as f:
+        for chunk in iter(lambda: f.read(1 << 20), b""):
+            h.update(chunk)
+    return {"Checksum": h.hexdigest()}
+
+
+def append_params(hydfs, num):
+    with append_lock:
+        append_state["seq"] += 1
+        return {"filename": hydfs, "num": num, "client": CLIENT_ID, "seq": append_state["seq"], "after": append_state["after"]}
+
+
+def stamp_key(stamp):
+    # Servers send their hybrid logical clock as "wall.logical", "" being before any other
+    wall, _, logical = stamp.partition(".")
+    return (int(wall or 0), int(logical or 0))
+
+
+def observe(response):
+    # The latest clock is kept
+    for stamp in (response.headers.get("HLC", ""), response.headers.get("Append-Timestamp", "")):
+        with append_lock:
+            if stamp and stamp_key(stamp) > stamp_key(append_state["after"]):
+                append_state["after"] = stamp
+
+
+def appended(response, params):
+    observe(response)
+    with append_lock:
+        if response.ok and params["seq"] > written.get(params["filename"], 0):
+            written[params["filename"]] = params["seq"]
+
+
+def session(data):
+    with append_lock:
+        if data["hydfs"] in written:
+            data["client"] = CLIENT_ID
+            data["seq"] = str(written[data["hydfs"]])
+    return data
 
 
 def find_live_server():
-    random_number = random.randint(1, 10)
-    for i in range(10):
-        address = server_addresses[(random_number + i)%10]
-        url = f"{address}:" + HTTP_PORT
+    ids = sorted(server_addresses)
+    random_number = random.randrange(len(ids))
+    for i in range(len(ids)):
+        url = server_addresses[ids[(random_number + i) % len(ids)]]
         try:
             response = requests.get(url, timeout=2)
             if response.status_code == 200:
@@ -38,16 +95,22 @@ def handle_user_input(user_input):
     if len(parts) == 0:
         return True
 
+    # create, append and get take their quorums first, --w for the copies a write waits for and --r for those a get reads
+    quorum = {}
+    while len(parts) >= 3 and parts[0] in ("create", "append", "get") and parts[1] in ("--w", "--r"):
+        quorum[parts[1][2:]] = parts[2]
+        del parts[1:3]
+
     if parts[0] == 'exit':
         return False
 
     if parts[0] == "list_mem_ids" and len(parts) == 2:
         try:
             server_id = int(parts[1])
-            if server_id > 10 or server_id < 1:
+            if server_id not in server_addresses:
                 print("Invalid server id!")
                 return True
-            address = server_addresses[server_id - 1] + ":" + HTTP_PORT
+            address = server_addresses[server_id]
             response = requests.get(address, timeout=2)
             if response.status_code == 200:
                 print(f"Connected to live server at {address}")
@@ -61,10 +124,10 @@ def handle_user_input(user_input):
     if parts[0] == 'online' and len(parts) == 2:
         try:
             server_id = int(parts[1])
-            if server_id > 10 or server_id < 1:
+            if server_id not in server_addresses:
                 print("Invalid server id!")
                 return True
-            address = server_addresses[server_id - 1] + ":" + HTTP_PORT
+            address = server_addresses[server_id]
             response = requests.get(address, timeout=2)
             if response.status_code == 200:
                 print(f"Connected to live server at {address}")
@@ -90,15 +153,18 @@ def handle_user_input(user_input):
         return True
 
 
-    if parts[0] == "create" and len(parts) == 3:  # dd if=/dev/urandom of=largefile.txt bs=1M count=100
+    if parts[0] == "create" and len(parts) in (3, 4):  # dd if=/dev/urandom of=largefile.txt bs=1M count=100
                                                 # Above is a good way of generating a large text file with random text.
         local, hydfs = parts[1], parts[2]
         
         live_server = find_live_server()
         if live_server:
             try:
-                # Step 1: Request authorization to create the file
+                # Step 1: Request authorization to create the file, optionally with its replication factor
                 data = {"local": local, "hydfs": hydfs}
+                if len(parts) == 4:
+                    data["rf"] = parts[3]
+                data.update(quorum)
                 response = requests.post(f"{live_server}/create", json=data)
                 
                 if response.ok:
@@ -106,10 +172,10 @@ def handle_user_input(user_input):
                     
                     # Step 2: Send the actual file content
                     with open(FILE_PATH_PREFIX + local, 'rb') as f:
-                        upload_response = requests.put(f"{live_server}/create?filename={hydfs}", data=f)
+                        upload_response = requests.put(f"{live_server}/create", params={"filename": hydfs}, data=f, headers=checksum_header(FILE_PATH_PREFIX + local))
                     
                     if upload_response.ok:
-                        print("File upload complete")
+                        print(f"File upload complete, {upload_response.headers.get('Replica-Acks')} copies acknowledged")
                     else:
                         print("File upload failed:", upload_response.text)
                 else:
@@ -136,10 +202,14 @@ def handle_user_input(user_input):
                     
                     # Step 2: Send the actual file content
                     with open(FILE_PATH_PREFIX + local, 'rb') as f:
-                        upload_response = requests.put(f"{live_server}/append?filename={hydfs}&num=0", data=f)
+                        params = append_params(hydfs, 0)
+                        if "w" in quorum:
+                            params["w"] = quorum["w"]
+                        upload_response = requests.put(f"{live_server}/append", params=params, data=f, headers=checksum_header(FILE_PATH_PREFIX + local))
+                    appended(upload_response, params)
                     
                     if upload_response.ok:
-                        print("File upload complete")
+                        print(f"File upload complete, {upload_response.headers.get('Replica-Acks')} copies acknowledged")
                     else:
                         print("File upload failed:", upload_response.text)
                 else:
@@ -175,9 +245,11 @@ def handle_user_input(user_input):
                     upload_futures = []
                     for i, local in enumerate(local_files):
                         with open(FILE_PATH_PREFIX + local, 'rb') as f:
-                            upload_futures.append((local, requests.put(f"{live_server}/append?filename={hydfs}&num={i}", data=f)))
+                            params = append_params(hydfs, i)
+                            upload_futures.append((local, params, requests.put(f"{live_server}/append", params=params, data=f, headers=checksum_header(FILE_PATH_PREFIX + local))))
 
-                    for local, upload_response in upload_futures:
+                    for local, params, upload_response in upload_futures:
+                        appended(upload_response, params)
                         if upload_response.ok:
                             print(f"File {local} upload complete")
                         else:
@@ -196,8 +268,10 @@ def handle_user_input(user_input):
         if live_server:
             try:
                 # Step 1: Request authorization to create the file
-                data = {"local": local, "hydfs": hydfs}
+                data = session({"local": local, "hydfs": hydfs})
+                data.update(quorum)
                 response = requests.get(f"{live_server}/get", json=data)
+                observe(response)
 
                 if response.ok:
                     # Ensure correct encoding
@@ -218,6 +292,61 @@ def handle_user_input(user_input):
         return True
 
 
+    if parts[0] == "get" and len(parts) == 5 and parts[1] in ("--version", "--as-of"):
+        # get --version N HyDFSfilename localfilename, or --as-of time for the version current at an RFC 3339 time
+        hydfs, local = parts[3], parts[4]
+        data = {"local": local, "hydfs": hydfs}
+        data["version" if parts[1] == "--version" else "as_of"] = parts[2]
+
+        live_server = find_live_server()
+        if live_server:
+            try:
+                response = requests.get(f"{live_server}/get", json=data)
+
+                if response.ok:
+                    with open(FILE_PATH_PREFIX + local, 'wb') as f:
+                        f.write(response.content)
+                    print("File get successfully!")
+                else:
+                    print("Get file failed:", response.text)
+
+            except requests.RequestException as e:
+                print("Request to server failed:", e)
+        else:
+            print("No live servers available")
+        return True
+
+    if parts[0] == "get" and len(parts) in (4, 5):
+        # get HyDFSfilename localfilename offset [length], length defaulting to the end of the file
+        hydfs, local = parts[1], parts[2]
+        try:
+            offset = int(parts[3])
+            length = int(parts[4]) if len(parts) == 5 else 0
+        except ValueError:
+            print("Offset and length must be integers")
+            return True
+        byte_range = f"bytes={offset}-{offset + length - 1}" if length > 0 else f"bytes={offset}-"
+
+        live_server = find_live_server()
+        if live_server:
+            try:
+                data = session({"local": local, "hydfs": hydfs})
+                response = requests.get(f"{live_server}/get", json=data, headers={"Range": byte_range})
+                observe(response)
+
+                if response.ok:
+                    with open(FILE_PATH_PREFIX + local, 'wb') as f:
+                        f.write(response.content)
+                    print(f"Got {response.headers.get('Content-Range', 'the whole file')}, the file is {response.headers.get('File-Size')} bytes")
+                else:
+                    print("Get file failed:", response.text)
+
+            except requests.RequestException as e:
+                print("Request to server failed:", e)
+        else:
+            print("No live servers available")
+        return True
+
     if parts[0] == "getfromreplica" and len(parts) == 4:  
         vm_id, hydfs, local = parts[1], parts[2], parts[3]
         
@@ -225,7 +354,7 @@ def handle_user_input(user_input):
         if live_server:
             try:
                 # Step 1: Request authorization to create the file
-                data = {"local": local, "hydfs": hydfs, "vm_add": server_addresses[int(vm_id)-1]}
+                data = {"local": local, "hydfs": hydfs, "vm_id": vm_id}
                 response = requests.get(f"{live_server}/getfromreplica", json=data)
                 
                 if response.ok:
@@ -249,7 +378,7 @@ def handle_user_input(user_input):
         if live_server:
             try:
                 # Step 1: Request authorization to create the file
-                response = requests.get(f"{live_server}/ls?filename={hydfs}")
+                response = requests.get(f"{live_server}/ls", params={"filename": hydfs})
                 
                 if response.ok:
                     # Step 2: Send the actual file content
@@ -269,7 +398,7 @@ def handle_user_input(user_input):
         live_server = find_live_server()
         if live_server:
             try:
-                response = requests.get(f"{live_server}/merge?filename={filename}")
+                response = requests.get(f"{live_server}/merge", params={"filename": filename})
                 
                 if response.ok:
                     print("File merged successfully!")
@@ -282,6 +411,146 @@ def handle_user_input(user_input):
             print("No live servers available")
         return True
 
+    if parts[0] == "delete" and len(parts) == 2:
+        filename = parts[1]
+
+        live_server = find_live_server()
+        if live_server:
+            try:
+                response = requests.delete(f"{live_server}/delete", params={"filename": filename})
+
+                if response.ok:
+                    print("File deleted successfully!")
+                else:
+                    print("Delete file failed:", response.text)
+
+            except requests.RequestException as e:
+                print("Request to server failed:", e)
+        else:
+            print("No live servers available")
+        return True
+
+    if parts[0] == "rename" and len(parts) == 3:
+        filename, newname = parts[1], parts[2]
+
+        live_server = find_live_server()
+        if live_server:
+            try:
+                response = requests.post(f"{live_server}/rename", params={"filename": filename, "newname": newname})
+
+                if response.ok:
+                    print("File renamed successfully!")
+                else:
+                    print("Rename file failed:", response.text)
+
+            except requests.RequestException as e:
+                print("Request to server failed:", e)
+        else:
+            print("No live servers available")
+        return True
+
+    if parts[0] == "mkdir" and len(parts) == 2:
+        dirname = parts[1]
+
+        live_server = find_live_server()
+        if live_server:
+            try:
+                response = requests.post(f"{live_server}/mkdir", params={"dirname": dirname})
+
+                if response.ok:
+                    print("Directory created successfully!")
+                else:
+                    print("Mkdir failed:", response.text)
+
+            except requests.RequestException as e:
+                print("Request to server failed:", e)
+        else:
+            print("No live servers available")
+        return True
+
+    if parts[0] == "find" and len(parts) in (1, 2):
+        prefix = parts[1] if len(parts) == 2 else ""
+
+        live_server = find_live_server()
+        if live_server:
+            try:
+                response = requests.get(f"{live_server}/find", params={"prefix": prefix})
+
+                if response.ok:
+                    print(response.text, end="")
+                else:
+                    print("Find failed:", response.text)
+
+            except requests.RequestException as e:
+                print("Request to server failed:", e)
+        else:
+            print("No live servers available")
+        return True
+
+    if parts[0] == "list" and len(parts) in (1, 2, 3):
+        prefix = parts[1] if len(parts) >= 2 else ""
+        sort = parts[2] if len(parts) == 3 else "name"
+
+        live_server = find_live_server()
+        if live_server:
+            try:
+                response = requests.get(f"{live_server}/list", params={"prefix": prefix, "sort": sort})
+
+                if response.ok:
+                    for f in response.json():
+                        print(f"{f['name']}\t{f['size']}\t{f['created']}\t{f['merged']}\t{f['pending']}\t{f['replicas']}\t{f['owners']}")
+                else:
+                    print("List failed:", response.text)
+
+            except requests.RequestException as e:
+                print("Request to server failed:", e)
+        else:
+            print("No live servers available")
+        return True
+
+    if parts[0] == "stat" and len(parts) == 2:
+        hydfs_filename = parts[1]
+
+        live_server = find_live_server()
+        if live_server:
+            try:
+                response = requests.get(f"{live_server}/stat", params={"filename": hydfs_filename})
+
+                if response.ok:
+                    stat = response.json()
+                    for key in ("name", "size", "rf", "version", "pending", "replicas", "creator", "created", "modified", "merged"):
+                        print(f"{key}: {stat[key]}")
+                    for a in stat["appends"] or []:
+                        print(f"append: {a['time']} {a['size']} bytes from {a['client']}")
+                else:
+                    print("Stat failed:", response.text)
+
+            except requests.RequestException as e:
+                print("Request to server failed:", e)
+        else:
+            print("No live servers available")
+        return True
+
+
+    if parts[0] == "versions" and len(parts) == 2:
+        hydfs_filename = parts[1]
+
+        live_server = find_live_server()
+        if live_server:
+            try:
+                response = requests.get(f"{live_server}/stat", params={"filename": hydfs_filename})
+
+                if response.ok:
+                    for v in response.json()["versions"] or []:
+                        print(f"{v['version']}\t{v['time']}\t{v['size']}")
+                else:
+                    print("Versions failed:", response.text)
+
+            except requests.RequestException as e:
+                print("Request to server failed:", e)
+        else:
+            print("No live servers available")
+        return True
 
     print("Not a valid command")
     # ...